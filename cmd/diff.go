@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/sync"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var errDrift = errors.New("replicas differ from origin")
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:          "diff",
+	Short:        "Show the differences between origin and the replicas",
+	Long:         `Compares all enabled features of the origin instance with each replica and exits with a non-zero code if they differ`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger = log.GetLogger("diff")
+		output, _ := cmd.Flags().GetString("output")
+		if output != outputText && output != outputJSON {
+			return fmt.Errorf("unsupported output format %q", output)
+		}
+
+		cfg, err := getConfig()
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+		// the diff is printed to stdout in both formats
+		if err := log.StdoutToStderr(); err != nil {
+			return err
+		}
+
+		run, err := sync.DryRun(cfg)
+		if err != nil {
+			return err
+		}
+		sortRun(run)
+
+		if output == outputJSON {
+			err = printJSON(cmd.OutOrStdout(), run)
+		} else {
+			err = printDiff(cmd.OutOrStdout(), run)
+		}
+		if err != nil {
+			return err
+		}
+
+		if run.HasErrors() {
+			return errors.New("diff finished with errors")
+		}
+		if run.HasChanges() {
+			return errDrift
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringP("output", "o", outputText, "Output format (text|json)")
+}
+
+func sortRun(run *types.Run) {
+	sort.Slice(run.Replicas, func(i, j int) bool {
+		return run.Replicas[i].Replica < run.Replicas[j].Replica
+	})
+	for _, rr := range run.Replicas {
+		sort.SliceStable(rr.Changes, func(i, j int) bool {
+			if rr.Changes[i].Feature != rr.Changes[j].Feature {
+				return rr.Changes[i].Feature < rr.Changes[j].Feature
+			}
+			return rr.Changes[i].Key < rr.Changes[j].Key
+		})
+	}
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printDiff(out io.Writer, run *types.Run) error {
+	p := &printer{out: out}
+	p.printf("origin: %s\n", run.Origin)
+	if run.Error != "" {
+		p.printf("  error: %s\n", run.Error)
+	}
+	for _, c := range run.Conflicts {
+		if c.Winner != "" {
+			p.printf("  conflict: %s [%s] (%s: %s)\n", c.Section, c.Key, c.Resolution, c.Winner)
+		} else {
+			p.printf("  conflict: %s [%s] (%s)\n", c.Section, c.Key, c.Resolution)
+		}
+	}
+	for _, rr := range run.Replicas {
+		switch {
+		case rr.Error != "":
+			p.printf("replica: %s (error: %s)\n", rr.Replica, rr.Error)
+		case len(rr.Changes) == 0:
+			p.printf("replica: %s (in sync)\n", rr.Replica)
+		default:
+			p.printf("replica: %s (%d differences)\n", rr.Replica, len(rr.Changes))
+		}
+		for _, c := range rr.Changes {
+			p.printChange(c)
+		}
+		for _, c := range rr.SkippedDeletes {
+			p.printf("  ! %s [%s] (delete skipped)\n", c.Feature, c.Key)
+		}
+	}
+	return p.err
+}
+
+type printer struct {
+	out io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, a ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.out, format, a...)
+	}
+}
+
+func (p *printer) printChange(c types.Change) {
+	var sign string
+	switch c.Action {
+	case types.ActionAdd:
+		sign = "+"
+	case types.ActionDelete:
+		sign = "-"
+	default:
+		sign = "~"
+	}
+	if c.Key != "" {
+		p.printf("  %s %s [%s]\n", sign, c.Feature, c.Key)
+	} else {
+		p.printf("  %s %s\n", sign, c.Feature)
+	}
+	if c.Before != nil {
+		p.printf("      replica: %s\n", compactJSON(c.Before))
+	}
+	if c.After != nil {
+		p.printf("      origin:  %s\n", compactJSON(c.After))
+	}
+}
+
+func compactJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Diff", func() {
+	var run *types.Run
+	BeforeEach(func() {
+		run = &types.Run{
+			Origin: "https://origin",
+			Replicas: []*types.ReplicaResult{
+				{
+					Replica: "https://replica2",
+					Changes: []types.Change{
+						{Feature: types.FeatureDNSRewrites, Action: types.ActionDelete, Key: "b#2", Before: types.RewriteEntry{Domain: "b", Answer: "2"}},
+						{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd, Key: "a#1", After: types.RewriteEntry{Domain: "a", Answer: "1"}},
+						{Feature: types.FeatureStatsConfig, Action: types.ActionUpdate, Before: &types.IntervalConfig{Interval: 1}, After: &types.IntervalConfig{Interval: 2}},
+					},
+				},
+				{Replica: "https://replica1"},
+			},
+		}
+	})
+	Context("sortRun", func() {
+		It("should sort replicas and changes", func() {
+			sortRun(run)
+			Ω(run.Replicas[0].Replica).Should(Equal("https://replica1"))
+			Ω(run.Replicas[1].Changes[0].Key).Should(Equal("a#1"))
+			Ω(run.Replicas[1].Changes[1].Key).Should(Equal("b#2"))
+			Ω(run.Replicas[1].Changes[2].Feature).Should(Equal(types.FeatureStatsConfig))
+		})
+	})
+	Context("printDiff", func() {
+		It("should print a human readable diff", func() {
+			sortRun(run)
+			out := &bytes.Buffer{}
+			Ω(printDiff(out, run)).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(`origin: https://origin
+replica: https://replica1 (in sync)
+replica: https://replica2 (3 differences)
+  + dns.rewrites [a#1]
+      origin:  {"domain":"a","answer":"1"}
+  - dns.rewrites [b#2]
+      replica: {"domain":"b","answer":"2"}
+  ~ statsConfig
+      replica: {"interval":1}
+      origin:  {"interval":2}
+`))
+		})
+		It("should print the conflicts", func() {
+			run.Replicas = nil
+			run.Conflicts = []types.Conflict{
+				{Section: "clients", Key: "laptop", Resolution: types.ResolutionPreferOrigin, Winner: "https://origin"},
+				{Section: "filters", Key: "https://list", Resolution: types.ResolutionManual},
+			}
+			out := &bytes.Buffer{}
+			Ω(printDiff(out, run)).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(`origin: https://origin
+  conflict: clients [laptop] (prefer-origin: https://origin)
+  conflict: filters [https://list] (manual)
+`))
+		})
+		It("should print the skipped deletes", func() {
+			run.Replicas[1].SkippedDeletes = []types.Change{
+				{Feature: types.FeatureClientSettings, Action: types.ActionDelete, Key: "client1"},
+			}
+			sortRun(run)
+			out := &bytes.Buffer{}
+			Ω(printDiff(out, run)).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(`origin: https://origin
+replica: https://replica1 (in sync)
+  ! clientSettings [client1] (delete skipped)
+replica: https://replica2 (3 differences)
+  + dns.rewrites [a#1]
+      origin:  {"domain":"a","answer":"1"}
+  - dns.rewrites [b#2]
+      replica: {"domain":"b","answer":"2"}
+  ~ statsConfig
+      replica: {"interval":1}
+      origin:  {"interval":2}
+`))
+		})
+	})
+	Context("output", func() {
+		var stdout, stderr *os.File
+		BeforeEach(func() {
+			stdout, stderr = failingInstances()
+		})
+		It("should print only the text diff to stdout", func() {
+			Ω(diffCmd.RunE(diffCmd, nil)).Should(MatchError("diff finished with errors"))
+
+			out, err := os.ReadFile(stdout.Name())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(out)).Should(HavePrefix("origin: "))
+			Ω(string(out)).ShouldNot(ContainSubstring("ERROR"))
+
+			logs, err := os.ReadFile(stderr.Name())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(logs)).Should(ContainSubstring("Error"))
+		})
+		It("should print only the report to stdout", func() {
+			Ω(diffCmd.Flags().Set("output", outputJSON)).ShouldNot(HaveOccurred())
+			defer func() { _ = diffCmd.Flags().Set("output", outputText) }()
+			Ω(diffCmd.RunE(diffCmd, nil)).Should(MatchError("diff finished with errors"))
+
+			out, err := os.ReadFile(stdout.Name())
+			Ω(err).ShouldNot(HaveOccurred())
+			run := &types.Run{}
+			Ω(json.Unmarshal(out, run)).ShouldNot(HaveOccurred())
+			Ω(run.Error).ShouldNot(BeEmpty())
+
+			logs, err := os.ReadFile(stderr.Name())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(logs)).Should(ContainSubstring("Error"))
+		})
+	})
+})
+
+// failingInstances configures an origin and a replica that answer with an error and replaces stdout and stderr with
+// files, they are reset after the test
+func failingInstances() (stdout *os.File, stderr *os.File) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	initConfig()
+	viper.Set("origin.url", srv.URL)
+	viper.Set("replica.url", srv.URL+"/replica")
+
+	var err error
+	stdout, err = os.CreateTemp(GinkgoT().TempDir(), "stdout")
+	Ω(err).ShouldNot(HaveOccurred())
+	stderr, err = os.CreateTemp(GinkgoT().TempDir(), "stderr")
+	Ω(err).ShouldNot(HaveOccurred())
+	osOut, osErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	// reopen the log outputs with the replaced stdout
+	Ω(log.Configure("", []string{"stderr"})).ShouldNot(HaveOccurred())
+	Ω(log.Configure("", []string{"stdout"})).ShouldNot(HaveOccurred())
+
+	DeferCleanup(func() {
+		os.Stdout, os.Stderr = osOut, osErr
+		Ω(log.Configure("", []string{"stderr"})).ShouldNot(HaveOccurred())
+		Ω(log.Configure("", []string{"stdout"})).ShouldNot(HaveOccurred())
+		viper.Set("origin.url", "")
+		viper.Set("replica.url", "")
+		srv.Close()
+	})
+	return stdout, stderr
+}
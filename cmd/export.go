@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/sync"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:          "export",
+	Short:        "Export the configuration of the origin as declarative file",
+	Long:         `Reads the configuration of the origin instance and writes it sorted and without volatile fields, to be used as origin file`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger = log.GetLogger("export")
+		cfg, err := getConfig()
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+
+		file, _ := cmd.Flags().GetString("file")
+		format, _ := cmd.Flags().GetString("format")
+		if format == "" {
+			format = snapshot.FormatOf(file)
+		}
+		if file == "" {
+			if err := log.StdoutToStderr(); err != nil {
+				return err
+			}
+		}
+
+		snap, err := sync.Export(cfg)
+		if err != nil {
+			return err
+		}
+		b, err := snapshot.Export(snap, format)
+		if err != nil {
+			return err
+		}
+
+		if file == "" {
+			_, err = cmd.OutOrStdout().Write(b)
+			return err
+		}
+		if err := os.WriteFile(file, b, 0o600); err != nil {
+			return err
+		}
+		logger.With("file", file).Info("Origin config exported")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringP("file", "f", "", "The file to write the config to (default stdout)")
+	exportCmd.Flags().String("format", "", "The format of the config (yaml|json), by default derived from the file extension")
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+	It("should write the logs to stderr if the config is written to stdout", func() {
+		stdout, stderr := failingInstances()
+		exportCmd.SetOut(stdout)
+		defer exportCmd.SetOut(nil)
+		Ω(exportCmd.RunE(exportCmd, nil)).Should(HaveOccurred())
+
+		out, err := os.ReadFile(stdout.Name())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(BeEmpty())
+
+		logs, err := os.ReadFile(stderr.Name())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(logs)).Should(ContainSubstring("Error"))
+		Ω(string(logs)).ShouldNot(ContainSubstring(`"run_id": ""`))
+	})
+})
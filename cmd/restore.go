@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/sync"
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:          "restore <snapshot-file>",
+	Short:        "Restore a snapshot to the origin or replica instances",
+	Long:         `Applies the configuration of a snapshot file to the target instances, the target is either 'origin', 'replicas' or the url of a configured replica`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger = log.GetLogger("restore")
+		cfg, err := getConfig()
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+
+		snap, err := snapshot.Load(args[0])
+		if err != nil {
+			return err
+		}
+
+		targets, _ := cmd.Flags().GetStringSlice("target")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if dryRun {
+			if err := log.StdoutToStderr(); err != nil {
+				return err
+			}
+		}
+		run, err := sync.Restore(cfg, snap, args[0], dryRun, targets...)
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			sortRun(run)
+			if err := printJSON(cmd.OutOrStdout(), run); err != nil {
+				return err
+			}
+		}
+		if run.HasErrors() {
+			return errors.New("restore finished with errors")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringSliceP("target", "t", nil, "The instances to restore the snapshot to (origin|replicas|<replica url>)")
+	restoreCmd.Flags().Bool("dry-run", false, "Print the changes the restore would apply without applying them")
+}
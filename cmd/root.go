@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/bakito/adguardhome-sync/pkg/log"
@@ -14,14 +16,42 @@ import (
 )
 
 const (
-	configCron       = "cron"
-	configRunOnStart = "runOnStart"
+	configCron                = "cron"
+	configRunOnStart          = "runOnStart"
+	configMaxParallelReplicas = "maxParallelReplicas"
+	configDeletes             = "deletes"
+	configContinueOnError     = "continueOnError"
+	configForce               = "force"
+
+	configDeleteGuardMaxCount    = "deleteGuard.maxCount"
+	configDeleteGuardMaxPercent  = "deleteGuard.maxPercent"
+	configDeleteGuardEmptyOrigin = "deleteGuard.emptyOrigin"
+	configDeleteGuardForce       = "deleteGuard.force"
+
+	configMultiMasterEnabled    = "multiMaster.enabled"
+	configMultiMasterResolution = "multiMaster.resolution"
+
+	configBackupDir      = "backup.dir"
+	configBackupFormat   = "backup.format"
+	configBackupMaxCount = "backup.maxCount"
+	configBackupMaxAge   = "backup.maxAge"
+
+	configStateFile = "state.file"
+
+	configWatchInterval = "watch.interval"
+	configWatchDebounce = "watch.debounce"
 
 	configAPIPort     = "api.port"
 	configAPIUsername = "api.username"
 	configAPIPassword = "api.password"
 	configAPIDarkMode = "api.darkMode"
 
+	configLogFormat = "log.format"
+	configLogOutput = "log.output"
+
+	configAPIWebhookSecret = "api.webhook.secret" // #nosec G101
+	configAPIWebhookMaxAge = "api.webhook.maxAge"
+
 	configFeatureDHCPServerConfig = "features.dhcp.serverConfig"
 	configFeatureDHCPStaticLeases = "features.dhcp.staticLeases"
 	configFeatureDNServerConfig   = "features.dns.serverConfig"
@@ -39,6 +69,7 @@ const (
 	configOriginUsername           = "origin.username"
 	configOriginPassword           = "origin.password"
 	configOriginInsecureSkipVerify = "origin.insecureSkipVerify"
+	configOriginFile               = "origin.file"
 
 	configReplicaURL                = "replica.url"
 	configReplicaAPIPath            = "replica.apiPath"
@@ -47,6 +78,7 @@ const (
 	configReplicaInsecureSkipVerify = "replica.insecureSkipVerify"
 	configReplicaAutoSetup          = "replica.autoSetup"
 	configReplicaInterfaceName      = "replica.interfaceName"
+	configReplicaMode               = "replica.mode"
 
 	envReplicasUsernameFormat           = "REPLICA%s_USERNAME" // #nosec G101
 	envReplicasPasswordFormat           = "REPLICA%s_PASSWORD" // #nosec G101
@@ -54,12 +86,20 @@ const (
 	envReplicasInsecureSkipVerifyFormat = "REPLICA%s_INSECURESKIPVERIFY"
 	envReplicasAutoSetup                = "REPLICA%s_AUTOSETUP"
 	envReplicasInterfaceName            = "REPLICA%s_INTERFACWENAME"
+	envReplicasMode                     = "REPLICA%s_MODE"
+	envReplicasFeatureFormat            = "REPLICA%s_FEATURES_%s"
+
+	envOriginsUsernameFormat           = "ORIGIN%s_USERNAME" // #nosec G101
+	envOriginsPasswordFormat           = "ORIGIN%s_PASSWORD" // #nosec G101
+	envOriginsAPIPathFormat            = "ORIGIN%s_APIPATH"
+	envOriginsInsecureSkipVerifyFormat = "ORIGIN%s_INSECURESKIPVERIFY"
 )
 
 var (
 	cfgFile               string
 	logger                = log.GetLogger("root")
 	envReplicasURLPattern = regexp.MustCompile(`^REPLICA(\d+)_URL=(.*)`)
+	envOriginsURLPattern  = regexp.MustCompile(`^ORIGIN(\d+)_URL=(.*)`)
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -85,6 +125,83 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.adguardhome-sync.yaml)")
+	rootCmd.PersistentFlags().String("log-format", "", "The format of the logs (console|json), default console")
+	_ = viper.BindPFlag(configLogFormat, rootCmd.PersistentFlags().Lookup("log-format"))
+	rootCmd.PersistentFlags().StringSlice("log-output", nil, "The paths the logs are written to (stdout|stderr|file path), default stdout")
+	_ = viper.BindPFlag(configLogOutput, rootCmd.PersistentFlags().Lookup("log-output"))
+	rootCmd.PersistentFlags().Int("max-parallel-replicas", 1, "The maximum number of replicas synced in parallel")
+	_ = viper.BindPFlag(configMaxParallelReplicas, rootCmd.PersistentFlags().Lookup("max-parallel-replicas"))
+	rootCmd.PersistentFlags().Bool("deletes", true, "Delete items on the replicas that do not exist on the origin; if false the sync only adds and updates items")
+	_ = viper.BindPFlag(configDeletes, rootCmd.PersistentFlags().Lookup("deletes"))
+	rootCmd.PersistentFlags().Bool("continue-on-error", false, "Sync the remaining features of a replica if a feature fails")
+	_ = viper.BindPFlag(configContinueOnError, rootCmd.PersistentFlags().Lookup("continue-on-error"))
+	rootCmd.PersistentFlags().Int("delete-guard-max-count", 0, "Abort the sync of a replica if more items of a feature would be deleted; if 0 the number is not limited")
+	_ = viper.BindPFlag(configDeleteGuardMaxCount, rootCmd.PersistentFlags().Lookup("delete-guard-max-count"))
+	rootCmd.PersistentFlags().Int("delete-guard-max-percent", 0, "Abort the sync of a replica if a higher percentage of the items of a feature would be deleted; if 0 the percentage is not limited")
+	_ = viper.BindPFlag(configDeleteGuardMaxPercent, rootCmd.PersistentFlags().Lookup("delete-guard-max-percent"))
+	rootCmd.PersistentFlags().Bool("delete-guard-empty-origin", false, "Abort the sync of a replica if the origin has no items of a feature, but the replica has")
+	_ = viper.BindPFlag(configDeleteGuardEmptyOrigin, rootCmd.PersistentFlags().Lookup("delete-guard-empty-origin"))
+	rootCmd.PersistentFlags().Bool("force-deletes", false, "Disable the delete guard to intentionally delete the items on the replicas")
+	_ = viper.BindPFlag(configDeleteGuardForce, rootCmd.PersistentFlags().Lookup("force-deletes"))
+	rootCmd.PersistentFlags().Bool("multi-master", false, "Merge the changes of the origin and the replicas in enforce mode and sync the merged config to all of them")
+	_ = viper.BindPFlag(configMultiMasterEnabled, rootCmd.PersistentFlags().Lookup("multi-master"))
+	rootCmd.PersistentFlags().String("conflict-resolution", string(types.ResolutionPreferOrigin), "The resolution of items changed differently on multiple instances in multi-master mode (prefer-origin|newest-wins|manual)")
+	_ = viper.BindPFlag(configMultiMasterResolution, rootCmd.PersistentFlags().Lookup("conflict-resolution"))
+
+	rootCmd.PersistentFlags().Bool("feature-dhcp-server-config", true, "Enable DHCP server config feature")
+	_ = viper.BindPFlag(configFeatureDHCPServerConfig, rootCmd.PersistentFlags().Lookup("feature-dhcp-server-config"))
+	rootCmd.PersistentFlags().Bool("feature-dhcp-static-leases", true, "Enable DHCP server static leases feature")
+	_ = viper.BindPFlag(configFeatureDHCPStaticLeases, rootCmd.PersistentFlags().Lookup("feature-dhcp-static-leases"))
+
+	rootCmd.PersistentFlags().Bool("feature-dns-server-config", true, "Enable DNS server config feature")
+	_ = viper.BindPFlag(configFeatureDNServerConfig, rootCmd.PersistentFlags().Lookup("feature-dns-server-config"))
+	rootCmd.PersistentFlags().Bool("feature-dns-access-lists", true, "Enable DNS server access lists feature")
+	_ = viper.BindPFlag(configFeatureDNSPAccessLists, rootCmd.PersistentFlags().Lookup("feature-dns-access-lists"))
+	rootCmd.PersistentFlags().Bool("feature-dns-rewrites", true, "Enable DNS rewrites feature")
+	_ = viper.BindPFlag(configFeatureDNSRewrites, rootCmd.PersistentFlags().Lookup("feature-dns-rewrites"))
+	rootCmd.PersistentFlags().Bool("feature-general-settings", true, "Enable general settings feature")
+	_ = viper.BindPFlag(configFeatureGeneralSettings, rootCmd.PersistentFlags().Lookup("feature-general-settings"))
+	_ = viper.BindPFlag("features.generalSettings", rootCmd.PersistentFlags().Lookup("feature-general-settings"))
+	rootCmd.PersistentFlags().Bool("feature-query-log-config", true, "Enable query log config feature")
+	_ = viper.BindPFlag(configFeatureQueryLogConfig, rootCmd.PersistentFlags().Lookup("feature-query-log-config"))
+	rootCmd.PersistentFlags().Bool("feature-stats-config", true, "Enable stats config feature")
+	_ = viper.BindPFlag(configFeatureStatsConfig, rootCmd.PersistentFlags().Lookup("feature-stats-config"))
+	rootCmd.PersistentFlags().Bool("feature-client-settings", true, "Enable client settings feature")
+	_ = viper.BindPFlag(configFeatureClientSettings, rootCmd.PersistentFlags().Lookup("feature-client-settings"))
+	rootCmd.PersistentFlags().Bool("feature-services", true, "Enable services sync feature")
+	_ = viper.BindPFlag(configFeatureServices, rootCmd.PersistentFlags().Lookup("feature-services"))
+	rootCmd.PersistentFlags().Bool("feature-filters", true, "Enable filters sync feature")
+	_ = viper.BindPFlag(configFeatureFilters, rootCmd.PersistentFlags().Lookup("feature-filters"))
+
+	rootCmd.PersistentFlags().String("origin-url", "", "Origin instance url")
+	_ = viper.BindPFlag(configOriginURL, rootCmd.PersistentFlags().Lookup("origin-url"))
+	rootCmd.PersistentFlags().String("origin-api-path", "/control", "Origin instance API path")
+	_ = viper.BindPFlag(configOriginAPIPath, rootCmd.PersistentFlags().Lookup("origin-api-path"))
+	rootCmd.PersistentFlags().String("origin-username", "", "Origin instance username")
+	_ = viper.BindPFlag(configOriginUsername, rootCmd.PersistentFlags().Lookup("origin-username"))
+	rootCmd.PersistentFlags().String("origin-password", "", "Origin instance password")
+	_ = viper.BindPFlag(configOriginPassword, rootCmd.PersistentFlags().Lookup("origin-password"))
+	rootCmd.PersistentFlags().String("origin-insecure-skip-verify", "", "Enable Origin instance InsecureSkipVerify")
+	_ = viper.BindPFlag(configOriginInsecureSkipVerify, rootCmd.PersistentFlags().Lookup("origin-insecure-skip-verify"))
+	rootCmd.PersistentFlags().String("origin-file", "", "Origin config file (yaml|json) to sync the replicas from instead of an origin instance")
+	_ = viper.BindPFlag(configOriginFile, rootCmd.PersistentFlags().Lookup("origin-file"))
+
+	rootCmd.PersistentFlags().String("replica-url", "", "Replica instance url")
+	_ = viper.BindPFlag(configReplicaURL, rootCmd.PersistentFlags().Lookup("replica-url"))
+	rootCmd.PersistentFlags().String("replica-api-path", "/control", "Replica instance API path")
+	_ = viper.BindPFlag(configReplicaAPIPath, rootCmd.PersistentFlags().Lookup("replica-api-path"))
+	rootCmd.PersistentFlags().String("replica-username", "", "Replica instance username")
+	_ = viper.BindPFlag(configReplicaUsername, rootCmd.PersistentFlags().Lookup("replica-username"))
+	rootCmd.PersistentFlags().String("replica-password", "", "Replica instance password")
+	_ = viper.BindPFlag(configReplicaPassword, rootCmd.PersistentFlags().Lookup("replica-password"))
+	rootCmd.PersistentFlags().Bool("replica-insecure-skip-verify", false, "Enable Replica instance InsecureSkipVerify")
+	_ = viper.BindPFlag(configReplicaInsecureSkipVerify, rootCmd.PersistentFlags().Lookup("replica-insecure-skip-verify"))
+	rootCmd.PersistentFlags().Bool("replica-auto-setup", false, "Enable automatic setup of new AdguardHome instances. This replaces the setup wizard.")
+	_ = viper.BindPFlag(configReplicaAutoSetup, rootCmd.PersistentFlags().Lookup("replica-auto-setup"))
+	rootCmd.PersistentFlags().Bool("replica-interface-name", false, "Optional change the interface name of the replica if it differs from the master")
+	_ = viper.BindPFlag(configReplicaInterfaceName, rootCmd.PersistentFlags().Lookup("replica-interface-name"))
+	rootCmd.PersistentFlags().String("replica-mode", "", "The sync mode of the replica (enforce|detect); detect only reports the differences to the origin")
+	_ = viper.BindPFlag(configReplicaMode, rootCmd.PersistentFlags().Lookup("replica-mode"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -129,9 +246,44 @@ func getConfig() (*types.Config, error) {
 	if len(cfg.Replicas) == 0 {
 		cfg.Replicas = append(cfg.Replicas, collectEnvReplicas()...)
 	}
+	if len(cfg.Origins) == 0 {
+		cfg.Origins = collectEnvOrigins()
+	}
+	if err := log.Configure(cfg.Log.Format, cfg.Log.Output); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// Manually collect the origin candidates from env, ordered by their index.
+func collectEnvOrigins() []types.AdGuardInstance {
+	indexes := make(map[int]types.AdGuardInstance)
+	for _, v := range os.Environ() {
+		if envOriginsURLPattern.MatchString(v) {
+			sm := envOriginsURLPattern.FindStringSubmatch(v)
+			index, _ := strconv.Atoi(sm[1])
+			indexes[index] = types.AdGuardInstance{
+				URL:                sm[2],
+				Username:           os.Getenv(fmt.Sprintf(envOriginsUsernameFormat, sm[1])),
+				Password:           os.Getenv(fmt.Sprintf(envOriginsPasswordFormat, sm[1])),
+				APIPath:            os.Getenv(fmt.Sprintf(envOriginsAPIPathFormat, sm[1])),
+				InsecureSkipVerify: strings.EqualFold(os.Getenv(fmt.Sprintf(envOriginsInsecureSkipVerifyFormat, sm[1])), "true"),
+			}
+		}
+	}
+
+	keys := make([]int, 0, len(indexes))
+	for k := range indexes {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	var origins []types.AdGuardInstance
+	for _, k := range keys {
+		origins = append(origins, indexes[k])
+	}
+	return origins
+}
+
 // Manually collect replicas from env.
 func collectEnvReplicas() []types.AdGuardInstance {
 	var replicas []types.AdGuardInstance
@@ -146,6 +298,8 @@ func collectEnvReplicas() []types.AdGuardInstance {
 				InsecureSkipVerify: strings.EqualFold(os.Getenv(fmt.Sprintf(envReplicasInsecureSkipVerifyFormat, sm[1])), "true"),
 				AutoSetup:          strings.EqualFold(os.Getenv(fmt.Sprintf(envReplicasAutoSetup, sm[1])), "true"),
 				InterfaceName:      os.Getenv(fmt.Sprintf(envReplicasInterfaceName, sm[1])),
+				Mode:               types.Mode(os.Getenv(fmt.Sprintf(envReplicasMode, sm[1]))),
+				Features:           collectEnvReplicaFeatures(sm[1]),
 			}
 			replicas = append(replicas, re)
 		}
@@ -153,3 +307,18 @@ func collectEnvReplicas() []types.AdGuardInstance {
 
 	return replicas
 }
+
+// collectEnvReplicaFeatures collects the feature overrides of a replica from env, nil if none is set
+func collectEnvReplicaFeatures(index string) *types.FeaturesOverride {
+	var features *types.FeaturesOverride
+	for _, f := range types.AllFeatures {
+		name := strings.ToUpper(strings.ReplaceAll(f, ".", "_"))
+		if v, ok := os.LookupEnv(fmt.Sprintf(envReplicasFeatureFormat, index, name)); ok {
+			if features == nil {
+				features = &types.FeaturesOverride{}
+			}
+			features.Set(f, strings.EqualFold(v, "true"))
+		}
+	}
+	return features
+}
@@ -44,6 +44,51 @@ var _ = Describe("Run", func() {
 			verifyFeatures(cfg, false)
 		})
 	})
+	Context("collectEnvOrigins", func() {
+		AfterEach(func() {
+			Ω(os.Unsetenv("ORIGIN1_URL")).ShouldNot(HaveOccurred())
+			Ω(os.Unsetenv("ORIGIN2_URL")).ShouldNot(HaveOccurred())
+			Ω(os.Unsetenv("ORIGIN10_URL")).ShouldNot(HaveOccurred())
+			Ω(os.Unsetenv("ORIGIN2_USERNAME")).ShouldNot(HaveOccurred())
+		})
+		It("should read the origins ordered by their index", func() {
+			Ω(os.Setenv("ORIGIN10_URL", "https://origin10")).ShouldNot(HaveOccurred())
+			Ω(os.Setenv("ORIGIN2_URL", "https://origin2")).ShouldNot(HaveOccurred())
+			Ω(os.Setenv("ORIGIN2_USERNAME", "user")).ShouldNot(HaveOccurred())
+			Ω(os.Setenv("ORIGIN1_URL", "https://origin1")).ShouldNot(HaveOccurred())
+			origins := collectEnvOrigins()
+			Ω(origins).Should(HaveLen(3))
+			Ω(origins[0].URL).Should(Equal("https://origin1"))
+			Ω(origins[1].URL).Should(Equal("https://origin2"))
+			Ω(origins[1].Username).Should(Equal("user"))
+			Ω(origins[2].URL).Should(Equal("https://origin10"))
+		})
+	})
+	Context("collectEnvReplicas", func() {
+		AfterEach(func() {
+			Ω(os.Unsetenv("REPLICA1_URL")).ShouldNot(HaveOccurred())
+			Ω(os.Unsetenv("REPLICA1_MODE")).ShouldNot(HaveOccurred())
+			Ω(os.Unsetenv("REPLICA1_FEATURES_DHCP_SERVERCONFIG")).ShouldNot(HaveOccurred())
+		})
+		It("should read the replica mode", func() {
+			Ω(os.Setenv("REPLICA1_URL", "https://replica1")).ShouldNot(HaveOccurred())
+			Ω(os.Setenv("REPLICA1_MODE", "detect")).ShouldNot(HaveOccurred())
+			replicas := collectEnvReplicas()
+			Ω(replicas).Should(HaveLen(1))
+			Ω(replicas[0].URL).Should(Equal("https://replica1"))
+			Ω(replicas[0].Mode).Should(Equal(types.ModeDetect))
+			Ω(replicas[0].Features).Should(BeNil())
+		})
+		It("should read the replica feature overrides", func() {
+			Ω(os.Setenv("REPLICA1_URL", "https://replica1")).ShouldNot(HaveOccurred())
+			Ω(os.Setenv("REPLICA1_FEATURES_DHCP_SERVERCONFIG", "false")).ShouldNot(HaveOccurred())
+			replicas := collectEnvReplicas()
+			Ω(replicas).Should(HaveLen(1))
+			Ω(replicas[0].Features).ShouldNot(BeNil())
+			Ω(*replicas[0].Features.DHCP.ServerConfig).Should(BeFalse())
+			Ω(replicas[0].Features.DHCP.StaticLeases).Should(BeNil())
+		})
+	})
 })
 
 func verifyFeatures(cfg *types.Config, value bool) {
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"errors"
+	"time"
+
 	"github.com/bakito/adguardhome-sync/pkg/log"
 	"github.com/bakito/adguardhome-sync/pkg/sync"
 	"github.com/spf13/cobra"
@@ -20,16 +23,50 @@ var doCmd = &cobra.Command{
 			return err
 		}
 
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			if err := log.StdoutToStderr(); err != nil {
+				return err
+			}
+			run, err := sync.DryRun(cfg)
+			if err != nil {
+				return err
+			}
+			if err := printJSON(cmd.OutOrStdout(), run); err != nil {
+				return err
+			}
+			if run.HasErrors() {
+				return errors.New("dry-run finished with errors")
+			}
+			return nil
+		}
+
 		return sync.Sync(cfg)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(doCmd)
+	doCmd.Flags().Bool("dry-run", false, "Print the changes a sync would apply without applying them")
+	doCmd.PersistentFlags().Bool("force", false, "Sync all replicas, also if neither the origin nor the replica changed since the last sync")
+	_ = viper.BindPFlag(configForce, doCmd.PersistentFlags().Lookup("force"))
 	doCmd.PersistentFlags().String("cron", "", "The cron expression to run in daemon mode")
 	_ = viper.BindPFlag(configCron, doCmd.PersistentFlags().Lookup("cron"))
 	doCmd.PersistentFlags().Bool("runOnStart", true, "Run the sync job on start.")
 	_ = viper.BindPFlag(configRunOnStart, doCmd.PersistentFlags().Lookup("runOnStart"))
+	doCmd.PersistentFlags().Duration("watch-interval", 0, "Interval to poll the origin for changes and sync the replicas when it changed; if 0 the watch mode is disabled.")
+	_ = viper.BindPFlag(configWatchInterval, doCmd.PersistentFlags().Lookup("watch-interval"))
+	doCmd.PersistentFlags().Duration("watch-debounce", 10*time.Second, "Time the changed origin config must not change again before the replicas are synced in watch mode")
+	_ = viper.BindPFlag(configWatchDebounce, doCmd.PersistentFlags().Lookup("watch-debounce"))
+	doCmd.PersistentFlags().String("backup-dir", "", "Directory to write a snapshot of the origin config to on every sync; if empty backups are disabled.")
+	_ = viper.BindPFlag(configBackupDir, doCmd.PersistentFlags().Lookup("backup-dir"))
+	doCmd.PersistentFlags().String("backup-format", "yaml", "Format of the origin snapshots (yaml|json)")
+	_ = viper.BindPFlag(configBackupFormat, doCmd.PersistentFlags().Lookup("backup-format"))
+	doCmd.PersistentFlags().Int("backup-max-count", 0, "Maximum number of snapshots to keep; if 0 the number is not limited.")
+	_ = viper.BindPFlag(configBackupMaxCount, doCmd.PersistentFlags().Lookup("backup-max-count"))
+	doCmd.PersistentFlags().Duration("backup-max-age", 0, "Maximum age of the snapshots to keep; if 0 the age is not limited.")
+	_ = viper.BindPFlag(configBackupMaxAge, doCmd.PersistentFlags().Lookup("backup-max-age"))
+	doCmd.PersistentFlags().String("state-file", "", "File to persist the sync history and state across restarts; if empty the state is kept in memory only.")
+	_ = viper.BindPFlag(configStateFile, doCmd.PersistentFlags().Lookup("state-file"))
 	doCmd.PersistentFlags().Int("api-port", 8080, "Sync API Port, the API endpoint will be started to enable remote triggering; if 0 port API is disabled.")
 	_ = viper.BindPFlag(configAPIPort, doCmd.PersistentFlags().Lookup("api-port"))
 	doCmd.PersistentFlags().String("api-username", "", "Sync API username")
@@ -38,55 +75,8 @@ func init() {
 	_ = viper.BindPFlag(configAPIPassword, doCmd.PersistentFlags().Lookup("api-password"))
 	doCmd.PersistentFlags().String("api-darkMode", "", "API UI in dark mode")
 	_ = viper.BindPFlag(configAPIDarkMode, doCmd.PersistentFlags().Lookup("api-darkMode"))
-
-	doCmd.PersistentFlags().Bool("feature-dhcp-server-config", true, "Enable DHCP server config feature")
-	_ = viper.BindPFlag(configFeatureDHCPServerConfig, doCmd.PersistentFlags().Lookup("feature-dhcp-server-config"))
-	doCmd.PersistentFlags().Bool("feature-dhcp-static-leases", true, "Enable DHCP server static leases feature")
-	_ = viper.BindPFlag(configFeatureDHCPStaticLeases, doCmd.PersistentFlags().Lookup("feature-dhcp-static-leases"))
-
-	doCmd.PersistentFlags().Bool("feature-dns-server-config", true, "Enable DNS server config feature")
-	_ = viper.BindPFlag(configFeatureDNServerConfig, doCmd.PersistentFlags().Lookup("feature-dns-server-config"))
-	doCmd.PersistentFlags().Bool("feature-dns-access-lists", true, "Enable DNS server access lists feature")
-	_ = viper.BindPFlag(configFeatureDNSPAccessLists, doCmd.PersistentFlags().Lookup("feature-dns-access-lists"))
-	doCmd.PersistentFlags().Bool("feature-dns-rewrites", true, "Enable DNS rewrites feature")
-	_ = viper.BindPFlag(configFeatureDNSRewrites, doCmd.PersistentFlags().Lookup("feature-dns-rewrites"))
-	doCmd.PersistentFlags().Bool("feature-general-settings", true, "Enable general settings feature")
-	_ = viper.BindPFlag(configFeatureGeneralSettings, doCmd.PersistentFlags().Lookup("feature-general-settings"))
-	_ = viper.BindPFlag("features.generalSettings", doCmd.PersistentFlags().Lookup("feature-general-settings"))
-	doCmd.PersistentFlags().Bool("feature-query-log-config", true, "Enable query log config feature")
-	_ = viper.BindPFlag(configFeatureQueryLogConfig, doCmd.PersistentFlags().Lookup("feature-query-log-config"))
-	doCmd.PersistentFlags().Bool("feature-stats-config", true, "Enable stats config feature")
-	_ = viper.BindPFlag(configFeatureStatsConfig, doCmd.PersistentFlags().Lookup("feature-stats-config"))
-	doCmd.PersistentFlags().Bool("feature-client-settings", true, "Enable client settings feature")
-	_ = viper.BindPFlag(configFeatureClientSettings, doCmd.PersistentFlags().Lookup("feature-client-settings"))
-	doCmd.PersistentFlags().Bool("feature-services", true, "Enable services sync feature")
-	_ = viper.BindPFlag(configFeatureServices, doCmd.PersistentFlags().Lookup("feature-services"))
-	doCmd.PersistentFlags().Bool("feature-filters", true, "Enable filters sync feature")
-	_ = viper.BindPFlag(configFeatureFilters, doCmd.PersistentFlags().Lookup("feature-filters"))
-
-	doCmd.PersistentFlags().String("origin-url", "", "Origin instance url")
-	_ = viper.BindPFlag(configOriginURL, doCmd.PersistentFlags().Lookup("origin-url"))
-	doCmd.PersistentFlags().String("origin-api-path", "/control", "Origin instance API path")
-	_ = viper.BindPFlag(configOriginAPIPath, doCmd.PersistentFlags().Lookup("origin-api-path"))
-	doCmd.PersistentFlags().String("origin-username", "", "Origin instance username")
-	_ = viper.BindPFlag(configOriginUsername, doCmd.PersistentFlags().Lookup("origin-username"))
-	doCmd.PersistentFlags().String("origin-password", "", "Origin instance password")
-	_ = viper.BindPFlag(configOriginPassword, doCmd.PersistentFlags().Lookup("origin-password"))
-	doCmd.PersistentFlags().String("origin-insecure-skip-verify", "", "Enable Origin instance InsecureSkipVerify")
-	_ = viper.BindPFlag(configOriginInsecureSkipVerify, doCmd.PersistentFlags().Lookup("origin-insecure-skip-verify"))
-
-	doCmd.PersistentFlags().String("replica-url", "", "Replica instance url")
-	_ = viper.BindPFlag(configReplicaURL, doCmd.PersistentFlags().Lookup("replica-url"))
-	doCmd.PersistentFlags().String("replica-api-path", "/control", "Replica instance API path")
-	_ = viper.BindPFlag(configReplicaAPIPath, doCmd.PersistentFlags().Lookup("replica-api-path"))
-	doCmd.PersistentFlags().String("replica-username", "", "Replica instance username")
-	_ = viper.BindPFlag(configReplicaUsername, doCmd.PersistentFlags().Lookup("replica-username"))
-	doCmd.PersistentFlags().String("replica-password", "", "Replica instance password")
-	_ = viper.BindPFlag(configReplicaPassword, doCmd.PersistentFlags().Lookup("replica-password"))
-	doCmd.PersistentFlags().Bool("replica-insecure-skip-verify", false, "Enable Replica instance InsecureSkipVerify")
-	_ = viper.BindPFlag(configReplicaInsecureSkipVerify, doCmd.PersistentFlags().Lookup("replica-insecure-skip-verify"))
-	doCmd.PersistentFlags().Bool("replica-auto-setup", false, "Enable automatic setup of new AdguardHome instances. This replaces the setup wizard.")
-	_ = viper.BindPFlag(configReplicaAutoSetup, doCmd.PersistentFlags().Lookup("replica-auto-setup"))
-	doCmd.PersistentFlags().Bool("replica-interface-name", false, "Optional change the interface name of the replica if it differs from the master")
-	_ = viper.BindPFlag(configReplicaInterfaceName, doCmd.PersistentFlags().Lookup("replica-interface-name"))
+	doCmd.PersistentFlags().String("api-webhook-secret", "", "Shared secret to verify the signature of the webhook requests; if empty the webhook is disabled.")
+	_ = viper.BindPFlag(configAPIWebhookSecret, doCmd.PersistentFlags().Lookup("api-webhook-secret"))
+	doCmd.PersistentFlags().Duration("api-webhook-max-age", 5*time.Minute, "Maximum age of the timestamp of a webhook request")
+	_ = viper.BindPFlag(configAPIWebhookMaxAge, doCmd.PersistentFlags().Lookup("api-webhook-max-age"))
 }
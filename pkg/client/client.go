@@ -9,8 +9,11 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/metrics"
 	"github.com/bakito/adguardhome-sync/pkg/types"
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
@@ -108,6 +111,12 @@ type Client interface {
 	DeleteDHCPStaticLeases(leases ...types.Lease) error
 }
 
+// Logged is implemented by the clients that log with the fields of the caller
+type Logged interface {
+	// UseLogger logs the requests and changes of the client with the fields of the logger, e.g. the instance and run id
+	UseLogger(sl *zap.SugaredLogger)
+}
+
 type client struct {
 	client *resty.Client
 	log    *zap.SugaredLogger
@@ -118,13 +127,19 @@ func (cl *client) Host() string {
 	return cl.host
 }
 
+func (cl *client) UseLogger(sl *zap.SugaredLogger) {
+	cl.log = sl.Named("client").With("host", cl.host)
+}
+
 func (cl *client) doGet(req *resty.Request, url string) error {
 	rl := cl.log.With("method", "GET", "path", url)
 	if cl.client.UserInfo != nil {
 		rl = rl.With("username", cl.client.UserInfo.Username)
 	}
 	rl.Debug("do get")
+	start := time.Now()
 	resp, err := req.Get(url)
+	cl.observe(http.MethodGet, url, resp, start)
 	if err != nil {
 		if resp != nil && resp.StatusCode() == http.StatusFound {
 			loc := resp.Header().Get("Location")
@@ -148,7 +163,9 @@ func (cl *client) doPost(req *resty.Request, url string) error {
 		rl = rl.With("username", cl.client.UserInfo.Username)
 	}
 	rl.Debug("do post")
+	start := time.Now()
 	resp, err := req.Post(url)
+	cl.observe(http.MethodPost, url, resp, start)
 	if err != nil {
 		rl.With("status", resp.StatusCode(), "body", string(resp.Body()), "error", err).Debug("error in do post")
 		return err
@@ -160,6 +177,15 @@ func (cl *client) doPost(req *resty.Request, url string) error {
 	return nil
 }
 
+// observe records the request metrics
+func (cl *client) observe(method string, url string, resp *resty.Response, start time.Time) {
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode()
+	}
+	metrics.ClientRequest(cl.host, method, "/"+strings.TrimPrefix(url, "/"), status, time.Since(start))
+}
+
 func (cl *client) Status() (*types.Status, error) {
 	status := &types.Status{}
 	err := cl.doGet(cl.client.R().EnableTrace().SetResult(status), "status")
@@ -245,7 +271,7 @@ func (cl *client) Filtering() (*types.FilteringStatus, error) {
 
 func (cl *client) AddFilters(whitelist bool, filters ...types.Filter) error {
 	for _, f := range filters {
-		cl.log.With("url", f.URL, "whitelist", whitelist, "enabled", f.Enabled).Info("Add filter")
+		cl.log.With("filter_url", f.URL, "whitelist", whitelist, "enabled", f.Enabled).Info("Add filter")
 		ff := &types.Filter{Name: f.Name, URL: f.URL, Whitelist: whitelist}
 		err := cl.doPost(cl.client.R().EnableTrace().SetBody(ff), "/filtering/add_url")
 		if err != nil {
@@ -257,7 +283,7 @@ func (cl *client) AddFilters(whitelist bool, filters ...types.Filter) error {
 
 func (cl *client) DeleteFilters(whitelist bool, filters ...types.Filter) error {
 	for _, f := range filters {
-		cl.log.With("url", f.URL, "whitelist", whitelist, "enabled", f.Enabled).Info("Delete filter")
+		cl.log.With("filter_url", f.URL, "whitelist", whitelist, "enabled", f.Enabled).Info("Delete filter")
 		ff := &types.Filter{URL: f.URL, Whitelist: whitelist}
 		err := cl.doPost(cl.client.R().EnableTrace().SetBody(ff), "/filtering/remove_url")
 		if err != nil {
@@ -269,7 +295,7 @@ func (cl *client) DeleteFilters(whitelist bool, filters ...types.Filter) error {
 
 func (cl *client) UpdateFilters(whitelist bool, filters ...types.Filter) error {
 	for _, f := range filters {
-		cl.log.With("url", f.URL, "whitelist", whitelist, "enabled", f.Enabled).Info("Update filter")
+		cl.log.With("filter_url", f.URL, "whitelist", whitelist, "enabled", f.Enabled).Info("Update filter")
 		fu := &types.FilterUpdate{Whitelist: whitelist, URL: f.URL, Data: types.Filter{ID: f.ID, Name: f.Name, URL: f.URL, Whitelist: whitelist, Enabled: f.Enabled}}
 		err := cl.doPost(cl.client.R().EnableTrace().SetBody(fu), "/filtering/set_url")
 		if err != nil {
@@ -361,7 +387,7 @@ func (cl *client) QueryLogConfig() (*types.QueryLogConfig, error) {
 }
 
 func (cl *client) SetQueryLogConfig(enabled bool, interval float64, anonymizeClientIP bool) error {
-	cl.log.With("enabled", enabled, "interval", interval, "anonymizeClientIP", anonymizeClientIP).Info("Set query log config")
+	cl.log.With("enabled", enabled, "interval", interval, "anonymize_client_ip", anonymizeClientIP).Info("Set query log config")
 	return cl.doPost(cl.client.R().EnableTrace().SetBody(&types.QueryLogConfig{
 		EnableConfig:      types.EnableConfig{Enabled: enabled},
 		IntervalConfig:    types.IntervalConfig{Interval: interval},
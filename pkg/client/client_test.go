@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"github.com/bakito/adguardhome-sync/pkg/client"
+	"github.com/bakito/adguardhome-sync/pkg/log"
 	"github.com/bakito/adguardhome-sync/pkg/types"
 	"github.com/google/uuid"
 	. "github.com/onsi/ginkgo/v2"
@@ -215,6 +216,21 @@ bar`)
 		})
 	})
 
+	Context("UseLogger", func() {
+		It("should log with the fields of the logger", func() {
+			ts, cl = ClientPost("/dns_config", `{"protection_enabled":true}`)
+			cl.(client.Logged).UseLogger(log.GetLogger("sync").With("replica", ts.URL, "run_id", "1"))
+			Ω(cl.ToggleProtection(true)).ShouldNot(HaveOccurred())
+
+			entries := log.Entries()
+			e := entries[len(entries)-1]
+			Ω(e.Logger).Should(Equal("sync.client"))
+			Ω(e.Fields).Should(HaveKeyWithValue("replica", ts.URL))
+			Ω(e.Fields).Should(HaveKeyWithValue("run_id", "1"))
+			Ω(e.Fields).Should(HaveKeyWithValue("host", cl.Host()))
+		})
+	})
+
 	Context("Services", func() {
 		It("should read Services", func() {
 			ts, cl = ClientGet("blockedservices-list.json", "/blocked_services/list")
@@ -1,7 +1,11 @@
 package log
 
 import (
+	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -10,63 +14,189 @@ import (
 const (
 	logHistorySize = 50
 	envLogLevel    = "LOG_LEVEL"
+	envLogFormat   = "LOG_FORMAT"
+
+	// FormatConsole human readable log lines
+	FormatConsole = "console"
+	// FormatJSON one json object per log entry
+	FormatJSON = "json"
 )
 
 var (
 	rootLogger *zap.Logger
-	logs       []string
+	level      = zap.NewAtomicLevelAt(zap.InfoLevel)
+	logs       []Entry
+	logsMutex  sync.RWMutex
+
+	// current the core the loggers write to, replaced by Configure
+	current atomic.Value
+	// closeOutputs closes the output paths of the current core
+	closeOutputs = func() {}
+	format       = FormatConsole
+	outputPaths  = []string{"stdout"}
+	configMutex  sync.Mutex
+	historyCoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
 )
 
+// Entry a structured entry of the log history
+type Entry struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Logger  string                 `json:"logger,omitempty"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+
+	// line the entry formatted as console log line
+	line string
+}
+
 // GetLogger returns a named logger
 func GetLogger(name string) *zap.SugaredLogger {
 	return rootLogger.Named(name).Sugar()
 }
 
 func init() {
-	level := zap.InfoLevel
-
 	if lvl, ok := os.LookupEnv(envLogLevel); ok {
-		if err := level.Set(lvl); err != nil {
+		if err := level.UnmarshalText([]byte(lvl)); err != nil {
 			panic(err)
 		}
 	}
+	if f, ok := os.LookupEnv(envLogFormat); ok {
+		format = f
+	}
+
+	if err := build(format, outputPaths); err != nil {
+		panic(err)
+	}
+	rootLogger = zap.New(&switchCore{}, zap.ErrorOutput(zapcore.Lock(os.Stderr)), zap.AddCaller(),
+		zap.AddStacktrace(zapcore.ErrorLevel))
+}
+
+// Configure sets the format (console or json) and the output paths of all loggers, empty values are not changed
+func Configure(logFormat string, paths []string) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if logFormat == "" {
+		logFormat = format
+	}
+	if len(paths) == 0 {
+		paths = outputPaths
+	}
+	if logFormat == format && fmt.Sprint(paths) == fmt.Sprint(outputPaths) {
+		return nil
+	}
+	closePrevious := closeOutputs
+	if err := build(logFormat, paths); err != nil {
+		return err
+	}
+	format, outputPaths = logFormat, paths
+	closePrevious()
+	return nil
+}
+
+// StdoutToStderr writes the logs of the stdout output to stderr, to keep stdout free for a machine-readable report
+func StdoutToStderr() error {
+	configMutex.Lock()
+	var paths []string
+	for _, p := range outputPaths {
+		if p == "stdout" {
+			p = "stderr"
+		}
+		if !contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	configMutex.Unlock()
+	return Configure("", paths)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// build creates the core of all loggers with the format and output paths
+func build(logFormat string, paths []string) error {
+	var enc zapcore.Encoder
+	switch logFormat {
+	case FormatConsole:
+		enc = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	case FormatJSON:
+		ec := zap.NewProductionEncoderConfig()
+		ec.TimeKey = "time"
+		ec.MessageKey = "message"
+		ec.EncodeTime = zapcore.ISO8601TimeEncoder
+		enc = zapcore.NewJSONEncoder(ec)
+	default:
+		return fmt.Errorf("invalid log format %q, supported are %s and %s", logFormat, FormatConsole, FormatJSON)
+	}
+
+	sink, closeSink, err := zap.Open(paths...)
+	if err != nil {
+		return err
+	}
 
-	cfg := zap.Config{
-		Level:            zap.NewAtomicLevelAt(level),
-		Development:      false,
-		Encoding:         "console",
-		EncoderConfig:    zap.NewDevelopmentEncoderConfig(),
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: []string{"stderr"},
+	current.Store(&holder{core: zapcore.NewTee(zapcore.NewCore(enc, sink, level), &logList{LevelEnabler: level})})
+	closeOutputs = func() {
+		_ = sink.Sync()
+		closeSink()
 	}
-	opt := zap.WrapCore(func(c zapcore.Core) zapcore.Core {
-		return zapcore.NewTee(c, &logList{
-			enc:          zapcore.NewConsoleEncoder(cfg.EncoderConfig),
-			LevelEnabler: cfg.Level,
-		})
-	})
+	return nil
+}
+
+type holder struct {
+	core zapcore.Core
+}
+
+// switchCore writes to the current core, so the loggers created before Configure use the configured core
+type switchCore struct {
+	fields []zapcore.Field
+}
 
-	rootLogger, _ = cfg.Build(opt)
+func (c *switchCore) core() zapcore.Core {
+	return current.Load().(*holder).core
+}
+
+func (c *switchCore) Enabled(lvl zapcore.Level) bool {
+	return c.core().Enabled(lvl)
+}
+
+func (c *switchCore) With(fields []zapcore.Field) zapcore.Core {
+	return &switchCore{fields: append(append([]zapcore.Field{}, c.fields...), fields...)}
+}
+
+func (c *switchCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
 }
 
+func (c *switchCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.core().With(c.fields).Write(ent, fields)
+}
+
+func (c *switchCore) Sync() error {
+	return c.core().Sync()
+}
+
+// logList keeps the latest log entries
 type logList struct {
 	zapcore.LevelEnabler
-	enc zapcore.Encoder
+	fields []zapcore.Field
 }
 
-func (l *logList) clone() *logList {
+func (l *logList) With(fields []zapcore.Field) zapcore.Core {
 	return &logList{
 		LevelEnabler: l.LevelEnabler,
-		enc:          l.enc.Clone(),
+		fields:       append(append([]zapcore.Field{}, l.fields...), fields...),
 	}
 }
 
-func (l *logList) With(fields []zapcore.Field) zapcore.Core {
-	clone := l.clone()
-	addFields(clone.enc, fields)
-	return clone
-}
-
 func (l *logList) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
 	if l.Enabled(ent.Level) {
 		return ce.AddCore(ent, l)
@@ -75,11 +205,32 @@ func (l *logList) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.Ch
 }
 
 func (l *logList) Write(ent zapcore.Entry, fields []zapcore.Field) error {
-	buf, err := l.enc.EncodeEntry(ent, fields)
+	all := append(append([]zapcore.Field{}, l.fields...), fields...)
+	buf, err := historyCoder.EncodeEntry(ent, all)
 	if err != nil {
 		return err
 	}
-	logs = append(logs, buf.String())
+	defer buf.Free()
+
+	enc := zapcore.NewMapObjectEncoder()
+	for i := range all {
+		all[i].AddTo(enc)
+	}
+	e := Entry{
+		Time:    ent.Time,
+		Level:   ent.Level.String(),
+		Logger:  ent.LoggerName,
+		Message: ent.Message,
+		Fields:  enc.Fields,
+		line:    buf.String(),
+	}
+	if len(e.Fields) == 0 {
+		e.Fields = nil
+	}
+
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+	logs = append(logs, e)
 
 	if len(logs) > logHistorySize {
 		logs = logs[len(logs)-logHistorySize:]
@@ -91,13 +242,20 @@ func (l *logList) Sync() error {
 	return nil
 }
 
-// Logs get the current logs
+// Logs get the current logs as console log lines
 func Logs() []string {
-	return logs
+	logsMutex.RLock()
+	defer logsMutex.RUnlock()
+	lines := make([]string, len(logs))
+	for i := range logs {
+		lines[i] = logs[i].line
+	}
+	return lines
 }
 
-func addFields(enc zapcore.ObjectEncoder, fields []zapcore.Field) {
-	for i := range fields {
-		fields[i].AddTo(enc)
-	}
+// Entries get the current logs as structured entries
+func Entries() []Entry {
+	logsMutex.RLock()
+	defer logsMutex.RUnlock()
+	return append([]Entry{}, logs...)
 }
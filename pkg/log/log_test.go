@@ -0,0 +1,84 @@
+package log_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bakito/adguardhome-sync/pkg/log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Log", func() {
+	l := log.GetLogger("test")
+
+	AfterEach(func() {
+		Ω(log.Configure(log.FormatConsole, []string{"stdout"})).ShouldNot(HaveOccurred())
+	})
+
+	It("should write json to the output paths of the loggers created before", func() {
+		file := filepath.Join(GinkgoT().TempDir(), "sync.log")
+		Ω(log.Configure(log.FormatJSON, []string{file})).ShouldNot(HaveOccurred())
+		l.With("replica", "https://replica", "run_id", "1").Info("Sync done")
+		_ = l.Sync()
+
+		b, err := os.ReadFile(file)
+		Ω(err).ShouldNot(HaveOccurred())
+		entry := map[string]interface{}{}
+		Ω(json.Unmarshal(b, &entry)).ShouldNot(HaveOccurred())
+		Ω(entry).Should(HaveKeyWithValue("message", "Sync done"))
+		Ω(entry).Should(HaveKeyWithValue("level", "info"))
+		Ω(entry).Should(HaveKeyWithValue("logger", "test"))
+		Ω(entry).Should(HaveKeyWithValue("replica", "https://replica"))
+		Ω(entry).Should(HaveKeyWithValue("run_id", "1"))
+		Ω(entry).Should(HaveKey("time"))
+	})
+
+	It("should close the previous output files", func() {
+		if _, err := os.Stat("/proc/self/fd"); err != nil {
+			Skip("open files can't be listed")
+		}
+		dir := GinkgoT().TempDir()
+		first := filepath.Join(dir, "first.log")
+		Ω(log.Configure(log.FormatJSON, []string{first})).ShouldNot(HaveOccurred())
+		Ω(openFiles()).Should(ContainElement(first))
+
+		Ω(log.Configure(log.FormatJSON, []string{filepath.Join(dir, "second.log")})).ShouldNot(HaveOccurred())
+		Ω(openFiles()).ShouldNot(ContainElement(first))
+	})
+
+	It("should keep the structured entries and the log lines", func() {
+		l.With("feature", "dns.rewrites", "error", errors.New("failed")).Warn("Error syncing rewrites")
+		entries := log.Entries()
+		e := entries[len(entries)-1]
+		Ω(e.Message).Should(Equal("Error syncing rewrites"))
+		Ω(e.Level).Should(Equal("warn"))
+		Ω(e.Logger).Should(Equal("test"))
+		Ω(e.Fields).Should(Equal(map[string]interface{}{"feature": "dns.rewrites", "error": "failed"}))
+
+		logs := log.Logs()
+		Ω(logs).Should(HaveLen(len(entries)))
+		Ω(logs[len(logs)-1]).Should(ContainSubstring("Error syncing rewrites"))
+		Ω(strings.HasSuffix(logs[len(logs)-1], "\n")).Should(BeTrue())
+	})
+
+	It("should reject an invalid format", func() {
+		Ω(log.Configure("xml", nil)).Should(MatchError(ContainSubstring(`invalid log format "xml"`)))
+	})
+})
+
+// openFiles returns the paths of the files opened by the process
+func openFiles() []string {
+	fds, err := os.ReadDir("/proc/self/fd")
+	Ω(err).ShouldNot(HaveOccurred())
+	var files []string
+	for _, fd := range fds {
+		if f, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "adguardhome_sync"
+
+	// RoleOrigin the role of the origin instance
+	RoleOrigin = "origin"
+	// RoleReplica the role of a replica instance
+	RoleReplica = "replica"
+
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+)
+
+var (
+	syncRunsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_runs_started_total",
+		Help:      "Number of started sync runs.",
+	})
+	syncRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_runs_total",
+		Help:      "Number of finished sync runs by result.",
+	}, []string{"result"})
+	replicaSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "replica_sync_duration_seconds",
+		Help:      "Duration of the sync of a replica.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"replica", "result"})
+	replicaChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replica_changes_total",
+		Help:      "Number of changes applied to a replica by feature and action.",
+	}, []string{"replica", "feature", "action"})
+	replicaSkippedDeletes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replica_skipped_deletes_total",
+		Help:      "Number of deletes not applied to a replica as deletes are disabled, by feature.",
+	}, []string{"replica", "feature"})
+	replicaLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "replica_last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful sync of a replica.",
+	}, []string{"replica"})
+	replicaLastCheck = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "replica_last_check_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful comparison of a replica in detect mode.",
+	}, []string{"replica"})
+	replicaDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "replica_drift_changes",
+		Help:      "Number of differences to the origin of a replica in detect mode.",
+	}, []string{"replica"})
+	instanceInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_info",
+		Help:      "AdGuard Home version of the origin and replica instances.",
+	}, []string{"instance", "role", "version"})
+	clientRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_requests_total",
+		Help:      "Number of requests to the AdGuard Home API by endpoint and status.",
+	}, []string{"host", "method", "endpoint", "status"})
+	clientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "client_request_duration_seconds",
+		Help:      "Latency of the requests to the AdGuard Home API by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "method", "endpoint"})
+
+	versions      = make(map[string]string)
+	versionsMutex sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(
+		syncRunsStarted,
+		syncRuns,
+		replicaSyncDuration,
+		replicaChanges,
+		replicaSkippedDeletes,
+		replicaLastSuccess,
+		replicaLastCheck,
+		replicaDrift,
+		instanceInfo,
+		clientRequests,
+		clientRequestDuration,
+	)
+}
+
+// SyncStarted count a started sync run
+func SyncStarted() {
+	syncRunsStarted.Inc()
+}
+
+// SyncFinished count a finished sync run
+func SyncFinished(success bool) {
+	syncRuns.WithLabelValues(result(success)).Inc()
+}
+
+// ReplicaSynced record the outcome of a replica sync
+func ReplicaSynced(replica string, duration time.Duration, changes []types.Change, success bool) {
+	replicaSyncDuration.WithLabelValues(replica, result(success)).Observe(duration.Seconds())
+	for _, c := range changes {
+		replicaChanges.WithLabelValues(replica, c.Feature, string(c.Action)).Inc()
+	}
+	if success {
+		replicaLastSuccess.WithLabelValues(replica).SetToCurrentTime()
+	}
+}
+
+// DeletesSkipped count the deletes that were not applied to a replica
+func DeletesSkipped(replica string, skipped []types.Change) {
+	for _, c := range skipped {
+		replicaSkippedDeletes.WithLabelValues(replica, c.Feature).Inc()
+	}
+}
+
+// ReplicaChecked record the outcome of the comparison of a replica in detect mode, the last success of the
+// synced replicas is not changed
+func ReplicaChecked(replica string, changes int, success bool) {
+	if success {
+		replicaDrift.WithLabelValues(replica).Set(float64(changes))
+		replicaLastCheck.WithLabelValues(replica).SetToCurrentTime()
+	}
+}
+
+// InstanceVersion record the AdGuard Home version of an instance
+func InstanceVersion(role string, instance string, version string) {
+	versionsMutex.Lock()
+	defer versionsMutex.Unlock()
+	key := role + "#" + instance
+	if prev, ok := versions[key]; ok && prev != version {
+		instanceInfo.DeleteLabelValues(instance, role, prev)
+	}
+	versions[key] = version
+	instanceInfo.WithLabelValues(instance, role, version).Set(1)
+}
+
+// ClientRequest record a request to the AdGuard Home API
+func ClientRequest(host string, method string, endpoint string, status int, duration time.Duration) {
+	clientRequests.WithLabelValues(host, method, endpoint, strconv.Itoa(status)).Inc()
+	clientRequestDuration.WithLabelValues(host, method, endpoint).Observe(duration.Seconds())
+}
+
+func result(success bool) string {
+	if success {
+		return resultSucceeded
+	}
+	return resultFailed
+}
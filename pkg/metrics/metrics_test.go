@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Metrics", func() {
+	var replica string
+	BeforeEach(func() {
+		replica = "https://" + uuid.NewString()
+	})
+	Context("ReplicaSynced", func() {
+		It("should count the changes per feature and action", func() {
+			ReplicaSynced(replica, time.Second, []types.Change{
+				{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd},
+				{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd},
+				{Feature: types.FeatureClientSettings, Action: types.ActionDelete},
+			}, true)
+			Ω(testutil.ToFloat64(replicaChanges.WithLabelValues(replica, types.FeatureDNSRewrites, string(types.ActionAdd)))).Should(Equal(2.0))
+			Ω(testutil.ToFloat64(replicaChanges.WithLabelValues(replica, types.FeatureClientSettings, string(types.ActionDelete)))).Should(Equal(1.0))
+			Ω(testutil.ToFloat64(replicaLastSuccess.WithLabelValues(replica))).Should(BeNumerically(">", 0))
+		})
+		It("should not update the last success timestamp on failure", func() {
+			ReplicaSynced(replica, time.Second, nil, false)
+			Ω(testutil.ToFloat64(replicaLastSuccess.WithLabelValues(replica))).Should(BeZero())
+		})
+	})
+	Context("DeletesSkipped", func() {
+		It("should count the skipped deletes per feature", func() {
+			DeletesSkipped(replica, []types.Change{
+				{Feature: types.FeatureDNSRewrites, Action: types.ActionDelete},
+				{Feature: types.FeatureDNSRewrites, Action: types.ActionDelete},
+			})
+			Ω(testutil.ToFloat64(replicaSkippedDeletes.WithLabelValues(replica, types.FeatureDNSRewrites))).Should(Equal(2.0))
+		})
+	})
+	Context("ReplicaChecked", func() {
+		It("should set the number of differences", func() {
+			ReplicaChecked(replica, 3, true)
+			Ω(testutil.ToFloat64(replicaDrift.WithLabelValues(replica))).Should(Equal(3.0))
+			ReplicaChecked(replica, 0, true)
+			Ω(testutil.ToFloat64(replicaDrift.WithLabelValues(replica))).Should(BeZero())
+		})
+		It("should set the last check but not the last success timestamp", func() {
+			ReplicaChecked(replica, 1, true)
+			Ω(testutil.ToFloat64(replicaLastCheck.WithLabelValues(replica))).Should(BeNumerically(">", 0))
+			Ω(testutil.ToFloat64(replicaLastSuccess.WithLabelValues(replica))).Should(BeZero())
+		})
+		It("should not update the metrics on failure", func() {
+			ReplicaChecked(replica, 1, false)
+			Ω(testutil.ToFloat64(replicaLastCheck.WithLabelValues(replica))).Should(BeZero())
+			Ω(testutil.ToFloat64(replicaDrift.WithLabelValues(replica))).Should(BeZero())
+		})
+	})
+	Context("InstanceVersion", func() {
+		It("should replace the previous version", func() {
+			InstanceVersion(RoleReplica, replica, "v0.107.0")
+			InstanceVersion(RoleReplica, replica, "v0.107.1")
+			Ω(testutil.ToFloat64(instanceInfo.WithLabelValues(replica, RoleReplica, "v0.107.1"))).Should(Equal(1.0))
+			Ω(instanceInfo.DeleteLabelValues(replica, RoleReplica, "v0.107.0")).Should(BeFalse())
+		})
+	})
+	Context("SyncFinished", func() {
+		It("should count by result", func() {
+			before := testutil.ToFloat64(syncRuns.WithLabelValues(resultFailed))
+			SyncFinished(false)
+			Ω(testutil.ToFloat64(syncRuns.WithLabelValues(resultFailed))).Should(Equal(before + 1))
+		})
+	})
+})
@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+var l = log.GetLogger("notify")
+
+// Event an event of a finished sync run
+type Event struct {
+	Type types.EventType `json:"type"`
+	// Repeated true if the previous run had the same failure or drift event
+	Repeated bool       `json:"repeated"`
+	Message  string     `json:"message"`
+	Run      *types.Run `json:"run"`
+}
+
+// Events returns the events of the finished run, compared with the previous run that is nil if there was none
+func Events(run *types.Run, previous *types.Run) []*Event {
+	var events []*Event
+	failed := run.HasErrors()
+	previousFailed := previous != nil && previous.HasErrors()
+	if failed {
+		events = append(events, &Event{Type: types.EventFailure, Repeated: previousFailed, Message: failureMessage(run), Run: run})
+	} else {
+		if previousFailed {
+			events = append(events, &Event{
+				Type:    types.EventRecovery,
+				Message: fmt.Sprintf("Sync from %s recovered, all replicas were synced successfully", run.Origin),
+				Run:     run,
+			})
+		}
+		events = append(events, &Event{
+			Type:    types.EventSuccess,
+			Message: fmt.Sprintf("Sync from %s succeeded", run.Origin),
+			Run:     run,
+		})
+	}
+	if run.HasDrift() {
+		events = append(events, &Event{
+			Type:     types.EventDrift,
+			Repeated: previous != nil && previous.HasDrift(),
+			Message:  driftMessage(run),
+			Run:      run,
+		})
+	}
+	return events
+}
+
+func failureMessage(run *types.Run) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Sync from %s failed", run.Origin))
+	if run.Error != "" {
+		sb.WriteString(": " + run.Error)
+	}
+	for _, rr := range run.Replicas {
+		if rr.Error != "" {
+			sb.WriteString(fmt.Sprintf("\n- %s: %s", rr.Replica, rr.Error))
+		}
+	}
+	return sb.String()
+}
+
+func driftMessage(run *types.Run) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Replicas differ from origin %s", run.Origin))
+	for _, rr := range run.Replicas {
+		if rr.Drift {
+			sb.WriteString(fmt.Sprintf("\n- %s: %d differences", rr.Replica, len(rr.Changes)))
+		}
+	}
+	return sb.String()
+}
+
+// Sender sends an event
+type Sender interface {
+	Send(e *Event) error
+}
+
+// Dispatcher sends the events of the sync runs to the notifiers by their rules
+type Dispatcher struct {
+	notifiers []notifier
+}
+
+type notifier struct {
+	cfg    types.Notification
+	sender Sender
+}
+
+// New creates the notifiers of the configurations
+func New(cfgs []types.Notification) (*Dispatcher, error) {
+	d := &Dispatcher{}
+	for _, cfg := range cfgs {
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		tpl, err := parseTemplate(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var s Sender
+		switch cfg.Type {
+		case types.NotificationWebhook:
+			s = &webhook{url: cfg.URL, headers: cfg.Headers, template: tpl}
+		case types.NotificationChat:
+			s = &chat{url: cfg.URL, headers: cfg.Headers, template: tpl}
+		case types.NotificationSMTP:
+			s = &email{cfg: cfg.SMTP, template: tpl}
+		}
+		d.notifiers = append(d.notifiers, notifier{cfg: cfg, sender: s})
+	}
+	return d, nil
+}
+
+// Notify sends the events of the finished run to the notifiers, errors are logged
+func (d *Dispatcher) Notify(run *types.Run, previous *types.Run) {
+	if d == nil || len(d.notifiers) == 0 {
+		return
+	}
+	for _, e := range Events(run, previous) {
+		for _, n := range d.notifiers {
+			if !n.cfg.Notifies(e.Type) || (e.Repeated && !n.cfg.Repeat) {
+				continue
+			}
+			nl := l.With("notifier", n.cfg.DisplayName(), "event", e.Type, "run_id", run.ID)
+			if err := n.sender.Send(e); err != nil {
+				nl.With("error", err).Error("Error sending notification")
+			} else {
+				nl.Info("Notification sent")
+			}
+		}
+	}
+}
+
+func parseTemplate(cfg types.Notification) (*template.Template, error) {
+	if cfg.Template == "" {
+		return nil, nil
+	}
+	tpl, err := template.New(cfg.DisplayName()).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("notification %s: invalid template: %w", cfg.DisplayName(), err)
+	}
+	return tpl, nil
+}
+
+// render renders the template with the event, the message of the event if there is no template
+func render(tpl *template.Template, e *Event) (string, error) {
+	if tpl == nil {
+		return e.Message, nil
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, e); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,226 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Notify", func() {
+	var (
+		failed    *types.Run
+		succeeded *types.Run
+		drift     *types.Run
+	)
+	eventTypes := func(events []*Event) []types.EventType {
+		var et []types.EventType
+		for _, e := range events {
+			et = append(et, e.Type)
+		}
+		return et
+	}
+
+	BeforeEach(func() {
+		failed = &types.Run{ID: "1", Origin: "https://origin", Replicas: []*types.ReplicaResult{
+			{Replica: "https://replica1", Error: "connection refused"},
+			{Replica: "https://replica2"},
+		}}
+		succeeded = &types.Run{ID: "2", Origin: "https://origin", Replicas: []*types.ReplicaResult{{Replica: "https://replica1"}}}
+		drift = &types.Run{ID: "3", Origin: "https://origin", Replicas: []*types.ReplicaResult{
+			{Replica: "https://replica1", Drift: true, Changes: []types.Change{{Feature: types.FeatureDNSRewrites}}},
+		}}
+	})
+
+	Context("Events", func() {
+		It("should report the first failure", func() {
+			events := Events(failed, succeeded)
+			Ω(eventTypes(events)).Should(Equal([]types.EventType{types.EventFailure}))
+			Ω(events[0].Repeated).Should(BeFalse())
+			Ω(events[0].Message).Should(Equal("Sync from https://origin failed\n- https://replica1: connection refused"))
+		})
+		It("should report a repeated failure", func() {
+			events := Events(failed, failed)
+			Ω(events[0].Repeated).Should(BeTrue())
+		})
+		It("should report the recovery", func() {
+			Ω(eventTypes(Events(succeeded, failed))).Should(Equal([]types.EventType{types.EventRecovery, types.EventSuccess}))
+			Ω(eventTypes(Events(succeeded, nil))).Should(Equal([]types.EventType{types.EventSuccess}))
+		})
+		It("should report the drift", func() {
+			events := Events(drift, nil)
+			Ω(eventTypes(events)).Should(Equal([]types.EventType{types.EventSuccess, types.EventDrift}))
+			Ω(events[1].Message).Should(Equal("Replicas differ from origin https://origin\n- https://replica1: 1 differences"))
+			Ω(Events(drift, drift)[1].Repeated).Should(BeTrue())
+		})
+	})
+
+	Context("Dispatcher", func() {
+		var (
+			server   *httptest.Server
+			requests []map[string]interface{}
+			headers  []http.Header
+		)
+		BeforeEach(func() {
+			requests = nil
+			headers = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				req := map[string]interface{}{}
+				Ω(json.Unmarshal(b, &req)).ShouldNot(HaveOccurred())
+				requests = append(requests, req)
+				headers = append(headers, r.Header)
+			}))
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should notify the first failure and the recovery only by default", func() {
+			d, err := New([]types.Notification{{Type: types.NotificationWebhook, URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}}})
+			Ω(err).ShouldNot(HaveOccurred())
+			d.Notify(failed, succeeded)
+			d.Notify(failed, failed)
+			d.Notify(succeeded, failed)
+			d.Notify(succeeded, succeeded)
+			Ω(requests).Should(HaveLen(2))
+			Ω(requests[0]["type"]).Should(Equal("failure"))
+			Ω(requests[0]["run"]).Should(HaveKeyWithValue("id", "1"))
+			Ω(requests[1]["type"]).Should(Equal("recovery"))
+			Ω(headers[0].Get("Authorization")).Should(Equal("Bearer token"))
+		})
+		It("should notify every failure if repeated", func() {
+			d, err := New([]types.Notification{{Type: types.NotificationWebhook, URL: server.URL, Repeat: true}})
+			Ω(err).ShouldNot(HaveOccurred())
+			d.Notify(failed, failed)
+			Ω(requests).Should(HaveLen(1))
+		})
+		It("should render the body template", func() {
+			d, err := New([]types.Notification{{
+				Type:     types.NotificationWebhook,
+				URL:      server.URL,
+				Events:   []types.EventType{types.EventDrift},
+				Template: `{"event":"{{ .Type }}","replica":{{ json (index .Run.Replicas 0).Replica }}}`,
+			}})
+			Ω(err).ShouldNot(HaveOccurred())
+			d.Notify(drift, nil)
+			Ω(requests).Should(Equal([]map[string]interface{}{{"event": "drift", "replica": "https://replica1"}}))
+		})
+		It("should post the message to a chat webhook", func() {
+			d, err := New([]types.Notification{{Type: types.NotificationChat, URL: server.URL}})
+			Ω(err).ShouldNot(HaveOccurred())
+			d.Notify(failed, nil)
+			Ω(requests).Should(Equal([]map[string]interface{}{{"text": "Sync from https://origin failed\n- https://replica1: connection refused"}}))
+		})
+		It("should send an email", func() {
+			var addr, from string
+			var to []string
+			var msg []byte
+			sendMail = func(a string, _ smtp.Auth, f string, t []string, m []byte) error {
+				addr, from, to, msg = a, f, t, m
+				return nil
+			}
+			defer func() { sendMail = sendMailWithTimeout }()
+
+			d, err := New([]types.Notification{{Type: types.NotificationSMTP, SMTP: types.SMTP{
+				Host: "mail.example.com",
+				From: "sync@example.com",
+				To:   []string{"admin@example.com"},
+			}}})
+			Ω(err).ShouldNot(HaveOccurred())
+			d.Notify(failed, nil)
+			Ω(addr).Should(Equal("mail.example.com:587"))
+			Ω(from).Should(Equal("sync@example.com"))
+			Ω(to).Should(Equal([]string{"admin@example.com"}))
+			Ω(string(msg)).Should(ContainSubstring("Subject: [adguardhome-sync] sync failure\r\n"))
+			Ω(string(msg)).Should(ContainSubstring("\r\n\r\nSync from https://origin failed\r\n- https://replica1: connection refused\r\n"))
+		})
+		It("should send an email to the SMTP server", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = ln.Close() }()
+			received := make(chan string, 1)
+			go serveSMTP(ln, received)
+
+			err = sendMailWithTimeout(ln.Addr().String(), nil, "sync@example.com", []string{"admin@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(<-received).Should(ContainSubstring("body"))
+		})
+		It("should fail if the SMTP server does not answer within the timeout", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = ln.Close() }()
+			// accepts the connection, but never sends the greeting
+			go func() {
+				if c, err := ln.Accept(); err == nil {
+					defer func() { _ = c.Close() }()
+					_, _ = io.Copy(io.Discard, c)
+				}
+			}()
+			smtpTimeout = 100 * time.Millisecond
+			defer func() { smtpTimeout = 10 * time.Second }()
+
+			start := time.Now()
+			err = sendMailWithTimeout(ln.Addr().String(), nil, "sync@example.com", []string{"admin@example.com"}, []byte("test"))
+			Ω(err).Should(HaveOccurred())
+			Ω(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+		})
+		It("should validate the notifications", func() {
+			_, err := New([]types.Notification{{Type: "foo"}})
+			Ω(err).Should(MatchError(`notification foo: invalid type "foo"`))
+			_, err = New([]types.Notification{{Name: "ci", Type: types.NotificationWebhook}})
+			Ω(err).Should(MatchError("notification ci: url is required"))
+			_, err = New([]types.Notification{{Type: types.NotificationChat, URL: "https://chat", Events: []types.EventType{"foo"}}})
+			Ω(err).Should(MatchError(`notification chat: invalid event "foo"`))
+			_, err = New([]types.Notification{{Type: types.NotificationChat, URL: "https://chat", Template: "{{ .Foo"}})
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
+
+// serveSMTP answers a single SMTP session without extensions and sends the received data to the channel
+func serveSMTP(ln net.Listener, received chan<- string) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer func() { _ = c.Close() }()
+	r := bufio.NewReader(c)
+	_, _ = c.Write([]byte("220 localhost\r\n"))
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			_, _ = c.Write([]byte("250 localhost\r\n"))
+		case cmd == "DATA":
+			_, _ = c.Write([]byte("354 go ahead\r\n"))
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			received <- data.String()
+			_, _ = c.Write([]byte("250 OK\r\n"))
+		case cmd == "QUIT":
+			_, _ = c.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			_, _ = c.Write([]byte("250 OK\r\n"))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+const defaultSMTPPort = 587
+
+var (
+	// sendMail sends the email, replaced in the tests
+	sendMail = sendMailWithTimeout
+	// smtpTimeout the timeout of connecting to the SMTP server and sending an email
+	smtpTimeout = 10 * time.Second
+)
+
+// email sends the message, or the rendered template, as email
+type email struct {
+	cfg      types.SMTP
+	template *template.Template
+}
+
+func (m *email) Send(e *Event) error {
+	text, err := render(m.template, e)
+	if err != nil {
+		return err
+	}
+	port := m.cfg.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+
+	msg := strings.Builder{}
+	msg.WriteString("From: " + m.cfg.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(m.cfg.To, ", ") + "\r\n")
+	msg.WriteString(fmt.Sprintf("Subject: [adguardhome-sync] sync %s\r\n", e.Type))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+
+	return sendMail(net.JoinHostPort(m.cfg.Host, strconv.Itoa(port)), auth, m.cfg.From, m.cfg.To, []byte(msg.String()))
+}
+
+// sendMailWithTimeout sends the email like smtp.SendMail, but fails if the SMTP server does not answer within the timeout
+func sendMailWithTimeout(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhook posts the event as json, or the rendered template as body
+type webhook struct {
+	url      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func (w *webhook) Send(e *Event) error {
+	var body []byte
+	if w.template == nil {
+		var err error
+		if body, err = json.Marshal(e); err != nil {
+			return err
+		}
+	} else {
+		b, err := render(w.template, e)
+		if err != nil {
+			return err
+		}
+		body = []byte(b)
+	}
+	return post(w.url, w.headers, body)
+}
+
+// chat posts the message, or the rendered template, as text to a chat-style incoming webhook
+type chat struct {
+	url      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func (c *chat) Send(e *Event) error {
+	text, err := render(c.template, e)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	return post(c.url, c.headers, body)
+}
+
+func post(url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d of %s", resp.StatusCode, url)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+// Differences counts the differences between the normalized snapshots,
+// every added or removed item of a list and every changed value counts as one difference
+func Differences(a *types.Snapshot, b *types.Snapshot) int {
+	return countDifferences(genericValue(Normalize(a)), genericValue(Normalize(b)))
+}
+
+func genericValue(s *types.Snapshot) interface{} {
+	var v interface{}
+	b, _ := json.Marshal(s)
+	_ = json.Unmarshal(b, &v)
+	return v
+}
+
+func countDifferences(a interface{}, b interface{}) int {
+	am, aIsMap := a.(map[string]interface{})
+	bm, bIsMap := b.(map[string]interface{})
+	if aIsMap || bIsMap {
+		if a != nil && b != nil && aIsMap != bIsMap {
+			return 1
+		}
+		diff := 0
+		for k, av := range am {
+			diff += countDifferences(av, bm[k])
+		}
+		for k, bv := range bm {
+			if _, ok := am[k]; !ok {
+				diff += countDifferences(nil, bv)
+			}
+		}
+		return diff
+	}
+
+	as, aIsList := a.([]interface{})
+	bs, bIsList := b.([]interface{})
+	if aIsList || bIsList {
+		if a != nil && b != nil && aIsList != bIsList {
+			return 1
+		}
+		// the items are compared as multiset, independent of their order
+		items := make(map[string]int)
+		for _, v := range as {
+			items[compact(v)]++
+		}
+		for _, v := range bs {
+			items[compact(v)]--
+		}
+		diff := 0
+		for _, n := range items {
+			if n < 0 {
+				n = -n
+			}
+			diff += n
+		}
+		return diff
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return 1
+}
+
+func compact(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,39 @@
+package snapshot_test
+
+import (
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Differences", func() {
+	var a, b *types.Snapshot
+	BeforeEach(func() {
+		a = &types.Snapshot{
+			Source:      "https://origin1",
+			Rewrites:    &types.RewriteEntries{{Domain: "a", Answer: "1"}, {Domain: "b", Answer: "2"}},
+			Services:    &types.Services{"youtube"},
+			StatsConfig: &types.IntervalConfig{Interval: 1},
+		}
+		b = &types.Snapshot{
+			Source:      "https://origin2",
+			Rewrites:    &types.RewriteEntries{{Domain: "b", Answer: "2"}, {Domain: "a", Answer: "1"}},
+			Services:    &types.Services{"youtube"},
+			StatsConfig: &types.IntervalConfig{Interval: 1},
+		}
+	})
+	It("should have no differences for the same config", func() {
+		Ω(snapshot.Differences(a, b)).Should(BeZero())
+	})
+	It("should count the changed items and values", func() {
+		b.Rewrites = &types.RewriteEntries{{Domain: "a", Answer: "1"}, {Domain: "c", Answer: "3"}}
+		b.StatsConfig.Interval = 7
+		Ω(snapshot.Differences(a, b)).Should(Equal(3))
+	})
+	It("should count all items of a missing section", func() {
+		b.Rewrites = nil
+		b.Services = nil
+		Ω(snapshot.Differences(a, b)).Should(Equal(3))
+	})
+})
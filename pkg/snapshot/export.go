@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+// Normalize returns a sorted copy of the snapshot without the volatile metadata of the instance
+func Normalize(s *types.Snapshot) *types.Snapshot {
+	n := &types.Snapshot{}
+	b, _ := json.Marshal(s)
+	_ = json.Unmarshal(b, n)
+
+	n.Version = types.SnapshotVersion
+	n.Created = nil
+	n.Source = ""
+	n.AdGuardHomeVersion = ""
+
+	if n.Rewrites != nil {
+		sort.Slice(*n.Rewrites, func(i, j int) bool {
+			return (*n.Rewrites)[i].Key() < (*n.Rewrites)[j].Key()
+		})
+	}
+	if n.Services != nil {
+		n.Services.Sort()
+	}
+	if n.Filtering != nil {
+		normalizeFilters(n.Filtering.Filters)
+		normalizeFilters(n.Filtering.WhitelistFilters)
+	}
+	if n.Clients != nil {
+		n.Clients.AutoClients = nil
+		n.Clients.SupportedTags = nil
+		for i := range n.Clients.Clients {
+			n.Clients.Clients[i].Sort()
+		}
+		sort.Slice(n.Clients.Clients, func(i, j int) bool {
+			return n.Clients.Clients[i].Name < n.Clients.Clients[j].Name
+		})
+	}
+	if n.DHCPServerConfig != nil {
+		n.DHCPServerConfig.Leases = nil
+		sort.Slice(n.DHCPServerConfig.StaticLeases, func(i, j int) bool {
+			return n.DHCPServerConfig.StaticLeases[i].HWAddr < n.DHCPServerConfig.StaticLeases[j].HWAddr
+		})
+	}
+	return n
+}
+
+func normalizeFilters(f types.Filters) {
+	for i := range f {
+		f[i].ID = 0
+		f[i].RulesCount = 0
+	}
+	sort.Slice(f, func(i, j int) bool {
+		return f[i].URL < f[j].URL
+	})
+}
+
+// Export marshals the normalized snapshot in the given format, omitting the fields that are managed by the instance
+func Export(s *types.Snapshot, format string) ([]byte, error) {
+	b, err := json.Marshal(Normalize(s))
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	if filtering, ok := v["filtering"].(map[string]interface{}); ok {
+		for _, key := range []string{"filters", "whitelist_filters"} {
+			filters, _ := filtering[key].([]interface{})
+			for _, f := range filters {
+				if fm, ok := f.(map[string]interface{}); ok {
+					delete(fm, "id")
+					delete(fm, "rules_count")
+				}
+			}
+		}
+	}
+	if clients, ok := v["clients"].(map[string]interface{}); ok {
+		delete(clients, "auto_clients")
+		delete(clients, "supported_tags")
+	}
+	return encode(v, format)
+}
+
+// Hash returns the sha256 hash of the normalized snapshot, equal configs have the same hash
+func Hash(s *types.Snapshot) string {
+	b, _ := json.Marshal(Normalize(s))
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
@@ -0,0 +1,106 @@
+package snapshot_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+	var snap *types.Snapshot
+	BeforeEach(func() {
+		now := time.Now()
+		snap = &types.Snapshot{
+			Version:            types.SnapshotVersion,
+			Created:            &now,
+			Source:             "https://origin",
+			AdGuardHomeVersion: "v0.107.0",
+			Rewrites:           &types.RewriteEntries{{Domain: "b", Answer: "1"}, {Domain: "a", Answer: "2"}},
+			Services:           &types.Services{"youtube", "tiktok"},
+			Filtering: &types.FilteringStatus{
+				Filters: types.Filters{
+					{ID: 2, URL: "https://b", Name: "b", RulesCount: 20},
+					{ID: 1, URL: "https://a", Name: "a", RulesCount: 10},
+				},
+				UserRules: types.UserRules{"||b^", "||a^"},
+			},
+			Clients: &types.Clients{
+				Clients:       []types.Client{{Name: "b", Ids: []string{"2", "1"}}, {Name: "a", Ids: []string{"3"}}},
+				SupportedTags: []string{"device_pc"},
+			},
+			DHCPServerConfig: &types.DHCPServerConfig{
+				Leases:       types.Leases{{HWAddr: "00:00:00:00:00:01", IP: net.ParseIP("1.2.3.5")}},
+				StaticLeases: types.Leases{{HWAddr: "00:00:00:00:00:03", IP: net.ParseIP("1.2.3.4")}, {HWAddr: "00:00:00:00:00:02", IP: net.ParseIP("1.2.3.3")}},
+			},
+		}
+	})
+	It("should omit the volatile fields", func() {
+		b, err := snapshot.Export(snap, snapshot.FormatYAML)
+		Ω(err).ShouldNot(HaveOccurred())
+		out := string(b)
+		Ω(out).ShouldNot(ContainSubstring("created"))
+		Ω(out).ShouldNot(ContainSubstring("source"))
+		Ω(out).ShouldNot(ContainSubstring("adGuardHomeVersion"))
+		Ω(out).ShouldNot(ContainSubstring("rules_count"))
+		Ω(out).ShouldNot(ContainSubstring("id:"))
+		Ω(out).ShouldNot(ContainSubstring("auto_clients"))
+		Ω(out).ShouldNot(ContainSubstring("supported_tags"))
+		Ω(out).ShouldNot(ContainSubstring("00:00:00:00:00:01"))
+	})
+	It("should sort the entries but keep the order of the user rules", func() {
+		b, err := snapshot.Export(snap, snapshot.FormatJSON)
+		Ω(err).ShouldNot(HaveOccurred())
+		s, err := snapshot.Unmarshal(b, snapshot.FormatJSON)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(*s.Rewrites).Should(Equal(types.RewriteEntries{{Domain: "a", Answer: "2"}, {Domain: "b", Answer: "1"}}))
+		Ω(*s.Services).Should(Equal(types.Services{"tiktok", "youtube"}))
+		Ω(s.Filtering.Filters).Should(Equal(types.Filters{{URL: "https://a", Name: "a"}, {URL: "https://b", Name: "b"}}))
+		Ω(s.Filtering.UserRules).Should(Equal(types.UserRules{"||b^", "||a^"}))
+		Ω(s.Clients.Clients[0].Name).Should(Equal("a"))
+		Ω(s.Clients.Clients[1].Ids).Should(Equal([]string{"1", "2"}))
+		Ω(s.DHCPServerConfig.StaticLeases[0].HWAddr).Should(Equal("00:00:00:00:00:02"))
+	})
+	It("should be stable", func() {
+		a, err := snapshot.Export(snap, snapshot.FormatYAML)
+		Ω(err).ShouldNot(HaveOccurred())
+		(*snap.Rewrites)[0], (*snap.Rewrites)[1] = (*snap.Rewrites)[1], (*snap.Rewrites)[0]
+		now := time.Now()
+		snap.Created = &now
+		b, err := snapshot.Export(snap, snapshot.FormatYAML)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal(string(a)))
+	})
+	It("should not modify the snapshot", func() {
+		_, err := snapshot.Export(snap, snapshot.FormatYAML)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω((*snap.Rewrites)[0].Domain).Should(Equal("b"))
+		Ω(snap.Filtering.Filters[0].ID).Should(Equal(2))
+	})
+	It("should have the same hash for the same config", func() {
+		other := &types.Snapshot{
+			Source:   "https://other",
+			Rewrites: &types.RewriteEntries{{Domain: "a", Answer: "2"}, {Domain: "b", Answer: "1"}},
+			Services: &types.Services{"tiktok", "youtube"},
+			Filtering: &types.FilteringStatus{
+				Filters: types.Filters{
+					{ID: 7, URL: "https://a", Name: "a", RulesCount: 11},
+					{ID: 8, URL: "https://b", Name: "b", RulesCount: 21},
+				},
+				UserRules: types.UserRules{"||b^", "||a^"},
+			},
+			Clients: &types.Clients{
+				Clients: []types.Client{{Name: "a", Ids: []string{"3"}}, {Name: "b", Ids: []string{"1", "2"}}},
+			},
+			DHCPServerConfig: &types.DHCPServerConfig{
+				StaticLeases: types.Leases{{HWAddr: "00:00:00:00:00:02", IP: net.ParseIP("1.2.3.3")}, {HWAddr: "00:00:00:00:00:03", IP: net.ParseIP("1.2.3.4")}},
+			},
+		}
+		Ω(snapshot.Hash(other)).Should(Equal(snapshot.Hash(snap)))
+		other.Filtering.UserRules = types.UserRules{"||a^", "||b^"}
+		Ω(snapshot.Hash(other)).ShouldNot(Equal(snapshot.Hash(snap)))
+	})
+})
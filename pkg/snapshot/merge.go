@@ -0,0 +1,388 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+const (
+	// SectionRewrites the dns rewrites, keyed by domain and answer
+	SectionRewrites = "rewrites"
+	// SectionClients the persistent clients, keyed by name
+	SectionClients = "clients"
+	// SectionFilters the block lists, keyed by url
+	SectionFilters = "filters"
+	// SectionWhitelistFilters the allow lists, keyed by url
+	SectionWhitelistFilters = "whitelistFilters"
+	// SectionStaticLeases the dhcp static leases, keyed by mac
+	SectionStaticLeases = "staticLeases"
+	// SectionUserRules the synchronized user rules, keyed by the rule
+	SectionUserRules = "userRules"
+)
+
+var sectionFeatures = map[string]string{
+	SectionRewrites:         types.FeatureDNSRewrites,
+	SectionClients:          types.FeatureClientSettings,
+	SectionFilters:          types.FeatureFilters,
+	SectionWhitelistFilters: types.FeatureFilters,
+	SectionStaticLeases:     types.FeatureDHCPStaticLeases,
+	SectionUserRules:        types.FeatureFilters,
+}
+
+// ItemSet the items of the sections of an instance, the values are the items as json
+type ItemSet map[string]map[string]string
+
+// ItemsOf returns the items of the sections of the enabled features, all sections if the features are nil
+func ItemsOf(s *types.Snapshot, f *types.Features) ItemSet {
+	n := Normalize(s)
+	items := ItemSet{}
+	add := func(section string, key string, value interface{}) {
+		items[section][key] = compact(value)
+	}
+	// enabled adds the section if its feature is enabled
+	enabled := func(section string) bool {
+		if f != nil && !f.Enabled(sectionFeatures[section]) {
+			return false
+		}
+		items[section] = map[string]string{}
+		return true
+	}
+
+	if n.Rewrites != nil && enabled(SectionRewrites) {
+		for _, re := range *n.Rewrites {
+			add(SectionRewrites, re.Key(), re)
+		}
+	}
+	if n.Clients != nil && enabled(SectionClients) {
+		for _, cl := range n.Clients.Clients {
+			add(SectionClients, cl.Name, cl)
+		}
+	}
+	if n.Filtering != nil && enabled(SectionFilters) && enabled(SectionWhitelistFilters) && enabled(SectionUserRules) {
+		for _, fi := range n.Filtering.Filters {
+			add(SectionFilters, fi.URL, fi)
+		}
+		for _, fi := range n.Filtering.WhitelistFilters {
+			add(SectionWhitelistFilters, fi.URL, fi)
+		}
+		synced, _ := n.Filtering.UserRules.Split()
+		for _, r := range synced {
+			add(SectionUserRules, r, r)
+		}
+	}
+	if n.DHCPServerConfig != nil && enabled(SectionStaticLeases) {
+		for _, le := range n.DHCPServerConfig.StaticLeases {
+			add(SectionStaticLeases, le.HWAddr, le)
+		}
+	}
+	return items
+}
+
+func (is ItemSet) copy() ItemSet {
+	c := ItemSet{}
+	for section, items := range is {
+		c[section] = map[string]string{}
+		for k, v := range items {
+			c[section][k] = v
+		}
+	}
+	return c
+}
+
+func (is ItemSet) set(section string, key string, value string, present bool) {
+	if !present {
+		delete(is[section], key)
+		return
+	}
+	if is[section] == nil {
+		is[section] = map[string]string{}
+	}
+	is[section][key] = value
+}
+
+// MergeState the state of an instance in the multi-master mode
+type MergeState struct {
+	// Base the items after the last sync, nil if the instance was never synced
+	Base ItemSet `json:"base,omitempty"`
+	// Current the items when the instance was read the last time
+	Current ItemSet `json:"current,omitempty"`
+	// Seen when the current value of an item was observed first
+	Seen map[string]map[string]time.Time `json:"seen,omitempty"`
+}
+
+// Observe sets the current items of the instance, the time an item is seen is kept as long as its value does not change
+func (s *MergeState) Observe(items ItemSet, now time.Time) {
+	seen := map[string]map[string]time.Time{}
+	for section, values := range items {
+		seen[section] = map[string]time.Time{}
+		previous := s.Current[section]
+		for k, v := range values {
+			seen[section][k] = now
+			if pv, ok := previous[k]; ok && pv == v {
+				if t, ok := s.Seen[section][k]; ok {
+					seen[section][k] = t
+				}
+			}
+		}
+		// deleted items are kept to know when they were deleted
+		for k := range s.Base[section] {
+			if _, ok := values[k]; ok {
+				continue
+			}
+			seen[section][k] = now
+			if _, ok := previous[k]; !ok && previous != nil {
+				if t, ok := s.Seen[section][k]; ok {
+					seen[section][k] = t
+				}
+			}
+		}
+	}
+	s.Current = items
+	s.Seen = seen
+}
+
+// Synced sets the merged items as the base of the next merge. The items of the unresolved conflicts keep
+// their base and their current value, the items not managed on the instance keep their current value,
+// as they were not synced
+func (s *MergeState) Synced(merged ItemSet, conflicts []types.Conflict, managed Managed) {
+	base := merged.copy()
+	current := merged.copy()
+	if managed != nil {
+		for section, values := range merged {
+			own := s.Current[section]
+			for k, v := range values {
+				if ov, ok := own[k]; !managed(section, v) || (ok && !managed(section, ov)) {
+					base.set(section, k, ov, ok)
+					current.set(section, k, ov, ok)
+				}
+			}
+			for k, ov := range own {
+				if _, ok := values[k]; !ok && !managed(section, ov) {
+					base.set(section, k, ov, true)
+					current.set(section, k, ov, true)
+				}
+			}
+		}
+	}
+	for _, c := range conflicts {
+		if c.Winner != "" {
+			continue
+		}
+		bv, ok := s.Base[c.Section][c.Key]
+		base.set(c.Section, c.Key, bv, ok)
+		cv, ok := s.Current[c.Section][c.Key]
+		current.set(c.Section, c.Key, cv, ok)
+	}
+	s.Base = base
+	s.Current = current
+}
+
+// Managed decides if the item of a section is synced to an instance, by its json value
+type Managed func(section string, value string) bool
+
+// MergeInstance the merge state of a named instance
+type MergeInstance struct {
+	Name string
+	*MergeState
+	// Managed the items synced to the instance, all items if nil. The changes of the other items are not merged.
+	Managed Managed
+}
+
+func (in MergeInstance) manages(section string, values ...string) bool {
+	if in.Managed == nil {
+		return true
+	}
+	for _, v := range values {
+		if v != "" && !in.Managed(section, v) {
+			return false
+		}
+	}
+	return true
+}
+
+type itemChange struct {
+	instance int
+	value    string
+	present  bool
+}
+
+// ThreeWay merges the changes of the instances since their last sync. The first instance is the origin, its
+// items are used for all items that were not changed. Instances without base were never synced, their items are
+// not merged. Items changed differently on multiple instances are conflicts resolved by the resolution. User rules
+// can't be excluded from the sync, their manual conflicts are resolved with the value of the origin.
+func ThreeWay(instances []MergeInstance, resolution types.ConflictResolution) (ItemSet, []types.Conflict) {
+	merged := ItemSet{}
+	if len(instances) == 0 {
+		return merged, nil
+	}
+	if resolution == "" {
+		resolution = types.ResolutionPreferOrigin
+	}
+	var conflicts []types.Conflict
+	origin := instances[0]
+
+	sections := sortedKeys(origin.Current)
+	for _, section := range sections {
+		merged[section] = map[string]string{}
+		keys := map[string]bool{}
+		for _, in := range instances {
+			for k := range in.Current[section] {
+				keys[k] = true
+			}
+			for k := range in.Base[section] {
+				keys[k] = true
+			}
+		}
+
+		for _, key := range sortedKeys(keys) {
+			var changes []itemChange
+			for i, in := range instances {
+				if in.Base == nil {
+					continue
+				}
+				if _, ok := in.Current[section]; !ok {
+					continue
+				}
+				cv, cok := in.Current[section][key]
+				bv, bok := in.Base[section][key]
+				if (cok != bok || cv != bv) && in.manages(section, cv, bv) {
+					changes = append(changes, itemChange{instance: i, value: cv, present: cok})
+				}
+			}
+
+			ov, ook := origin.Current[section][key]
+			switch {
+			case len(changes) == 0:
+				merged.set(section, key, ov, ook)
+			case agree(changes):
+				merged.set(section, key, changes[0].value, changes[0].present)
+			default:
+				c := types.Conflict{
+					Section:    section,
+					Key:        key,
+					Values:     map[string]interface{}{},
+					Resolution: resolution,
+				}
+				for _, ch := range changes {
+					c.Values[instances[ch.instance].Name] = ch.jsonValue()
+				}
+				switch {
+				case resolution == types.ResolutionNewestWins:
+					newest := changes[0]
+					for _, ch := range changes[1:] {
+						if instances[ch.instance].Seen[section][key].After(instances[newest.instance].Seen[section][key]) {
+							newest = ch
+						}
+					}
+					c.Winner = instances[newest.instance].Name
+					merged.set(section, key, newest.value, newest.present)
+				case resolution == types.ResolutionManual && section != SectionUserRules:
+					// the item is not synced, the origin keeps its value
+					merged.set(section, key, ov, ook)
+				default:
+					c.Winner = origin.Name
+					merged.set(section, key, ov, ook)
+				}
+				conflicts = append(conflicts, c)
+			}
+		}
+	}
+	return merged, conflicts
+}
+
+func agree(changes []itemChange) bool {
+	for _, ch := range changes[1:] {
+		if ch.present != changes[0].present || ch.value != changes[0].value {
+			return false
+		}
+	}
+	return true
+}
+
+func (ch itemChange) jsonValue() interface{} {
+	if !ch.present {
+		return nil
+	}
+	var v interface{}
+	_ = json.Unmarshal([]byte(ch.value), &v)
+	return v
+}
+
+// ApplyItems replaces the items of the snapshot sections with the merged items. The synchronized user rules
+// keep their order, added rules are appended.
+func ApplyItems(s *types.Snapshot, items ItemSet) {
+	if values, ok := items[SectionRewrites]; ok && s.Rewrites != nil {
+		rewrites := types.RewriteEntries{}
+		for _, k := range sortedKeys(values) {
+			var re types.RewriteEntry
+			_ = json.Unmarshal([]byte(values[k]), &re)
+			rewrites = append(rewrites, re)
+		}
+		s.Rewrites = &rewrites
+	}
+	if values, ok := items[SectionClients]; ok && s.Clients != nil {
+		s.Clients.Clients = nil
+		for _, k := range sortedKeys(values) {
+			var cl types.Client
+			_ = json.Unmarshal([]byte(values[k]), &cl)
+			s.Clients.Clients = append(s.Clients.Clients, cl)
+		}
+	}
+	if s.Filtering != nil {
+		if values, ok := items[SectionFilters]; ok {
+			s.Filtering.Filters = filtersOf(values)
+		}
+		if values, ok := items[SectionWhitelistFilters]; ok {
+			s.Filtering.WhitelistFilters = filtersOf(values)
+		}
+		if values, ok := items[SectionUserRules]; ok {
+			synced, local := s.Filtering.UserRules.Split()
+			rules := types.UserRules{}
+			for _, r := range synced {
+				if _, ok := values[r]; ok {
+					rules = append(rules, r)
+				}
+			}
+			known := map[string]bool{}
+			for _, r := range synced {
+				known[r] = true
+			}
+			for _, r := range sortedKeys(values) {
+				if !known[r] {
+					rules = append(rules, r)
+				}
+			}
+			s.Filtering.UserRules = append(rules, local...)
+		}
+	}
+	if values, ok := items[SectionStaticLeases]; ok && s.DHCPServerConfig != nil {
+		s.DHCPServerConfig.StaticLeases = nil
+		for _, k := range sortedKeys(values) {
+			var le types.Lease
+			_ = json.Unmarshal([]byte(values[k]), &le)
+			s.DHCPServerConfig.StaticLeases = append(s.DHCPServerConfig.StaticLeases, le)
+		}
+	}
+}
+
+func filtersOf(values map[string]string) types.Filters {
+	filters := types.Filters{}
+	for _, k := range sortedKeys(values) {
+		var f types.Filter
+		_ = json.Unmarshal([]byte(values[k]), &f)
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,169 @@
+package snapshot_test
+
+import (
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Merge", func() {
+	var (
+		t0, t1, t2 time.Time
+		base       snapshot.ItemSet
+	)
+	rewrites := func(entries ...types.RewriteEntry) snapshot.ItemSet {
+		re := types.RewriteEntries(entries)
+		return snapshot.ItemsOf(&types.Snapshot{Rewrites: &re}, nil)
+	}
+	instance := func(name string, items snapshot.ItemSet, seen time.Time) snapshot.MergeInstance {
+		s := &snapshot.MergeState{}
+		s.Observe(base, t0)
+		s.Synced(base, nil, nil)
+		s.Observe(items, seen)
+		return snapshot.MergeInstance{Name: name, MergeState: s}
+	}
+	keys := func(items snapshot.ItemSet, section string) []string {
+		var k []string
+		for key := range items[section] {
+			k = append(k, key)
+		}
+		return k
+	}
+
+	BeforeEach(func() {
+		t0 = time.Now()
+		t1 = t0.Add(time.Minute)
+		t2 = t0.Add(2 * time.Minute)
+		base = rewrites(types.RewriteEntry{Domain: "a", Answer: "1"}, types.RewriteEntry{Domain: "b", Answer: "2"})
+	})
+
+	Context("ItemsOf", func() {
+		It("should key the items of the sections", func() {
+			items := snapshot.ItemsOf(&types.Snapshot{
+				Clients: &types.Clients{Clients: []types.Client{{Name: "laptop"}}},
+				Filtering: &types.FilteringStatus{
+					Filters:          types.Filters{{URL: "https://block", ID: 3}},
+					WhitelistFilters: types.Filters{{URL: "https://allow"}},
+					UserRules:        types.UserRules{"||a^", types.UserRulesLocalStart, "||local^", types.UserRulesLocalEnd},
+				},
+				DHCPServerConfig: &types.DHCPServerConfig{StaticLeases: types.Leases{{HWAddr: "00:11"}}},
+			}, nil)
+			Ω(items).ShouldNot(HaveKey(snapshot.SectionRewrites))
+			Ω(keys(items, snapshot.SectionClients)).Should(ConsistOf("laptop"))
+			Ω(keys(items, snapshot.SectionFilters)).Should(ConsistOf("https://block"))
+			Ω(items[snapshot.SectionFilters]["https://block"]).ShouldNot(ContainSubstring(`"id":3`))
+			Ω(keys(items, snapshot.SectionWhitelistFilters)).Should(ConsistOf("https://allow"))
+			Ω(keys(items, snapshot.SectionUserRules)).Should(ConsistOf("||a^"))
+			Ω(keys(items, snapshot.SectionStaticLeases)).Should(ConsistOf("00:11"))
+		})
+		It("should only contain the sections of the enabled features", func() {
+			re := types.RewriteEntries{{Domain: "a", Answer: "1"}}
+			items := snapshot.ItemsOf(&types.Snapshot{
+				Rewrites: &re,
+				Clients:  &types.Clients{},
+			}, &types.Features{ClientSettings: true})
+			Ω(items).Should(HaveKey(snapshot.SectionClients))
+			Ω(items).ShouldNot(HaveKey(snapshot.SectionRewrites))
+		})
+	})
+
+	Context("ThreeWay", func() {
+		It("should use the origin for instances that were never synced", func() {
+			o := &snapshot.MergeState{}
+			o.Observe(base, t0)
+			r := &snapshot.MergeState{}
+			r.Observe(rewrites(types.RewriteEntry{Domain: "c", Answer: "3"}), t0)
+			merged, conflicts := snapshot.ThreeWay([]snapshot.MergeInstance{
+				{Name: "origin", MergeState: o},
+				{Name: "replica", MergeState: r},
+			}, types.ResolutionPreferOrigin)
+			Ω(conflicts).Should(BeEmpty())
+			Ω(merged).Should(Equal(base))
+		})
+		It("should merge the changes of all instances", func() {
+			merged, conflicts := snapshot.ThreeWay([]snapshot.MergeInstance{
+				instance("origin", rewrites(types.RewriteEntry{Domain: "a", Answer: "1"}, types.RewriteEntry{Domain: "b", Answer: "2"},
+					types.RewriteEntry{Domain: "c", Answer: "3"}), t1),
+				instance("replica1", rewrites(types.RewriteEntry{Domain: "b", Answer: "2"}), t1),
+				instance("replica2", base, t1),
+			}, types.ResolutionPreferOrigin)
+			Ω(conflicts).Should(BeEmpty())
+			Ω(keys(merged, snapshot.SectionRewrites)).Should(ConsistOf("b#2", "c#3"))
+		})
+		Context("conflicts", func() {
+			var instances []snapshot.MergeInstance
+			BeforeEach(func() {
+				clients := func(cl types.Client) snapshot.ItemSet {
+					return snapshot.ItemsOf(&types.Snapshot{Clients: &types.Clients{Clients: []types.Client{cl}}}, nil)
+				}
+				base = clients(types.Client{Name: "laptop"})
+				instances = []snapshot.MergeInstance{
+					instance("origin", clients(types.Client{Name: "laptop", FilteringEnabled: true}), t2),
+					instance("replica", clients(types.Client{Name: "laptop", ParentalEnabled: true}), t1),
+				}
+			})
+			It("should prefer the origin", func() {
+				merged, conflicts := snapshot.ThreeWay(instances, types.ResolutionPreferOrigin)
+				Ω(conflicts).Should(HaveLen(1))
+				Ω(conflicts[0].Section).Should(Equal(snapshot.SectionClients))
+				Ω(conflicts[0].Key).Should(Equal("laptop"))
+				Ω(conflicts[0].Winner).Should(Equal("origin"))
+				Ω(conflicts[0].Values).Should(HaveKey("replica"))
+				Ω(merged[snapshot.SectionClients]["laptop"]).Should(ContainSubstring(`"filtering_enabled":true`))
+			})
+			It("should use the newest change", func() {
+				instances[0], instances[1] = instances[1], instances[0]
+				merged, conflicts := snapshot.ThreeWay(instances, types.ResolutionNewestWins)
+				Ω(conflicts).Should(HaveLen(1))
+				Ω(conflicts[0].Winner).Should(Equal("origin"))
+				Ω(merged[snapshot.SectionClients]["laptop"]).Should(ContainSubstring(`"filtering_enabled":true`))
+			})
+			It("should not resolve manual conflicts", func() {
+				merged, conflicts := snapshot.ThreeWay(instances, types.ResolutionManual)
+				Ω(conflicts).Should(HaveLen(1))
+				Ω(conflicts[0].Winner).Should(BeEmpty())
+
+				instances[1].Synced(merged, conflicts, nil)
+				Ω(instances[1].Current[snapshot.SectionClients]["laptop"]).Should(ContainSubstring(`"parental_enabled":true`))
+				Ω(instances[1].Base).Should(Equal(base))
+			})
+			It("should not merge the changes of items not managed on the instance", func() {
+				instances[1].Managed = func(section string, value string) bool { return false }
+				merged, conflicts := snapshot.ThreeWay(instances, types.ResolutionPreferOrigin)
+				Ω(conflicts).Should(BeEmpty())
+				Ω(merged[snapshot.SectionClients]["laptop"]).Should(ContainSubstring(`"filtering_enabled":true`))
+
+				instances[1].Synced(merged, conflicts, instances[1].Managed)
+				Ω(instances[1].Base[snapshot.SectionClients]["laptop"]).Should(ContainSubstring(`"parental_enabled":true`))
+			})
+		})
+	})
+
+	Context("Observe", func() {
+		It("should keep the time an unchanged item was seen", func() {
+			s := &snapshot.MergeState{}
+			s.Observe(base, t0)
+			s.Observe(rewrites(types.RewriteEntry{Domain: "a", Answer: "1"}, types.RewriteEntry{Domain: "c", Answer: "3"}), t1)
+			Ω(s.Seen[snapshot.SectionRewrites]["a#1"]).Should(Equal(t0))
+			Ω(s.Seen[snapshot.SectionRewrites]["c#3"]).Should(Equal(t1))
+		})
+	})
+
+	Context("ApplyItems", func() {
+		It("should replace the items of the sections", func() {
+			re := types.RewriteEntries{{Domain: "x", Answer: "9"}}
+			s := &types.Snapshot{
+				Rewrites:  &re,
+				Filtering: &types.FilteringStatus{UserRules: types.UserRules{"||b^", "||a^", types.UserRulesLocalStart, "||local^", types.UserRulesLocalEnd}},
+			}
+			items := rewrites(types.RewriteEntry{Domain: "a", Answer: "1"})
+			items[snapshot.SectionUserRules] = map[string]string{"||a^": `"||a^"`, "||c^": `"||c^"`}
+			snapshot.ApplyItems(s, items)
+			Ω(*s.Rewrites).Should(Equal(types.RewriteEntries{{Domain: "a", Answer: "1"}}))
+			Ω(s.Filtering.UserRules).Should(Equal(types.UserRules{"||a^", "||c^", types.UserRulesLocalStart, "||local^", types.UserRulesLocalEnd}))
+		})
+	})
+})
@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FormatYAML yaml snapshot format
+	FormatYAML = "yaml"
+	// FormatJSON json snapshot format
+	FormatJSON = "json"
+)
+
+// FormatOf returns the format of a snapshot file by its extension
+func FormatOf(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// Marshal the snapshot in the given format
+func Marshal(s *types.Snapshot, format string) ([]byte, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	// convert via json to keep the field names of the json tags
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return encode(v, format)
+}
+
+func encode(v interface{}, format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(v, "", "  ")
+	case FormatYAML:
+		buf := &bytes.Buffer{}
+		enc := yaml.NewEncoder(buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), enc.Close()
+	}
+	return nil, fmt.Errorf("unsupported snapshot format %q", format)
+}
+
+// Unmarshal a snapshot in the given format, unknown fields are rejected
+func Unmarshal(data []byte, format string) (*types.Snapshot, error) {
+	switch format {
+	case FormatJSON:
+	case FormatYAML:
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported snapshot format %q", format)
+	}
+
+	s := &types.Snapshot{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load a snapshot file
+func Load(path string) (*types.Snapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Unmarshal(b, FormatOf(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot %q: %w", path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,78 @@
+package snapshot_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshot", func() {
+	var snap *types.Snapshot
+	BeforeEach(func() {
+		created := time.Date(2022, 10, 17, 8, 30, 0, 0, time.UTC)
+		snap = &types.Snapshot{
+			Version:            types.SnapshotVersion,
+			Created:            &created,
+			Source:             "https://origin",
+			AdGuardHomeVersion: "v0.107.0",
+			GeneralSettings:    &types.GeneralSettings{ProtectionEnabled: true, SafeSearch: true},
+			Rewrites:           &types.RewriteEntries{{Domain: "foo.bar", Answer: "1.2.3.4"}},
+			Services:           &types.Services{"youtube"},
+			StatsConfig:        &types.IntervalConfig{Interval: 7},
+		}
+	})
+	Context("FormatOf", func() {
+		It("should detect json files", func() {
+			Ω(snapshot.FormatOf("/tmp/snapshot.JSON")).Should(Equal(snapshot.FormatJSON))
+		})
+		It("should default to yaml", func() {
+			Ω(snapshot.FormatOf("/tmp/snapshot.yml")).Should(Equal(snapshot.FormatYAML))
+		})
+	})
+	Context("Marshal", func() {
+		It("should write yaml with the json field names", func() {
+			b, err := snapshot.Marshal(snap, snapshot.FormatYAML)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(b)).Should(ContainSubstring("adGuardHomeVersion: v0.107.0"))
+			Ω(string(b)).Should(ContainSubstring("- answer: 1.2.3.4"))
+		})
+		It("should fail with an unknown format", func() {
+			_, err := snapshot.Marshal(snap, "xml")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+	Context("Unmarshal", func() {
+		DescribeTable("should read a marshalled snapshot",
+			func(format string) {
+				b, err := snapshot.Marshal(snap, format)
+				Ω(err).ShouldNot(HaveOccurred())
+				s, err := snapshot.Unmarshal(b, format)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(s).Should(Equal(snap))
+			},
+			Entry("yaml", snapshot.FormatYAML),
+			Entry("json", snapshot.FormatJSON),
+		)
+		It("should fail on unknown fields", func() {
+			_, err := snapshot.Unmarshal([]byte("version: v1\nfoo: bar\n"), snapshot.FormatYAML)
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("foo"))
+		})
+	})
+	Context("Load", func() {
+		It("should read the snapshot file", func() {
+			b, err := snapshot.Marshal(snap, snapshot.FormatJSON)
+			Ω(err).ShouldNot(HaveOccurred())
+			file := filepath.Join(GinkgoT().TempDir(), "snapshot.json")
+			Ω(os.WriteFile(file, b, 0o600)).ShouldNot(HaveOccurred())
+			s, err := snapshot.Load(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(s).Should(Equal(snap))
+		})
+	})
+})
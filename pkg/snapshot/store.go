@@ -0,0 +1,116 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+const (
+	filePrefix = "snapshot-"
+	timeFormat = "20060102T150405.000Z"
+)
+
+// NewStore create a new snapshot store for the given backup config
+func NewStore(cfg types.Backup) *Store {
+	format := cfg.Format
+	if format == "" {
+		format = FormatYAML
+	}
+	return &Store{
+		dir:      cfg.Dir,
+		format:   format,
+		maxCount: cfg.MaxCount,
+		maxAge:   cfg.MaxAge,
+	}
+}
+
+// Store writes snapshots to a directory and removes the snapshots outside the retention
+type Store struct {
+	dir      string
+	format   string
+	maxCount int
+	maxAge   time.Duration
+}
+
+// Save the snapshot and apply the retention, returns the path of the written file
+func (s *Store) Save(snap *types.Snapshot) (string, error) {
+	if snap.Created == nil {
+		now := time.Now()
+		snap.Created = &now
+	}
+	b, err := Marshal(snap, s.format)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return "", err
+	}
+	name := filepath.Join(s.dir, fmt.Sprintf("%s%s.%s", filePrefix, snap.Created.UTC().Format(timeFormat), s.format))
+	if err := os.WriteFile(name, b, 0o600); err != nil {
+		return "", err
+	}
+	return name, s.prune(snap.Created.UTC())
+}
+
+// Files returns the paths of all snapshots in the store, the oldest first
+func (s *Store) Files() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), filePrefix) {
+			files = append(files, filepath.Join(s.dir, e.Name()))
+		}
+	}
+	// the timestamp in the file name allows sorting by name
+	sort.Strings(files)
+	return files, nil
+}
+
+// Latest loads the latest snapshot of the store, nil if the store has no snapshots
+func (s *Store) Latest() (*types.Snapshot, error) {
+	files, err := s.Files()
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return Load(files[len(files)-1])
+}
+
+func (s *Store) prune(now time.Time) error {
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		remaining := len(files) - i
+		if (s.maxCount > 0 && remaining > s.maxCount) || (s.maxAge > 0 && now.Sub(created(f)) > s.maxAge) {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// created parses the creation time from the file name
+func created(path string) time.Time {
+	name := strings.TrimPrefix(filepath.Base(path), filePrefix)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	t, err := time.Parse(timeFormat, name)
+	if err != nil {
+		// keep files with unknown timestamps
+		return time.Now()
+	}
+	return t
+}
@@ -0,0 +1,75 @@
+package snapshot_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		dir  string
+		base time.Time
+	)
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		base = time.Now().Truncate(time.Millisecond)
+	})
+	save := func(store *snapshot.Store, age time.Duration) string {
+		created := base.Add(-age)
+		file, err := store.Save(&types.Snapshot{Version: types.SnapshotVersion, Created: &created})
+		Ω(err).ShouldNot(HaveOccurred())
+		return file
+	}
+
+	It("should write timestamped files in the configured format", func() {
+		store := snapshot.NewStore(types.Backup{Dir: filepath.Join(dir, "backup"), Format: snapshot.FormatJSON})
+		file := save(store, 0)
+		Ω(filepath.Base(file)).Should(Equal("snapshot-" + base.UTC().Format("20060102T150405.000Z") + ".json"))
+		s, err := snapshot.Load(file)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.Created.Equal(base)).Should(BeTrue())
+	})
+	It("should default to yaml", func() {
+		file := save(snapshot.NewStore(types.Backup{Dir: dir}), 0)
+		Ω(filepath.Ext(file)).Should(Equal(".yaml"))
+	})
+	It("should keep the newest files up to the max count", func() {
+		store := snapshot.NewStore(types.Backup{Dir: dir, MaxCount: 2})
+		save(store, 3*time.Second)
+		second := save(store, 2*time.Second)
+		third := save(store, time.Second)
+		files, err := store.Files()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(Equal([]string{second, third}))
+	})
+	It("should remove the files older than the max age", func() {
+		store := snapshot.NewStore(types.Backup{Dir: dir, MaxAge: time.Hour})
+		save(store, 2*time.Hour)
+		recent := save(store, time.Minute)
+		latest := save(store, 0)
+		files, err := store.Files()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(Equal([]string{recent, latest}))
+	})
+	It("should load the latest snapshot", func() {
+		store := snapshot.NewStore(types.Backup{Dir: dir})
+		latest, err := store.Latest()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(latest).Should(BeNil())
+		save(store, time.Second)
+		save(store, 0)
+		latest, err = store.Latest()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(latest.Created.Equal(base)).Should(BeTrue())
+	})
+	It("should return no files for a missing directory", func() {
+		files, err := snapshot.NewStore(types.Backup{Dir: filepath.Join(dir, "missing")}).Files()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,91 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"go.uber.org/multierr"
+)
+
+// Validate checks the entries of the snapshot and that it contains the sections of all enabled features
+func Validate(s *types.Snapshot, f *types.Features) error {
+	v := &validator{}
+	if s.Version != "" && s.Version != types.SnapshotVersion {
+		v.fail("version", "unsupported version %q, expected %q", s.Version, types.SnapshotVersion)
+	}
+	if err := s.Validate(f); err != nil {
+		v.errs = append(v.errs, err)
+	}
+
+	if s.Rewrites != nil {
+		for i, re := range *s.Rewrites {
+			v.required(fmt.Sprintf("rewrites[%d].domain", i), re.Domain)
+			v.required(fmt.Sprintf("rewrites[%d].answer", i), re.Answer)
+		}
+	}
+	if s.Services != nil {
+		for i, svc := range *s.Services {
+			v.required(fmt.Sprintf("services[%d]", i), svc)
+		}
+	}
+	if s.Filtering != nil {
+		v.filters("filtering.filters", s.Filtering.Filters)
+		v.filters("filtering.whitelist_filters", s.Filtering.WhitelistFilters)
+	}
+	if s.Clients != nil {
+		names := make(map[string]bool)
+		for i, cl := range s.Clients.Clients {
+			path := fmt.Sprintf("clients.clients[%d]", i)
+			v.required(path+".name", cl.Name)
+			if cl.Name != "" && names[cl.Name] {
+				v.fail(path+".name", "duplicate client %q", cl.Name)
+			}
+			names[cl.Name] = true
+			if len(cl.Ids) == 0 {
+				v.fail(path+".ids", "must not be empty")
+			}
+		}
+	}
+	if s.DHCPServerConfig != nil {
+		macs := make(map[string]bool)
+		for i, le := range s.DHCPServerConfig.StaticLeases {
+			path := fmt.Sprintf("dhcpServerConfig.static_leases[%d]", i)
+			v.required(path+".mac", le.HWAddr)
+			if le.HWAddr != "" && macs[le.HWAddr] {
+				v.fail(path+".mac", "duplicate lease %q", le.HWAddr)
+			}
+			macs[le.HWAddr] = true
+			if le.IP == nil {
+				v.fail(path+".ip", "must not be empty")
+			}
+		}
+	}
+	return multierr.Combine(v.errs...)
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) fail(path string, format string, a ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, a...)))
+}
+
+func (v *validator) required(path string, value string) {
+	if value == "" {
+		v.fail(path, "must not be empty")
+	}
+}
+
+func (v *validator) filters(path string, filters types.Filters) {
+	urls := make(map[string]bool)
+	for i, f := range filters {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		v.required(p+".url", f.URL)
+		v.required(p+".name", f.Name)
+		if f.URL != "" && urls[f.URL] {
+			v.fail(p+".url", "duplicate filter %q", f.URL)
+		}
+		urls[f.URL] = true
+	}
+}
@@ -0,0 +1,69 @@
+package snapshot_test
+
+import (
+	"net"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/multierr"
+)
+
+var _ = Describe("Validate", func() {
+	var (
+		snap     *types.Snapshot
+		features *types.Features
+	)
+	BeforeEach(func() {
+		snap = &types.Snapshot{
+			Rewrites:  &types.RewriteEntries{{Domain: "foo.bar", Answer: "1.2.3.4"}},
+			Filtering: &types.FilteringStatus{Filters: types.Filters{{URL: "https://foo", Name: "foo"}}},
+			Clients:   &types.Clients{Clients: []types.Client{{Name: "foo", Ids: []string{"1.2.3.4"}}}},
+			DHCPServerConfig: &types.DHCPServerConfig{StaticLeases: types.Leases{
+				{HWAddr: "00:11:22:33:44:55", IP: net.ParseIP("1.2.3.4")},
+			}},
+		}
+		features = &types.Features{
+			DNS:            types.DNS{Rewrites: true},
+			DHCP:           types.DHCP{StaticLeases: true},
+			Filters:        true,
+			ClientSettings: true,
+		}
+	})
+	It("should accept a valid snapshot", func() {
+		Ω(snapshot.Validate(snap, features)).ShouldNot(HaveOccurred())
+	})
+	It("should reject an unknown version", func() {
+		snap.Version = "v0"
+		err := snapshot.Validate(snap, features)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("version: unsupported version"))
+	})
+	It("should reject a missing section of an enabled feature", func() {
+		features.Services = true
+		err := snapshot.Validate(snap, features)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("services"))
+	})
+	It("should report every invalid entry with its path", func() {
+		*snap.Rewrites = append(*snap.Rewrites, types.RewriteEntry{Domain: "foo.baz"})
+		snap.Filtering.WhitelistFilters = types.Filters{{URL: "https://foo"}, {URL: "https://foo", Name: "foo"}}
+		snap.Clients.Clients = append(snap.Clients.Clients, types.Client{Name: "foo"})
+		snap.DHCPServerConfig.StaticLeases = append(snap.DHCPServerConfig.StaticLeases, types.Lease{HWAddr: "00:11:22:33:44:66"})
+		err := snapshot.Validate(snap, features)
+		Ω(err).Should(HaveOccurred())
+		var msgs []string
+		for _, e := range multierr.Errors(err) {
+			msgs = append(msgs, e.Error())
+		}
+		Ω(msgs).Should(Equal([]string{
+			"rewrites[1].answer: must not be empty",
+			"filtering.whitelist_filters[0].name: must not be empty",
+			`filtering.whitelist_filters[1].url: duplicate filter "https://foo"`,
+			`clients.clients[1].name: duplicate client "foo"`,
+			"clients.clients[1].ids: must not be empty",
+			"dhcpServerConfig.static_leases[1].ip: must not be empty",
+		}))
+	})
+})
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backend a key value store with the values grouped in buckets
+type Backend interface {
+	// Get returns the value of the key, nil if it does not exist
+	Get(bucket string, key string) ([]byte, error)
+	// Put sets the value of the key
+	Put(bucket string, key string, value []byte) error
+	// Delete removes the key
+	Delete(bucket string, key string) error
+	// Keys returns the keys of the bucket, sorted ascending
+	Keys(bucket string) ([]string, error)
+	// Close releases the resources of the backend
+	Close() error
+}
+
+// NewMemoryBackend creates a backend that keeps the values in memory only
+func NewMemoryBackend() Backend {
+	return &memoryBackend{buckets: map[string]map[string][]byte{}}
+}
+
+type memoryBackend struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func (m *memoryBackend) Get(bucket string, key string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.buckets[bucket][key], nil
+}
+
+func (m *memoryBackend) Put(bucket string, key string, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = map[string][]byte{}
+	}
+	m.buckets[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *memoryBackend) Delete(bucket string, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memoryBackend) Keys(bucket string) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	for k := range m.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+// NewBoltBackend opens or creates the embedded key value file, fails if the file is locked by another process
+func NewBoltBackend(path string) (Backend, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func (b *boltBackend) Get(bucket string, key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket([]byte(bucket)); bk != nil {
+			// the value is only valid during the transaction
+			if v := bk.Get([]byte(key)); v != nil {
+				value = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltBackend) Put(bucket string, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bk.Put([]byte(key), value)
+	})
+}
+
+func (b *boltBackend) Delete(bucket string, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket([]byte(bucket)); bk != nil {
+			return bk.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+func (b *boltBackend) Keys(bucket string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket([]byte(bucket)); bk != nil {
+			return bk.ForEach(func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
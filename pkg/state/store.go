@@ -0,0 +1,155 @@
+package state
+
+import (
+	"encoding/json"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+const (
+	bucketRuns          = "runs"
+	bucketAppliedHashes = "appliedHashes"
+	bucketFingerprints  = "fingerprints"
+	bucketMergeStates   = "mergeStates"
+	bucketOrigin        = "origin"
+
+	keyLastOrigin = "last"
+	runTimeFormat = "20060102T150405.000000000Z"
+)
+
+// New creates the state store of the config, the state is kept in memory if no file is configured
+func New(cfg types.State) (*Store, error) {
+	if cfg.File == "" {
+		return NewMemoryStore(), nil
+	}
+	b, err := NewBoltBackend(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{backend: b}, nil
+}
+
+// NewMemoryStore creates a store that keeps the state in memory only
+func NewMemoryStore() *Store {
+	return &Store{backend: NewMemoryBackend()}
+}
+
+// Store persists the state of the sync: the sync runs, the origin hash applied to the replicas and their
+// fingerprints, the last known origin config and the multi-master states
+type Store struct {
+	backend Backend
+}
+
+// Close closes the backend
+func (s *Store) Close() error {
+	return s.backend.Close()
+}
+
+// SaveRun adds the run or replaces it, if it was already saved
+func (s *Store) SaveRun(run *types.Run) error {
+	return s.put(bucketRuns, runKey(run), run)
+}
+
+// Runs returns the saved runs, the oldest first
+func (s *Store) Runs() ([]*types.Run, error) {
+	keys, err := s.backend.Keys(bucketRuns)
+	if err != nil {
+		return nil, err
+	}
+	var runs []*types.Run
+	for _, k := range keys {
+		run := &types.Run{}
+		if ok, err := s.get(bucketRuns, k, run); err != nil {
+			return nil, err
+		} else if ok {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// PruneRuns removes all but the latest runs
+func (s *Store) PruneRuns(keep int) error {
+	keys, err := s.backend.Keys(bucketRuns)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(keys)-keep; i++ {
+		if err := s.backend.Delete(bucketRuns, keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runKey(run *types.Run) string {
+	// the start time makes the keys sortable, the id unique
+	return run.Start.UTC().Format(runTimeFormat) + "-" + run.ID
+}
+
+// AppliedHash returns the hash of the origin config last applied to the replica, empty if unknown
+func (s *Store) AppliedHash(replica string) (string, error) {
+	var hash string
+	_, err := s.get(bucketAppliedHashes, replica, &hash)
+	return hash, err
+}
+
+// SetAppliedHash sets the hash of the origin config applied to the replica
+func (s *Store) SetAppliedHash(replica string, hash string) error {
+	return s.put(bucketAppliedHashes, replica, hash)
+}
+
+// ReplicaFingerprint returns the fingerprint of the replica after the last sync, empty if unknown
+func (s *Store) ReplicaFingerprint(replica string) (string, error) {
+	var fingerprint string
+	_, err := s.get(bucketFingerprints, replica, &fingerprint)
+	return fingerprint, err
+}
+
+// SetReplicaFingerprint sets the fingerprint of the replica after the last sync
+func (s *Store) SetReplicaFingerprint(replica string, fingerprint string) error {
+	return s.put(bucketFingerprints, replica, fingerprint)
+}
+
+// LastOrigin returns the last known origin config, nil if unknown
+func (s *Store) LastOrigin() (*types.Snapshot, error) {
+	snap := &types.Snapshot{}
+	if ok, err := s.get(bucketOrigin, keyLastOrigin, snap); !ok || err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// SetLastOrigin sets the last known origin config
+func (s *Store) SetLastOrigin(snap *types.Snapshot) error {
+	return s.put(bucketOrigin, keyLastOrigin, snap)
+}
+
+// MergeState returns the multi-master state of the instance, an empty state if unknown
+func (s *Store) MergeState(instance string) (*snapshot.MergeState, error) {
+	state := &snapshot.MergeState{}
+	_, err := s.get(bucketMergeStates, instance, state)
+	return state, err
+}
+
+// SetMergeState sets the multi-master state of the instance
+func (s *Store) SetMergeState(instance string, state *snapshot.MergeState) error {
+	return s.put(bucketMergeStates, instance, state)
+}
+
+func (s *Store) get(bucket string, key string, v interface{}) (bool, error) {
+	b, err := s.backend.Get(bucket, key)
+	if err != nil || b == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+func (s *Store) put(bucket string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.backend.Put(bucket, key, b)
+}
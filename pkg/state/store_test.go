@@ -0,0 +1,96 @@
+package state_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/state"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		file  string
+		store *state.Store
+	)
+	BeforeEach(func() {
+		file = filepath.Join(GinkgoT().TempDir(), "state.db")
+	})
+	AfterEach(func() {
+		Ω(store.Close()).ShouldNot(HaveOccurred())
+	})
+
+	for name, cfg := range map[string]func() types.State{
+		"memory": func() types.State { return types.State{} },
+		"file":   func() types.State { return types.State{File: file} },
+	} {
+		cfg := cfg
+		Context(name, func() {
+			BeforeEach(func() {
+				var err error
+				store, err = state.New(cfg())
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+			It("should save and replace the runs", func() {
+				start := time.Now()
+				for i, id := range []string{"b", "a", "c"} {
+					Ω(store.SaveRun(&types.Run{ID: id, Start: start.Add(time.Duration(i) * time.Second), Result: types.ResultRunning})).
+						ShouldNot(HaveOccurred())
+				}
+				Ω(store.SaveRun(&types.Run{ID: "a", Start: start.Add(time.Second), Result: types.ResultSuccess})).ShouldNot(HaveOccurred())
+
+				runs, err := store.Runs()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(runs).Should(HaveLen(3))
+				Ω(runs[0].ID).Should(Equal("b"))
+				Ω(runs[1].ID).Should(Equal("a"))
+				Ω(runs[1].Result).Should(Equal(types.ResultSuccess))
+
+				Ω(store.PruneRuns(1)).ShouldNot(HaveOccurred())
+				runs, err = store.Runs()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(runs).Should(HaveLen(1))
+				Ω(runs[0].ID).Should(Equal("c"))
+			})
+			It("should save the applied hashes", func() {
+				hash, err := store.AppliedHash("https://replica")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(hash).Should(BeEmpty())
+				Ω(store.SetAppliedHash("https://replica", "abc")).ShouldNot(HaveOccurred())
+				Ω(store.AppliedHash("https://replica")).Should(Equal("abc"))
+			})
+			It("should save the last origin", func() {
+				Ω(store.LastOrigin()).Should(BeNil())
+				Ω(store.SetLastOrigin(&types.Snapshot{Source: "https://origin"})).ShouldNot(HaveOccurred())
+				last, err := store.LastOrigin()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(last.Source).Should(Equal("https://origin"))
+			})
+			It("should save the merge states", func() {
+				ms, err := store.MergeState("https://replica")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(ms.Base).Should(BeNil())
+				items := snapshot.ItemSet{snapshot.SectionRewrites: {"a#1": `{"domain":"a","answer":"1"}`}}
+				Ω(store.SetMergeState("https://replica", &snapshot.MergeState{Base: items})).ShouldNot(HaveOccurred())
+				ms, err = store.MergeState("https://replica")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(ms.Base).Should(Equal(items))
+			})
+		})
+	}
+
+	It("should keep the state of the file after closing", func() {
+		var err error
+		store, err = state.New(types.State{File: file})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(store.SetAppliedHash("https://replica", "abc")).ShouldNot(HaveOccurred())
+		Ω(store.Close()).ShouldNot(HaveOccurred())
+
+		store, err = state.New(types.State{File: file})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(store.AppliedHash("https://replica")).Should(Equal("abc"))
+	})
+})
@@ -10,13 +10,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/types"
 	"github.com/bakito/adguardhome-sync/version"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -27,8 +30,52 @@ var (
 )
 
 func (w *worker) handleSync(c *gin.Context) {
-	l.With("remote-addr", c.Request.RemoteAddr).Info("Starting sync from API")
-	w.sync()
+	opts := syncOptions{trigger: types.TriggerAPI}
+	if dr, ok := c.GetQuery("dryRun"); ok {
+		dryRun, err := strconv.ParseBool(dr)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid dryRun value %q", dr)
+			return
+		}
+		opts.dryRun = dryRun
+	}
+	if f, ok := c.GetQuery("force"); ok {
+		force, err := strconv.ParseBool(f)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid force value %q", f)
+			return
+		}
+		opts.force = force
+	}
+
+	l.With("remote_addr", c.Request.RemoteAddr, "dry_run", opts.dryRun, "force", opts.force).Info("Starting sync from API")
+	run := w.startRun(opts)
+	if run == nil {
+		c.String(http.StatusConflict, "sync already running")
+		return
+	}
+	if opts.dryRun {
+		w.execute(run, opts)
+		c.JSON(http.StatusOK, run)
+		return
+	}
+	go w.execute(run, opts)
+	c.JSON(http.StatusAccepted, map[string]string{"id": run.ID})
+}
+
+func (w *worker) handleStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, w.history())
+}
+
+func (w *worker) handleRunStatus(c *gin.Context) {
+	id := c.Param("id")
+	for _, run := range w.history() {
+		if run.ID == id {
+			c.JSON(http.StatusOK, run)
+			return
+		}
+	}
+	c.String(http.StatusNotFound, "run %q not found", id)
 }
 
 func (w *worker) handleRoot(c *gin.Context) {
@@ -45,6 +92,10 @@ func (w *worker) handleFavicon(c *gin.Context) {
 }
 
 func (w *worker) handleLogs(c *gin.Context) {
+	if c.Query("format") == log.FormatJSON {
+		c.JSON(http.StatusOK, log.Entries())
+		return
+	}
 	c.Data(http.StatusOK, "text/plain", []byte(strings.Join(log.Logs(), "")))
 }
 
@@ -56,8 +107,13 @@ func (w *worker) listenAndServe() {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(gin.Recovery())
+	// the webhook requests are signed and not protected by basic auth
+	if w.cfg.API.Webhook.Enabled() {
+		r.POST("/api/v1/webhook", w.handleWebhook)
+	}
+	api := r.Group("/")
 	if w.cfg.API.Username != "" && w.cfg.API.Password != "" {
-		r.Use(gin.BasicAuth(map[string]string{w.cfg.API.Username: w.cfg.API.Password}))
+		api.Use(gin.BasicAuth(map[string]string{w.cfg.API.Username: w.cfg.API.Password}))
 	}
 	httpServer := &http.Server{
 		Addr:        fmt.Sprintf(":%d", w.cfg.API.Port),
@@ -66,10 +122,13 @@ func (w *worker) listenAndServe() {
 	}
 
 	r.SetHTMLTemplate(template.Must(template.New("index.html").Parse(string(index))))
-	r.POST("/api/v1/sync", w.handleSync)
-	r.GET("/api/v1/logs", w.handleLogs)
-	r.GET("/favicon.ico", w.handleFavicon)
-	r.GET("/", w.handleRoot)
+	api.POST("/api/v1/sync", w.handleSync)
+	api.GET("/api/v1/logs", w.handleLogs)
+	api.GET("/api/v1/status", w.handleStatus)
+	api.GET("/api/v1/status/:id", w.handleRunStatus)
+	api.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	api.GET("/favicon.ico", w.handleFavicon)
+	api.GET("/", w.handleRoot)
 
 	go func() {
 		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
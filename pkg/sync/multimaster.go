@@ -0,0 +1,190 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/metrics"
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"go.uber.org/zap"
+)
+
+// syncMultiMaster merges the changes of the origin and the enforced replicas since their last sync and syncs
+// the merged config to all of them. Replicas in detect mode only get the differences to the merged config.
+func (w *worker) syncMultiMaster(sl *zap.SugaredLogger, run *types.Run, o *origin, opts syncOptions) {
+	oi := w.cfg.Origin
+	for _, c := range w.cfg.OriginCandidates() {
+		if c.URL == run.Origin {
+			oi = c
+		}
+	}
+
+	masters := []types.AdGuardInstance{oi}
+	configs := []*origin{o}
+	var followers []types.AdGuardInstance
+	var unavailable []*types.ReplicaResult
+	for _, r := range w.cfg.UniqueReplicas() {
+		if r.URL == oi.URL {
+			continue
+		}
+		if r.Mode == types.ModeDetect {
+			followers = append(followers, r)
+			continue
+		}
+		rc, err := w.createClient(r)
+		if err == nil {
+			rl := l.With("replica", r.URL, "to", rc.Host(), "run_id", run.ID)
+			useLogger(rc, rl)
+			var ro *origin
+			if ro, err = w.fetchOrigin(rl, rc, r, metrics.RoleReplica); err == nil {
+				masters = append(masters, r)
+				configs = append(configs, ro)
+				continue
+			}
+		}
+		// the local changes of the replica would be lost by syncing the merged config
+		sl.With("error", err, "replica", r.URL).Error("Error reading replica, it is not synced")
+		unavailable = append(unavailable, &types.ReplicaResult{
+			Replica: r.URL,
+			Mode:    r.Mode,
+			Result:  types.ResultFailed,
+			Error:   fmt.Sprintf("error reading replica: %v", err),
+		})
+	}
+
+	now := time.Now()
+	features := w.cfg.AnyFeatures()
+	instances := make([]snapshot.MergeInstance, len(masters))
+	for i, m := range masters {
+		ms := w.mergeState(sl, m.URL)
+		ms.Observe(snapshot.ItemsOf(configs[i].snapshot(m.URL), &features), now)
+		if !opts.dryRun {
+			w.saveMergeState(sl, m.URL, ms)
+		}
+		// the item rules were validated when creating the worker
+		managed, _ := managedItems(w.cfg.ReplicaItems(m))
+		instances[i] = snapshot.MergeInstance{Name: m.URL, MergeState: ms, Managed: managed}
+	}
+
+	merged, conflicts := snapshot.ThreeWay(instances, w.cfg.MultiMaster.Resolution)
+	run.Conflicts = conflicts
+	for _, c := range conflicts {
+		cl := sl.With("section", c.Section, "key", c.Key, "resolution", c.Resolution)
+		if c.Winner == "" {
+			cl.Warn("Conflict not resolved, the item is not synced")
+		} else {
+			cl.With("winner", c.Winner).Info("Conflict resolved")
+		}
+	}
+
+	s := o.snapshot(oi.URL)
+	snapshot.ApplyItems(s, merged)
+	mo := originFromSnapshot(s)
+	mo.status = o.clone().status
+
+	w.withExcludes(conflicts).syncReplicas(sl, run, mo, append(masters, followers...), opts)
+
+	if !opts.dryRun {
+		for i := range masters {
+			if run.Replicas[i].Result == types.ResultSuccess {
+				instances[i].Synced(merged, conflicts, instances[i].Managed)
+				w.saveMergeState(sl, masters[i].URL, instances[i].MergeState)
+			}
+		}
+	}
+	run.Replicas = append(run.Replicas, unavailable...)
+}
+
+// mergeState returns the multi-master state of the instance
+func (w *worker) mergeState(sl *zap.SugaredLogger, url string) *snapshot.MergeState {
+	ms, err := w.state.MergeState(url)
+	if err != nil {
+		sl.With("error", err, "instance", url).Error("Error reading the multi-master state, the instance is merged as never synced")
+		return &snapshot.MergeState{}
+	}
+	return ms
+}
+
+// saveMergeState saves the multi-master state of the instance
+func (w *worker) saveMergeState(sl *zap.SugaredLogger, url string, ms *snapshot.MergeState) {
+	if err := w.state.SetMergeState(url, ms); err != nil {
+		sl.With("error", err, "instance", url).Error("Error saving the multi-master state")
+	}
+}
+
+// withExcludes returns a worker that does not sync the items of the unresolved conflicts
+func (w *worker) withExcludes(conflicts []types.Conflict) *worker {
+	cfg := *w.cfg
+	cfg.Items = w.cfg.Items.Merge(&types.Items{})
+	for _, c := range conflicts {
+		if c.Winner != "" {
+			continue
+		}
+		pattern := "/^" + regexp.QuoteMeta(c.Key) + "$/"
+		switch c.Section {
+		case snapshot.SectionRewrites:
+			// the rewrites are matched by domain
+			domain, _, _ := strings.Cut(c.Key, "#")
+			cfg.Items.Rewrites.Exclude = append(cfg.Items.Rewrites.Exclude, "/^"+regexp.QuoteMeta(domain)+"$/")
+		case snapshot.SectionClients:
+			cfg.Items.Clients.Exclude = append(cfg.Items.Clients.Exclude, pattern)
+		case snapshot.SectionFilters, snapshot.SectionWhitelistFilters:
+			cfg.Items.Filters.Exclude = append(cfg.Items.Filters.Exclude, pattern)
+		case snapshot.SectionStaticLeases:
+			cfg.Items.StaticLeases.Exclude = append(cfg.Items.StaticLeases.Exclude, pattern)
+		}
+	}
+	return &worker{cfg: &cfg, createClient: w.createClient, state: w.state}
+}
+
+// managedItems returns the decision which items are synced by the item rules, nil if all items are synced
+func managedItems(items types.Items) (snapshot.Managed, error) {
+	matchers := map[string]*types.ItemMatcher{}
+	for section, rules := range map[string]types.ItemRules{
+		snapshot.SectionRewrites:         items.Rewrites,
+		snapshot.SectionClients:          items.Clients,
+		snapshot.SectionFilters:          items.Filters,
+		snapshot.SectionWhitelistFilters: items.Filters,
+		snapshot.SectionStaticLeases:     items.StaticLeases,
+	} {
+		m, err := rules.Matcher()
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			matchers[section] = m
+		}
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+	return func(section string, value string) bool {
+		m, ok := matchers[section]
+		if !ok {
+			return true
+		}
+		switch section {
+		case snapshot.SectionRewrites:
+			var re types.RewriteEntry
+			_ = json.Unmarshal([]byte(value), &re)
+			return m.Managed(re.Domain)
+		case snapshot.SectionClients:
+			var cl types.Client
+			_ = json.Unmarshal([]byte(value), &cl)
+			return m.Managed(append([]string{cl.Name}, cl.Tags...)...)
+		case snapshot.SectionFilters, snapshot.SectionWhitelistFilters:
+			var f types.Filter
+			_ = json.Unmarshal([]byte(value), &f)
+			return m.Managed(f.URL, f.Name)
+		case snapshot.SectionStaticLeases:
+			var le types.Lease
+			_ = json.Unmarshal([]byte(value), &le)
+			return m.Managed(le.HWAddr, le.Hostname)
+		}
+		return true
+	}, nil
+}
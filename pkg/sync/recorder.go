@@ -0,0 +1,561 @@
+package sync
+
+import (
+	"github.com/bakito/adguardhome-sync/pkg/client"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+// recorder wraps a replica client and records every change done on the replica.
+// In dry-run mode the changes are only recorded and not applied.
+// The items of a batch are applied one by one, so the items applied before a failed item are recorded.
+type recorder struct {
+	client.Client
+	dryRun  bool
+	changes []types.Change
+	// undo reverts the change with the same index, nil if the change can not be reverted
+	undo []func() error
+	// planning queues the writes instead of applying them, until they are applied by their plannedStep
+	planning bool
+	planned  []func() error
+
+	// replica config before the sync, used to resolve the values before a change. The sections are set from the
+	// snapshot read before the sync, or by their first read if the snapshot could not be read.
+	status           *types.Status
+	rewrites         *types.RewriteEntries
+	filtering        *types.FilteringStatus
+	parental         *bool
+	safeSearch       *bool
+	safeBrowsing     *bool
+	services         types.Services
+	clients          *types.Clients
+	queryLogConfig   *types.QueryLogConfig
+	statsConfig      *types.IntervalConfig
+	accessList       *types.AccessList
+	dnsConfig        *types.DNSConfig
+	dhcpServerConfig *types.DHCPServerConfig
+}
+
+func newRecorder(cl client.Client, dryRun bool) *recorder {
+	return &recorder{Client: cl, dryRun: dryRun}
+}
+
+// useSnapshot serves the reads of the sync from the config read before the sync, which is also the config the values
+// before the changes are resolved from
+func (r *recorder) useSnapshot(config *types.Snapshot) {
+	sc := &snapshotClient{Client: r.Client, snapshot: config}
+	r.Client = sc
+	if gs := config.GeneralSettings; gs != nil {
+		parental, safeSearch, safeBrowsing := gs.Parental, gs.SafeSearch, gs.SafeBrowsing
+		r.parental, r.safeSearch, r.safeBrowsing = &parental, &safeSearch, &safeBrowsing
+	}
+	if config.QueryLogConfig != nil {
+		r.queryLogConfig, _ = sc.QueryLogConfig()
+	}
+	if config.StatsConfig != nil {
+		r.statsConfig, _ = sc.StatsConfig()
+	}
+	if config.Rewrites != nil {
+		r.rewrites, _ = sc.RewriteList()
+	}
+	if config.Filtering != nil {
+		r.filtering, _ = sc.Filtering()
+	}
+	if config.Services != nil {
+		r.services, _ = sc.Services()
+	}
+	if config.Clients != nil {
+		r.clients, _ = sc.Clients()
+	}
+	if config.AccessList != nil {
+		r.accessList, _ = sc.AccessList()
+	}
+	if config.DNSConfig != nil {
+		r.dnsConfig, _ = sc.DNSConfig()
+	}
+	if config.DHCPServerConfig != nil {
+		r.dhcpServerConfig, _ = sc.DHCPServerConfig()
+	}
+}
+
+func (r *recorder) record(feature string, action types.Action, key string, before interface{}, after interface{}, undo func() error) {
+	r.changes = append(r.changes, types.Change{
+		Feature: feature,
+		Action:  action,
+		Key:     key,
+		Before:  before,
+		After:   after,
+	})
+	r.undo = append(r.undo, undo)
+}
+
+// rollback reverts the changes applied since the change with the index in reverse order, the replica is updated
+// directly without recording
+func (r *recorder) rollback(from int) *types.Rollback {
+	if r.dryRun || len(r.changes) <= from {
+		return nil
+	}
+	rb := &types.Rollback{}
+	for i := len(r.changes) - 1; i >= from; i-- {
+		c := r.changes[i]
+		if r.undo[i] == nil {
+			rb.Failed = append(rb.Failed, types.RollbackFailure{Change: c, Error: "the value before the change is unknown"})
+		} else if err := r.undo[i](); err != nil {
+			rb.Failed = append(rb.Failed, types.RollbackFailure{Change: c, Error: err.Error()})
+		} else {
+			rb.Reverted = append(rb.Reverted, c)
+		}
+	}
+	return rb
+}
+
+// do applies the write on the replica if not in dry-run mode and records its changes, while planning the write is queued
+func (r *recorder) do(apply func() error, record func()) error {
+	write := func() error {
+		if !r.dryRun {
+			if err := apply(); err != nil {
+				return err
+			}
+		}
+		if record != nil {
+			record()
+		}
+		return nil
+	}
+	if r.planning {
+		r.planned = append(r.planned, write)
+		return nil
+	}
+	return write()
+}
+
+// takePlanned returns the writes queued since the last call
+func (r *recorder) takePlanned() []func() error {
+	planned := r.planned
+	r.planned = nil
+	return planned
+}
+
+func (r *recorder) Status() (*types.Status, error) {
+	s, err := r.Client.Status()
+	if err == nil && r.status == nil {
+		r.status = s
+	}
+	return s, err
+}
+
+func (r *recorder) ToggleProtection(enable bool) error {
+	return r.do(func() error { return r.Client.ToggleProtection(enable) }, func() {
+		var before interface{}
+		var undo func() error
+		if r.status != nil {
+			before = r.status.ProtectionEnabled
+			enabled := r.status.ProtectionEnabled
+			undo = func() error { return r.Client.ToggleProtection(enabled) }
+		}
+		r.record(types.FeatureGeneralSettings, types.ActionUpdate, "protection", before, enable, undo)
+	})
+}
+
+func (r *recorder) RewriteList() (*types.RewriteEntries, error) {
+	re, err := r.Client.RewriteList()
+	if err == nil && r.rewrites == nil {
+		r.rewrites = re
+	}
+	return re, err
+}
+
+func (r *recorder) AddRewriteEntries(e ...types.RewriteEntry) error {
+	for i := range e {
+		entry := e[i]
+		if err := r.do(func() error { return r.Client.AddRewriteEntries(entry) }, func() {
+			r.record(types.FeatureDNSRewrites, types.ActionAdd, entry.Key(), nil, entry,
+				func() error { return r.Client.DeleteRewriteEntries(entry) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) DeleteRewriteEntries(e ...types.RewriteEntry) error {
+	for i := range e {
+		entry := e[i]
+		if err := r.do(func() error { return r.Client.DeleteRewriteEntries(entry) }, func() {
+			r.record(types.FeatureDNSRewrites, types.ActionDelete, entry.Key(), entry, nil,
+				func() error { return r.Client.AddRewriteEntries(entry) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) Filtering() (*types.FilteringStatus, error) {
+	f, err := r.Client.Filtering()
+	if err == nil && r.filtering == nil {
+		r.filtering = f
+	}
+	return f, err
+}
+
+func (r *recorder) ToggleFiltering(enabled bool, interval float64) error {
+	return r.do(func() error { return r.Client.ToggleFiltering(enabled, interval) }, func() {
+		var before interface{}
+		var undo func() error
+		if r.filtering != nil {
+			before = r.filtering.FilteringConfig
+			fc := r.filtering.FilteringConfig
+			undo = func() error { return r.Client.ToggleFiltering(fc.Enabled, fc.Interval) }
+		}
+		r.record(types.FeatureFilters, types.ActionUpdate, "config", before, types.FilteringConfig{
+			EnableConfig:   types.EnableConfig{Enabled: enabled},
+			IntervalConfig: types.IntervalConfig{Interval: interval},
+		}, undo)
+	})
+}
+
+func (r *recorder) AddFilters(whitelist bool, e ...types.Filter) error {
+	for i := range e {
+		f := e[i]
+		if err := r.do(func() error { return r.Client.AddFilters(whitelist, f) }, func() {
+			r.record(types.FeatureFilters, types.ActionAdd, f.URL, nil, f,
+				func() error { return r.Client.DeleteFilters(whitelist, f) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) DeleteFilters(whitelist bool, e ...types.Filter) error {
+	for i := range e {
+		f := e[i]
+		if err := r.do(func() error { return r.Client.DeleteFilters(whitelist, f) }, func() {
+			r.record(types.FeatureFilters, types.ActionDelete, f.URL, f, nil,
+				func() error { return r.Client.AddFilters(whitelist, f) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) UpdateFilters(whitelist bool, e ...types.Filter) error {
+	for i := range e {
+		f := e[i]
+		if err := r.do(func() error { return r.Client.UpdateFilters(whitelist, f) }, func() {
+			var before interface{}
+			var undo func() error
+			if prev := r.filter(whitelist, f.URL); prev != nil {
+				before = *prev
+				undo = func() error { return r.Client.UpdateFilters(whitelist, *prev) }
+			}
+			r.record(types.FeatureFilters, types.ActionUpdate, f.URL, before, f, undo)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) filter(whitelist bool, url string) *types.Filter {
+	if r.filtering == nil {
+		return nil
+	}
+	filters := r.filtering.Filters
+	if whitelist {
+		filters = r.filtering.WhitelistFilters
+	}
+	for i := range filters {
+		if filters[i].URL == url {
+			return &filters[i]
+		}
+	}
+	return nil
+}
+
+func (r *recorder) RefreshFilters(whitelist bool) error {
+	return r.do(func() error { return r.Client.RefreshFilters(whitelist) }, nil)
+}
+
+func (r *recorder) SetCustomRules(rules types.UserRules) error {
+	return r.do(func() error { return r.Client.SetCustomRules(rules) }, func() {
+		var before interface{}
+		var undo func() error
+		if r.filtering != nil {
+			before = r.filtering.UserRules
+			ur := r.filtering.UserRules
+			undo = func() error { return r.Client.SetCustomRules(ur) }
+		}
+		r.record(types.FeatureFilters, types.ActionUpdate, "userRules", before, rules, undo)
+	})
+}
+
+func (r *recorder) SafeBrowsing() (bool, error) {
+	v, err := r.Client.SafeBrowsing()
+	if err == nil && r.safeBrowsing == nil {
+		r.safeBrowsing = &v
+	}
+	return v, err
+}
+
+func (r *recorder) ToggleSafeBrowsing(enable bool) error {
+	return r.do(func() error { return r.Client.ToggleSafeBrowsing(enable) }, func() {
+		var undo func() error
+		if r.safeBrowsing != nil {
+			enabled := *r.safeBrowsing
+			undo = func() error { return r.Client.ToggleSafeBrowsing(enabled) }
+		}
+		r.record(types.FeatureGeneralSettings, types.ActionUpdate, "safeBrowsing", boolValue(r.safeBrowsing), enable, undo)
+	})
+}
+
+func (r *recorder) Parental() (bool, error) {
+	v, err := r.Client.Parental()
+	if err == nil && r.parental == nil {
+		r.parental = &v
+	}
+	return v, err
+}
+
+func (r *recorder) ToggleParental(enable bool) error {
+	return r.do(func() error { return r.Client.ToggleParental(enable) }, func() {
+		var undo func() error
+		if r.parental != nil {
+			enabled := *r.parental
+			undo = func() error { return r.Client.ToggleParental(enabled) }
+		}
+		r.record(types.FeatureGeneralSettings, types.ActionUpdate, "parental", boolValue(r.parental), enable, undo)
+	})
+}
+
+func (r *recorder) SafeSearch() (bool, error) {
+	v, err := r.Client.SafeSearch()
+	if err == nil && r.safeSearch == nil {
+		r.safeSearch = &v
+	}
+	return v, err
+}
+
+func (r *recorder) ToggleSafeSearch(enable bool) error {
+	return r.do(func() error { return r.Client.ToggleSafeSearch(enable) }, func() {
+		var undo func() error
+		if r.safeSearch != nil {
+			enabled := *r.safeSearch
+			undo = func() error { return r.Client.ToggleSafeSearch(enabled) }
+		}
+		r.record(types.FeatureGeneralSettings, types.ActionUpdate, "safeSearch", boolValue(r.safeSearch), enable, undo)
+	})
+}
+
+func (r *recorder) Services() (types.Services, error) {
+	s, err := r.Client.Services()
+	if err == nil && r.services == nil {
+		r.services = s
+	}
+	return s, err
+}
+
+func (r *recorder) SetServices(services types.Services) error {
+	return r.do(func() error { return r.Client.SetServices(services) }, func() {
+		var undo func() error
+		if r.services != nil {
+			s := r.services
+			undo = func() error { return r.Client.SetServices(s) }
+		}
+		r.record(types.FeatureServices, types.ActionUpdate, "", r.services, services, undo)
+	})
+}
+
+func (r *recorder) Clients() (*types.Clients, error) {
+	c, err := r.Client.Clients()
+	if err == nil && r.clients == nil {
+		r.clients = c
+	}
+	return c, err
+}
+
+func (r *recorder) AddClients(cl ...types.Client) error {
+	for i := range cl {
+		c := cl[i]
+		if err := r.do(func() error { return r.Client.AddClients(c) }, func() {
+			r.record(types.FeatureClientSettings, types.ActionAdd, c.Name, nil, c,
+				func() error { return r.Client.DeleteClients(c) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) UpdateClients(cl ...types.Client) error {
+	for i := range cl {
+		c := cl[i]
+		if err := r.do(func() error { return r.Client.UpdateClients(c) }, func() {
+			var before interface{}
+			var undo func() error
+			if r.clients != nil {
+				for _, rc := range r.clients.Clients {
+					if rc.Name == c.Name {
+						before = rc
+						prev := rc
+						undo = func() error { return r.Client.UpdateClients(prev) }
+					}
+				}
+			}
+			r.record(types.FeatureClientSettings, types.ActionUpdate, c.Name, before, c, undo)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) DeleteClients(cl ...types.Client) error {
+	for i := range cl {
+		c := cl[i]
+		if err := r.do(func() error { return r.Client.DeleteClients(c) }, func() {
+			r.record(types.FeatureClientSettings, types.ActionDelete, c.Name, c, nil,
+				func() error { return r.Client.AddClients(c) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) QueryLogConfig() (*types.QueryLogConfig, error) {
+	qlc, err := r.Client.QueryLogConfig()
+	if err == nil && r.queryLogConfig == nil {
+		r.queryLogConfig = qlc
+	}
+	return qlc, err
+}
+
+func (r *recorder) SetQueryLogConfig(enabled bool, interval float64, anonymizeClientIP bool) error {
+	return r.do(func() error { return r.Client.SetQueryLogConfig(enabled, interval, anonymizeClientIP) }, func() {
+		var undo func() error
+		if r.queryLogConfig != nil {
+			qlc := *r.queryLogConfig
+			undo = func() error { return r.Client.SetQueryLogConfig(qlc.Enabled, qlc.Interval, qlc.AnonymizeClientIP) }
+		}
+		r.record(types.FeatureQueryLogConfig, types.ActionUpdate, "", r.queryLogConfig, &types.QueryLogConfig{
+			EnableConfig:      types.EnableConfig{Enabled: enabled},
+			IntervalConfig:    types.IntervalConfig{Interval: interval},
+			AnonymizeClientIP: anonymizeClientIP,
+		}, undo)
+	})
+}
+
+func (r *recorder) StatsConfig() (*types.IntervalConfig, error) {
+	sc, err := r.Client.StatsConfig()
+	if err == nil && r.statsConfig == nil {
+		r.statsConfig = sc
+	}
+	return sc, err
+}
+
+func (r *recorder) SetStatsConfig(interval float64) error {
+	return r.do(func() error { return r.Client.SetStatsConfig(interval) }, func() {
+		var undo func() error
+		if r.statsConfig != nil {
+			sc := *r.statsConfig
+			undo = func() error { return r.Client.SetStatsConfig(sc.Interval) }
+		}
+		r.record(types.FeatureStatsConfig, types.ActionUpdate, "", r.statsConfig, &types.IntervalConfig{Interval: interval}, undo)
+	})
+}
+
+func (r *recorder) Setup() error {
+	return r.do(r.Client.Setup, nil)
+}
+
+func (r *recorder) AccessList() (*types.AccessList, error) {
+	al, err := r.Client.AccessList()
+	if err == nil && r.accessList == nil {
+		r.accessList = al
+	}
+	return al, err
+}
+
+func (r *recorder) SetAccessList(list *types.AccessList) error {
+	return r.do(func() error { return r.Client.SetAccessList(list) }, func() {
+		var undo func() error
+		if r.accessList != nil {
+			prev := r.accessList
+			undo = func() error { return r.Client.SetAccessList(prev) }
+		}
+		r.record(types.FeatureDNSAccessLists, types.ActionUpdate, "", r.accessList, list, undo)
+	})
+}
+
+func (r *recorder) DNSConfig() (*types.DNSConfig, error) {
+	dc, err := r.Client.DNSConfig()
+	if err == nil && r.dnsConfig == nil {
+		r.dnsConfig = dc
+	}
+	return dc, err
+}
+
+func (r *recorder) SetDNSConfig(config *types.DNSConfig) error {
+	return r.do(func() error { return r.Client.SetDNSConfig(config) }, func() {
+		var undo func() error
+		if r.dnsConfig != nil {
+			prev := r.dnsConfig
+			undo = func() error { return r.Client.SetDNSConfig(prev) }
+		}
+		r.record(types.FeatureDNSServerConfig, types.ActionUpdate, "", r.dnsConfig, config, undo)
+	})
+}
+
+func (r *recorder) DHCPServerConfig() (*types.DHCPServerConfig, error) {
+	sc, err := r.Client.DHCPServerConfig()
+	if err == nil && r.dhcpServerConfig == nil {
+		r.dhcpServerConfig = sc
+	}
+	return sc, err
+}
+
+func (r *recorder) SetDHCPServerConfig(config *types.DHCPServerConfig) error {
+	return r.do(func() error { return r.Client.SetDHCPServerConfig(config) }, func() {
+		var undo func() error
+		if r.dhcpServerConfig != nil {
+			prev := r.dhcpServerConfig
+			undo = func() error { return r.Client.SetDHCPServerConfig(prev) }
+		}
+		r.record(types.FeatureDHCPServerConfig, types.ActionUpdate, "", r.dhcpServerConfig, config, undo)
+	})
+}
+
+func (r *recorder) AddDHCPStaticLeases(leases ...types.Lease) error {
+	for i := range leases {
+		lease := leases[i]
+		if err := r.do(func() error { return r.Client.AddDHCPStaticLeases(lease) }, func() {
+			r.record(types.FeatureDHCPStaticLeases, types.ActionAdd, lease.HWAddr, nil, lease,
+				func() error { return r.Client.DeleteDHCPStaticLeases(lease) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) DeleteDHCPStaticLeases(leases ...types.Lease) error {
+	for i := range leases {
+		lease := leases[i]
+		if err := r.do(func() error { return r.Client.DeleteDHCPStaticLeases(lease) }, func() {
+			r.record(types.FeatureDHCPStaticLeases, types.ActionDelete, lease.HWAddr, lease, nil,
+				func() error { return r.Client.AddDHCPStaticLeases(lease) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boolValue(b *bool) interface{} {
+	if b == nil {
+		return nil
+	}
+	return *b
+}
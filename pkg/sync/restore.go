@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"fmt"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/state"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+const (
+	// TargetOrigin restore target selecting the origin instance
+	TargetOrigin = "origin"
+	// TargetReplicas restore target selecting all replica instances
+	TargetReplicas = "replicas"
+)
+
+// Restore applies the snapshot to the target instances. A target is either "origin", "replicas" or the url of a replica
+func Restore(cfg *types.Config, snap *types.Snapshot, source string, dryRun bool, targets ...string) (*types.Run, error) {
+	instances, err := restoreTargets(cfg, targets)
+	if err != nil {
+		return nil, err
+	}
+	features := cfg.AnyFeatures()
+	if err := snapshot.Validate(snap, &features); err != nil {
+		return nil, err
+	}
+	logDisabledFeatures(cfg)
+
+	w := &worker{
+		cfg:          cfg,
+		createClient: newClient,
+		state:        state.NewMemoryStore(),
+	}
+	return w.restore(originFromSnapshot(snap), source, instances, syncOptions{trigger: types.TriggerCLI, dryRun: dryRun}), nil
+}
+
+func (w *worker) restore(o *origin, source string, instances []types.AdGuardInstance, opts syncOptions) *types.Run {
+	run := w.startRun(opts)
+	if run == nil {
+		return nil
+	}
+	run.Origin = source
+	defer w.finishRun(run)
+
+	w.syncReplicas(l.With("from", source, "run_id", run.ID), run, o, instances, opts)
+	return run
+}
+
+// restoreTargets resolves the target names to the configured instances
+func restoreTargets(cfg *types.Config, targets []string) ([]types.AdGuardInstance, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no restore target defined")
+	}
+	replicas := cfg.UniqueReplicas()
+
+	var instances []types.AdGuardInstance
+	selected := make(map[string]bool)
+	add := func(ai types.AdGuardInstance) {
+		if !selected[ai.Key()] {
+			selected[ai.Key()] = true
+			instances = append(instances, ai)
+		}
+	}
+
+	for _, t := range targets {
+		switch t {
+		case TargetOrigin:
+			// the origin with the highest priority is restored
+			candidates := cfg.OriginCandidates()
+			if len(candidates) == 0 || candidates[0].URL == "" {
+				return nil, fmt.Errorf("origin URL is required")
+			}
+			add(candidates[0])
+		case TargetReplicas:
+			if len(replicas) == 0 {
+				return nil, fmt.Errorf("no replicas configured")
+			}
+			for _, r := range replicas {
+				add(r)
+			}
+		default:
+			var found bool
+			for _, r := range replicas {
+				if r.URL == t {
+					add(r)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown restore target %q", t)
+			}
+		}
+	}
+	return instances, nil
+}
@@ -0,0 +1,274 @@
+package sync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/client"
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/state"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"github.com/google/uuid"
+)
+
+// Export reads the config of the first available origin instance as snapshot
+func Export(cfg *types.Config) (*types.Snapshot, error) {
+	if cfg.Origin.URL == "" && len(cfg.Origins) == 0 {
+		return nil, fmt.Errorf("origin URL is required")
+	}
+	w := &worker{cfg: cfg, createClient: newClient, state: state.NewMemoryStore()}
+	return w.export()
+}
+
+func (w *worker) export() (*types.Snapshot, error) {
+	run := &types.Run{ID: uuid.NewString(), Trigger: types.TriggerCLI}
+	o, _, err := w.selectOrigin(run)
+	if err != nil {
+		return nil, err
+	}
+	return o.snapshot(run.Origin), nil
+}
+
+// snapshot creates a snapshot of the origin configuration
+func (o *origin) snapshot(source string) *types.Snapshot {
+	c := o.clone()
+	now := time.Now()
+	s := &types.Snapshot{
+		Version: types.SnapshotVersion,
+		Created: &now,
+		Source:  source,
+		GeneralSettings: &types.GeneralSettings{
+			Parental:     c.parental,
+			SafeSearch:   c.safeSearch,
+			SafeBrowsing: c.safeBrowsing,
+		},
+		QueryLogConfig:   c.queryLogConfig,
+		StatsConfig:      c.statsConfig,
+		Rewrites:         c.rewrites,
+		Filtering:        c.filters,
+		Clients:          c.clients,
+		AccessList:       c.accessList,
+		DNSConfig:        c.dnsConfig,
+		DHCPServerConfig: c.dhcpServerConfig,
+	}
+	if c.services != nil {
+		s.Services = &c.services
+	}
+	if c.status != nil {
+		s.AdGuardHomeVersion = c.status.Version
+		s.GeneralSettings.ProtectionEnabled = c.status.ProtectionEnabled
+	}
+	return s
+}
+
+// originFromSnapshot creates an origin from a snapshot
+func originFromSnapshot(s *types.Snapshot) *origin {
+	o := &origin{
+		status:           &types.Status{Version: s.AdGuardHomeVersion},
+		rewrites:         s.Rewrites,
+		filters:          s.Filtering,
+		clients:          s.Clients,
+		queryLogConfig:   s.QueryLogConfig,
+		statsConfig:      s.StatsConfig,
+		accessList:       s.AccessList,
+		dnsConfig:        s.DNSConfig,
+		dhcpServerConfig: s.DHCPServerConfig,
+	}
+	if s.Services != nil {
+		o.services = *s.Services
+	}
+	if s.GeneralSettings != nil {
+		o.status.ProtectionEnabled = s.GeneralSettings.ProtectionEnabled
+		o.parental = s.GeneralSettings.Parental
+		o.safeSearch = s.GeneralSettings.SafeSearch
+		o.safeBrowsing = s.GeneralSettings.SafeBrowsing
+	}
+	return o.clone()
+}
+
+// backup writes a snapshot of the origin to the backup store
+func (w *worker) backup(o *origin, source string) {
+	if !w.cfg.Backup.Enabled() {
+		return
+	}
+	file, err := snapshot.NewStore(w.cfg.Backup).Save(o.snapshot(source))
+	if err != nil {
+		l.With("error", err, "dir", w.cfg.Backup.Dir).Error("Error writing origin snapshot")
+		return
+	}
+	l.With("file", file).Info("Origin snapshot written")
+}
+
+// readSnapshot reads the config of the enabled features of an instance, the sections of the disabled features are nil
+func readSnapshot(cl client.Client, rs *types.Status, f types.Features) (*types.Snapshot, error) {
+	s := &types.Snapshot{Version: types.SnapshotVersion, AdGuardHomeVersion: rs.Version}
+	var err error
+	if f.GeneralSettings {
+		gs := &types.GeneralSettings{ProtectionEnabled: rs.ProtectionEnabled}
+		if gs.Parental, err = cl.Parental(); err != nil {
+			return nil, err
+		}
+		if gs.SafeSearch, err = cl.SafeSearch(); err != nil {
+			return nil, err
+		}
+		if gs.SafeBrowsing, err = cl.SafeBrowsing(); err != nil {
+			return nil, err
+		}
+		s.GeneralSettings = gs
+	}
+	if f.QueryLogConfig {
+		if s.QueryLogConfig, err = cl.QueryLogConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if f.StatsConfig {
+		if s.StatsConfig, err = cl.StatsConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if f.DNS.Rewrites {
+		if s.Rewrites, err = cl.RewriteList(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Filters {
+		if s.Filtering, err = cl.Filtering(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Services {
+		services, err := cl.Services()
+		if err != nil {
+			return nil, err
+		}
+		s.Services = &services
+	}
+	if f.ClientSettings {
+		if s.Clients, err = cl.Clients(); err != nil {
+			return nil, err
+		}
+	}
+	if f.DNS.AccessLists {
+		if s.AccessList, err = cl.AccessList(); err != nil {
+			return nil, err
+		}
+	}
+	if f.DNS.ServerConfig {
+		if s.DNSConfig, err = cl.DNSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if f.DHCP.ServerConfig || f.DHCP.StaticLeases {
+		if s.DHCPServerConfig, err = cl.DHCPServerConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// snapshotClient serves the reads of the sections contained in the snapshot from the snapshot instead of the instance.
+// The sync reads each section once before changing it, so the snapshot read before the sync is not read again.
+type snapshotClient struct {
+	client.Client
+	snapshot *types.Snapshot
+}
+
+func (c *snapshotClient) Parental() (bool, error) {
+	if c.snapshot.GeneralSettings != nil {
+		return c.snapshot.GeneralSettings.Parental, nil
+	}
+	return c.Client.Parental()
+}
+
+func (c *snapshotClient) SafeSearch() (bool, error) {
+	if c.snapshot.GeneralSettings != nil {
+		return c.snapshot.GeneralSettings.SafeSearch, nil
+	}
+	return c.Client.SafeSearch()
+}
+
+func (c *snapshotClient) SafeBrowsing() (bool, error) {
+	if c.snapshot.GeneralSettings != nil {
+		return c.snapshot.GeneralSettings.SafeBrowsing, nil
+	}
+	return c.Client.SafeBrowsing()
+}
+
+func (c *snapshotClient) QueryLogConfig() (*types.QueryLogConfig, error) {
+	if c.snapshot.QueryLogConfig != nil {
+		qlc := &types.QueryLogConfig{}
+		deepCopy(qlc, c.snapshot.QueryLogConfig)
+		return qlc, nil
+	}
+	return c.Client.QueryLogConfig()
+}
+
+func (c *snapshotClient) StatsConfig() (*types.IntervalConfig, error) {
+	if c.snapshot.StatsConfig != nil {
+		sc := &types.IntervalConfig{}
+		deepCopy(sc, c.snapshot.StatsConfig)
+		return sc, nil
+	}
+	return c.Client.StatsConfig()
+}
+
+func (c *snapshotClient) RewriteList() (*types.RewriteEntries, error) {
+	if c.snapshot.Rewrites != nil {
+		re := &types.RewriteEntries{}
+		deepCopy(re, c.snapshot.Rewrites)
+		return re, nil
+	}
+	return c.Client.RewriteList()
+}
+
+func (c *snapshotClient) Filtering() (*types.FilteringStatus, error) {
+	if c.snapshot.Filtering != nil {
+		f := &types.FilteringStatus{}
+		deepCopy(f, c.snapshot.Filtering)
+		return f, nil
+	}
+	return c.Client.Filtering()
+}
+
+func (c *snapshotClient) Services() (types.Services, error) {
+	if c.snapshot.Services != nil {
+		var s types.Services
+		deepCopy(&s, c.snapshot.Services)
+		return s, nil
+	}
+	return c.Client.Services()
+}
+
+func (c *snapshotClient) Clients() (*types.Clients, error) {
+	if c.snapshot.Clients != nil {
+		cl := &types.Clients{}
+		deepCopy(cl, c.snapshot.Clients)
+		return cl, nil
+	}
+	return c.Client.Clients()
+}
+
+func (c *snapshotClient) AccessList() (*types.AccessList, error) {
+	if c.snapshot.AccessList != nil {
+		al := &types.AccessList{}
+		deepCopy(al, c.snapshot.AccessList)
+		return al, nil
+	}
+	return c.Client.AccessList()
+}
+
+func (c *snapshotClient) DNSConfig() (*types.DNSConfig, error) {
+	if c.snapshot.DNSConfig != nil {
+		dc := &types.DNSConfig{}
+		deepCopy(dc, c.snapshot.DNSConfig)
+		return dc, nil
+	}
+	return c.Client.DNSConfig()
+}
+
+func (c *snapshotClient) DHCPServerConfig() (*types.DHCPServerConfig, error) {
+	if c.snapshot.DHCPServerConfig != nil {
+		return c.snapshot.DHCPServerConfig.Clone(), nil
+	}
+	return c.Client.DHCPServerConfig()
+}
@@ -1,47 +1,61 @@
 package sync
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bakito/adguardhome-sync/pkg/client"
 	"github.com/bakito/adguardhome-sync/pkg/log"
+	"github.com/bakito/adguardhome-sync/pkg/metrics"
+	"github.com/bakito/adguardhome-sync/pkg/notify"
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/state"
 	"github.com/bakito/adguardhome-sync/pkg/types"
 	"github.com/bakito/adguardhome-sync/version"
+	"github.com/google/uuid"
 	"github.com/robfig/cron/v3"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"golang.org/x/mod/semver"
 )
 
-const minAghVersion = "v0.107.0"
+const (
+	minAghVersion  = "v0.107.0"
+	runHistorySize = 20
+)
 
 var l = log.GetLogger("sync")
 
 // Sync config from origin to replica
 func Sync(cfg *types.Config) error {
-	if cfg.Origin.URL == "" {
-		return fmt.Errorf("origin URL is required")
+	w, err := newWorker(cfg)
+	if err != nil {
+		return err
 	}
-
-	if len(cfg.UniqueReplicas()) == 0 {
-		return fmt.Errorf("no replicas configured")
+	if cfg.State.File != "" {
+		if w.state, err = state.New(cfg.State); err != nil {
+			return fmt.Errorf("error opening state file %q: %w", cfg.State.File, err)
+		}
+		defer func() { _ = w.state.Close() }()
+		w.loadRuns()
 	}
 
-	l.With("version", version.Version, "build", version.Build).Info("AdGuardHome sync")
-	cfg.Features.LogDisabled(l)
-	cfg.Origin.AutoSetup = false
-
-	w := &worker{
-		cfg: cfg,
-		createClient: func(ai types.AdGuardInstance) (client.Client, error) {
-			return client.New(ai)
-		},
+	// the watch mode blocks if neither the cron job nor the api do
+	watch := cfg.Watch.Enabled()
+	if watch && (cfg.Cron != "" || cfg.API.Port != 0) {
+		go w.watch()
+		watch = false
 	}
+
 	if cfg.Cron != "" {
 		w.cron = cron.New()
 		cl := l.With("cron", cfg.Cron)
 		_, err := w.cron.AddFunc(cfg.Cron, func() {
-			w.sync()
+			w.sync(syncOptions{trigger: types.TriggerCron})
 		})
 		if err != nil {
 			cl.With("error", err).Error("Error during cron job setup")
@@ -58,200 +72,818 @@ func Sync(cfg *types.Config) error {
 		if cfg.RunOnStart {
 			go func() {
 				l.Info("Running sync on startup")
-				w.sync()
+				w.sync(syncOptions{trigger: types.TriggerStartup})
 			}()
 		}
 		w.listenAndServe()
 	} else if cfg.RunOnStart {
 		l.Info("Running sync on startup")
-		w.sync()
+		w.sync(syncOptions{trigger: types.TriggerStartup})
+	}
+	if watch {
+		w.watch()
 	}
 
 	return nil
 }
 
+// DryRun evaluates all changes a sync from origin to the replicas would apply, without applying them
+func DryRun(cfg *types.Config) (*types.Run, error) {
+	w, err := newWorker(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return w.sync(syncOptions{trigger: types.TriggerCLI, dryRun: true}), nil
+}
+
+func newWorker(cfg *types.Config) (*worker, error) {
+	if cfg.Origin.URL == "" && len(cfg.Origins) == 0 && cfg.Origin.File == "" {
+		return nil, fmt.Errorf("origin URL or file is required")
+	}
+
+	if len(cfg.UniqueReplicas()) == 0 {
+		return nil, fmt.Errorf("no replicas configured")
+	}
+	if err := cfg.DeleteGuard.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.MultiMaster.Validate(cfg.Origin.File, cfg.UniqueReplicas()); err != nil {
+		return nil, err
+	}
+	if err := cfg.Watch.Validate(cfg.Origin.File); err != nil {
+		return nil, err
+	}
+	for _, r := range cfg.UniqueReplicas() {
+		if !r.Mode.Valid() {
+			return nil, fmt.Errorf("invalid mode %q of replica %s", r.Mode, r.URL)
+		}
+		items := cfg.ReplicaItems(r)
+		if err := items.Validate(); err != nil {
+			return nil, fmt.Errorf("replica %s: %w", r.URL, err)
+		}
+		if _, err := r.Replacer(); err != nil {
+			return nil, fmt.Errorf("replica %s: %w", r.URL, err)
+		}
+	}
+
+	notifier, err := notify.New(cfg.Notifications)
+	if err != nil {
+		return nil, err
+	}
+
+	l.With("version", version.Version, "build", version.Build).Info("AdGuardHome sync")
+	logDisabledFeatures(cfg)
+	cfg.Origin.AutoSetup = false
+
+	return &worker{
+		cfg:          cfg,
+		createClient: newClient,
+		state:        state.NewMemoryStore(),
+		notifier:     notifier,
+	}, nil
+}
+
+// logDisabledFeatures logs the disabled global features and those of the replicas with own features
+func logDisabledFeatures(cfg *types.Config) {
+	cfg.Features.LogDisabled(l)
+	for _, r := range cfg.UniqueReplicas() {
+		if r.Features != nil {
+			rf := cfg.ReplicaFeatures(r)
+			rf.LogDisabled(l.With("replica", r.URL))
+		}
+	}
+}
+
+func newClient(ai types.AdGuardInstance) (client.Client, error) {
+	return client.New(ai)
+}
+
+// useLogger logs the requests and changes of the client with the fields of the logger
+func useLogger(cl client.Client, sl *zap.SugaredLogger) {
+	if lc, ok := cl.(client.Logged); ok {
+		lc.UseLogger(sl)
+	}
+}
+
 type worker struct {
 	cfg          *types.Config
 	running      bool
+	runs         []*types.Run
+	mutex        sync.RWMutex
 	cron         *cron.Cron
 	createClient func(instance types.AdGuardInstance) (client.Client, error)
+
+	// skippedDeletes the deletes not applied to the replica of the worker as deletes are disabled
+	skippedDeletes []types.Change
+	// state the state of the sync, persisted if a state file is configured
+	state *state.Store
+	// webhookSignatures the signatures of the accepted webhook requests
+	webhookSignatures usedSignatures
+	// notifier sends the events of the sync runs
+	notifier *notify.Dispatcher
+}
+
+type syncOptions struct {
+	// trigger what triggered the sync
+	trigger types.Trigger
+	// dryRun only evaluate the changes without applying them
+	dryRun bool
+	// force sync the replicas, also if the origin and the replica did not change since the last sync
+	force bool
+	// replicas the urls of the replicas to sync, all replicas if empty
+	replicas []string
+	// features the names of the features to sync, all enabled features if empty
+	features []string
 }
 
-func (w *worker) sync() {
+// all returns true if all replicas and features are synced
+func (opts syncOptions) all() bool {
+	return len(opts.replicas) == 0 && len(opts.features) == 0
+}
+
+// selectReplicas returns the selected replicas
+func (opts syncOptions) selectReplicas(replicas []types.AdGuardInstance) []types.AdGuardInstance {
+	if len(opts.replicas) == 0 {
+		return replicas
+	}
+	var selected []types.AdGuardInstance
+	for _, r := range replicas {
+		for _, url := range opts.replicas {
+			if r.URL == url {
+				selected = append(selected, r)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// selectFeatures returns the features with the features that are not selected disabled
+func (opts syncOptions) selectFeatures(f types.Features) types.Features {
+	if len(opts.features) == 0 {
+		return f
+	}
+	disabled := &types.FeaturesOverride{}
+	for _, feature := range types.AllFeatures {
+		disabled.Set(feature, false)
+	}
+	for _, feature := range opts.features {
+		disabled.Set(feature, f.Enabled(feature))
+	}
+	return f.Merge(disabled)
+}
+
+func (w *worker) sync(opts syncOptions) *types.Run {
+	run := w.startRun(opts)
+	if run == nil {
+		return nil
+	}
+	w.execute(run, opts)
+	return run
+}
+
+// startRun registers a new run, returns nil if a sync is already running
+func (w *worker) startRun(opts syncOptions) *types.Run {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	if w.running {
 		l.Info("Sync already running")
-		return
+		return nil
 	}
 	w.running = true
-	defer func() { w.running = false }()
 
-	oc, err := w.createClient(w.cfg.Origin)
+	run := &types.Run{
+		ID:      uuid.NewString(),
+		Trigger: opts.trigger,
+		DryRun:  opts.dryRun,
+		Start:   time.Now(),
+		Result:  types.ResultRunning,
+		Origin:  w.originName(),
+	}
+	// the history gets a copy, as the run is updated during the sync
+	rc := *run
+	w.runs = append(w.runs, &rc)
+	if len(w.runs) > runHistorySize {
+		w.runs = w.runs[len(w.runs)-runHistorySize:]
+	}
+	w.saveRun(run)
+	return run
+}
+
+// originName returns the origin file if configured, the url of the preferred origin otherwise
+func (w *worker) originName() string {
+	if w.cfg.Origin.File != "" {
+		return w.cfg.Origin.File
+	}
+	if candidates := w.cfg.OriginCandidates(); len(candidates) > 0 {
+		return candidates[0].URL
+	}
+	return ""
+}
+
+// finishRun replaces the run in the history with the finished run, the origin hash is kept for successful runs only
+func (w *worker) finishRun(run *types.Run) {
+	run.Finish()
+	if run.Result != types.ResultSuccess {
+		run.OriginHash = ""
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.running = false
+	for i := range w.runs {
+		if w.runs[i].ID == run.ID {
+			w.runs[i] = run
+		}
+	}
+	w.saveRun(run)
+}
+
+// saveRun persists the run and removes the runs outside the history
+func (w *worker) saveRun(run *types.Run) {
+	if err := w.state.SaveRun(run); err != nil {
+		l.With("error", err, "run_id", run.ID).Error("Error saving run")
+		return
+	}
+	if err := w.state.PruneRuns(runHistorySize); err != nil {
+		l.With("error", err).Error("Error removing old runs")
+	}
+}
+
+// loadRuns restores the history from the state, runs that were interrupted by a restart are failed
+func (w *worker) loadRuns() {
+	runs, err := w.state.Runs()
 	if err != nil {
-		l.With("error", err, "url", w.cfg.Origin.URL).Error("Error creating origin client")
+		l.With("error", err).Error("Error loading runs")
 		return
 	}
+	for _, run := range runs {
+		if run.Result == types.ResultRunning {
+			run.Error = "interrupted by a restart"
+			run.Finish()
+			w.saveRun(run)
+		}
+	}
+	if len(runs) > runHistorySize {
+		runs = runs[len(runs)-runHistorySize:]
+	}
+	w.runs = runs
+	l.With("runs", len(runs)).Info("Restored sync history")
+}
+
+// notify sends the events of the finished run to the notifiers, dry-runs are not notified
+func (w *worker) notify(run *types.Run) {
+	if run.DryRun {
+		return
+	}
+	w.notifier.Notify(run, w.previousRun(run))
+}
+
+// previousRun returns the finished run before the run that was not a dry-run, nil if there is none
+func (w *worker) previousRun(run *types.Run) *types.Run {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for i := len(w.runs) - 1; i >= 0; i-- {
+		r := w.runs[i]
+		if r.ID != run.ID && !r.DryRun && r.Result != types.ResultRunning && r.Start.Before(run.Start) {
+			return r
+		}
+	}
+	return nil
+}
 
-	sl := l.With("from", oc.Host())
+// history returns the runs, the latest first
+func (w *worker) history() []*types.Run {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	runs := make([]*types.Run, len(w.runs))
+	for i := range w.runs {
+		runs[len(w.runs)-1-i] = w.runs[i]
+	}
+	return runs
+}
 
+func (w *worker) execute(run *types.Run, opts syncOptions) {
+	defer func() {
+		w.finishRun(run)
+		w.notify(run)
+	}()
+	if !opts.dryRun {
+		metrics.SyncStarted()
+		defer func() { metrics.SyncFinished(!run.HasErrors()) }()
+	}
+
+	var o *origin
+	var sl *zap.SugaredLogger
+	if w.cfg.Origin.File != "" {
+		sl = l.With("from", w.cfg.Origin.File, "run_id", run.ID)
+		var err error
+		o, err = w.readOrigin()
+		if err != nil {
+			sl.With("error", err).Error("Error reading origin file")
+			run.Error = err.Error()
+			return
+		}
+		sl.Info("Read origin file")
+	} else {
+		var err error
+		o, sl, err = w.selectOrigin(run)
+		if err != nil {
+			run.Error = err.Error()
+			return
+		}
+	}
+
+	if !opts.dryRun {
+		w.backup(o, run.Origin)
+	}
+	if opts.all() {
+		// the origin config is synced to the replicas only if all replicas and features are synced successfully
+		run.OriginHash = originHash(o.snapshot(run.Origin), w.cfg.AnyFeatures())
+	}
+
+	if w.cfg.MultiMaster.Enabled {
+		w.syncMultiMaster(sl, run, o, opts)
+		return
+	}
+	w.syncReplicas(sl, run, o, opts.selectReplicas(w.cfg.UniqueReplicas()), opts)
+}
+
+// selectOrigin reads the config of the first available origin candidate
+func (w *worker) selectOrigin(run *types.Run) (*origin, *zap.SugaredLogger, error) {
+	candidates := w.cfg.OriginCandidates()
+	if len(candidates) == 0 {
+		return nil, nil, errors.New("no origin configured")
+	}
+	var errs error
+	for i, c := range candidates {
+		oc, err := w.createClient(c)
+		if err != nil {
+			l.With("error", err, "origin", c.URL, "run_id", run.ID).Error("Error creating origin client")
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		sl := l.With("from", oc.Host(), "run_id", run.ID)
+		useLogger(oc, sl.With("origin", c.URL))
+		o, err := w.fetchOrigin(sl, oc, c, metrics.RoleOrigin)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		if i > 0 {
+			if err := w.checkFailover(o, c); err != nil {
+				sl.With("error", err).Error("Refusing to fail over to origin")
+				errs = multierr.Append(errs, err)
+				continue
+			}
+			sl.With("origin", c.URL, "priority", i+1).Warn("Failed over to origin")
+		} else if len(candidates) > 1 {
+			sl.With("origin", c.URL, "priority", i+1).Info("Using origin")
+		}
+
+		run.Origin = c.URL
+		if w.cfg.Failover.MaxDifferences > 0 {
+			if err := w.state.SetLastOrigin(o.snapshot(c.URL)); err != nil {
+				sl.With("error", err).Error("Error saving the origin config")
+			}
+		}
+		return o, sl, nil
+	}
+	return nil, nil, errs
+}
+
+// checkFailover checks that the config of an origin candidate does not differ too much from the last known origin config
+func (w *worker) checkFailover(o *origin, candidate types.AdGuardInstance) error {
+	if w.cfg.Failover.MaxDifferences <= 0 {
+		return nil
+	}
+	last, err := w.state.LastOrigin()
+	if err != nil {
+		return fmt.Errorf("error reading the last origin config: %w", err)
+	}
+	if last == nil && w.cfg.Backup.Enabled() {
+		if last, err = snapshot.NewStore(w.cfg.Backup).Latest(); err != nil {
+			return fmt.Errorf("error reading the latest origin snapshot: %w", err)
+		}
+	}
+	if last == nil {
+		l.With("origin", candidate.URL).Warn("No known origin config to compare the origin candidate with")
+		return nil
+	}
+	if diff := snapshot.Differences(last, o.snapshot(candidate.URL)); diff > w.cfg.Failover.MaxDifferences {
+		return fmt.Errorf("origin %s has %d differences to the last known origin config, more than the maximum of %d",
+			candidate.URL, diff, w.cfg.Failover.MaxDifferences)
+	}
+	return nil
+}
+
+// fetchOrigin reads the config of the origin instance, or of a replica merged in the multi-master mode
+func (w *worker) fetchOrigin(sl *zap.SugaredLogger, oc client.Client, oi types.AdGuardInstance, role string) (*origin, error) {
 	o := &origin{}
+	var err error
 	o.status, err = oc.Status()
 	if err != nil {
 		sl.With("error", err).Error("Error getting origin status")
-		return
+		return nil, err
 	}
 
 	if semver.Compare(o.status.Version, minAghVersion) == -1 {
 		sl.With("error", err, "version", o.status.Version).Errorf("Origin AdGuard Home version must be >= %s", minAghVersion)
-		return
+		return nil, fmt.Errorf("origin AdGuard Home version %s must be >= %s", o.status.Version, minAghVersion)
 	}
 
-	sl.With("version", o.status.Version).Info("Connected to origin")
+	sl.With("version", o.status.Version).Infof("Connected to %s", role)
+	metrics.InstanceVersion(role, oi.URL, o.status.Version)
 
 	o.parental, err = oc.Parental()
 	if err != nil {
 		sl.With("error", err).Error("Error getting parental status")
-		return
+		return nil, err
 	}
 	o.safeSearch, err = oc.SafeSearch()
 	if err != nil {
 		sl.With("error", err).Error("Error getting safe search status")
-		return
+		return nil, err
 	}
 	o.safeBrowsing, err = oc.SafeBrowsing()
 	if err != nil {
 		sl.With("error", err).Error("Error getting safe browsing status")
-		return
+		return nil, err
 	}
 
 	o.rewrites, err = oc.RewriteList()
 	if err != nil {
 		sl.With("error", err).Error("Error getting origin rewrites")
-		return
+		return nil, err
 	}
 
 	o.services, err = oc.Services()
 	if err != nil {
 		sl.With("error", err).Error("Error getting origin services")
-		return
+		return nil, err
 	}
 
 	o.filters, err = oc.Filtering()
 	if err != nil {
 		sl.With("error", err).Error("Error getting origin filters")
-		return
+		return nil, err
 	}
 	o.clients, err = oc.Clients()
 	if err != nil {
 		sl.With("error", err).Error("Error getting origin clients")
-		return
+		return nil, err
 	}
 	o.queryLogConfig, err = oc.QueryLogConfig()
 	if err != nil {
 		sl.With("error", err).Error("Error getting query log config")
-		return
+		return nil, err
 	}
 	o.statsConfig, err = oc.StatsConfig()
 	if err != nil {
 		sl.With("error", err).Error("Error getting stats config")
-		return
+		return nil, err
 	}
 
 	o.accessList, err = oc.AccessList()
 	if err != nil {
 		sl.With("error", err).Error("Error getting access list")
-		return
+		return nil, err
 	}
 
 	o.dnsConfig, err = oc.DNSConfig()
 	if err != nil {
 		sl.With("error", err).Error("Error getting dns config")
-		return
+		return nil, err
 	}
 
 	o.dhcpServerConfig, err = oc.DHCPServerConfig()
 	if err != nil {
 		sl.With("error", err).Error("Error getting dhcp server config")
-		return
+		return nil, err
+	}
+	return o, nil
+}
+
+// readOrigin reads the origin config from the origin file
+func (w *worker) readOrigin() (*origin, error) {
+	s, err := snapshot.Load(w.cfg.Origin.File)
+	if err != nil {
+		return nil, err
 	}
+	features := w.cfg.AnyFeatures()
+	if err := snapshot.Validate(s, &features); err != nil {
+		return nil, fmt.Errorf("invalid origin file %q: %w", w.cfg.Origin.File, err)
+	}
+	return originFromSnapshot(s), nil
+}
 
-	replicas := w.cfg.UniqueReplicas()
-	for _, replica := range replicas {
-		w.syncTo(sl, o, replica)
+// syncReplicas syncs the origin to the replicas in parallel and adds their results to the run
+func (w *worker) syncReplicas(l *zap.SugaredLogger, run *types.Run, o *origin, replicas []types.AdGuardInstance, opts syncOptions) {
+	run.Replicas = make([]*types.ReplicaResult, len(replicas))
+	sem := make(chan struct{}, w.cfg.ParallelReplicas())
+	wg := sync.WaitGroup{}
+	for i := range replicas {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// each replica gets its own copy, as the comparison of the values sorts them in place
+			rw := w.forReplica(replicas[i])
+			rw.cfg.Features = opts.selectFeatures(rw.cfg.Features)
+			run.Replicas[i] = rw.syncTo(l, o.clone(), replicas[i], opts)
+		}(i)
 	}
+	wg.Wait()
+}
+
+// forReplica returns a worker to sync the replica, with the features and item rules of the replica merged over the global ones
+func (w *worker) forReplica(replica types.AdGuardInstance) *worker {
+	cfg := *w.cfg
+	cfg.Features = w.cfg.ReplicaFeatures(replica)
+	cfg.Items = w.cfg.ReplicaItems(replica)
+	return &worker{cfg: &cfg, createClient: w.createClient, state: w.state}
 }
 
-func (w *worker) syncTo(l *zap.SugaredLogger, o *origin, replica types.AdGuardInstance) {
-	rc, err := w.createClient(replica)
+func (w *worker) syncTo(l *zap.SugaredLogger, o *origin, replica types.AdGuardInstance, opts syncOptions) *types.ReplicaResult {
+	rr := &types.ReplicaResult{Replica: replica.URL, Mode: replica.Mode, Result: types.ResultFailed}
+	detect := replica.Mode == types.ModeDetect
+	start := time.Now()
+	var rc *recorder
+	defer func() {
+		if rc != nil {
+			rr.Changes = rc.changes
+		}
+		rr.SkippedDeletes = w.skippedDeletes
+		countChanges(rr)
+		if opts.dryRun {
+			return
+		}
+		if detect {
+			// the differences of a replica in detect mode are not applied
+			metrics.ReplicaChecked(replica.URL, len(rr.Changes), rr.Error == "")
+		} else {
+			metrics.ReplicaSynced(replica.URL, time.Since(start), rr.Changes, rr.Error == "")
+			metrics.DeletesSkipped(replica.URL, rr.SkippedDeletes)
+		}
+	}()
+
+	cl, err := w.createClient(replica)
 	if err != nil {
-		l.With("error", err, "url", replica.URL).Error("Error creating replica client")
-		return
+		l.With("error", err, "replica", replica.URL).Error("Error creating replica client")
+		rr.Error = err.Error()
+		return rr
 	}
+	rl := l.With("replica", replica.URL, "to", cl.Host())
+	useLogger(cl, rl)
+	rc = newRecorder(cl, opts.dryRun || detect)
 
-	rl := l.With("to", rc.Host())
 	rl.Info("Start sync")
 
 	rs, err := w.statusWithSetup(rl, replica, rc)
 	if err != nil {
 		rl.With("error", err).Error("Error getting replica status")
-		return
+		rr.Error = err.Error()
+		return rr
 	}
+	rr.Version = rs.Version
 
 	rl.With("version", o.status.Version).Info("Connected to replica")
+	metrics.InstanceVersion(metrics.RoleReplica, replica.URL, rs.Version)
 
 	if semver.Compare(rs.Version, minAghVersion) == -1 {
 		rl.With("error", err, "version", rs.Version).Errorf("Replica AdGuard Home version must be >= %s", minAghVersion)
-		return
+		rr.Error = fmt.Sprintf("replica AdGuard Home version %s must be >= %s", rs.Version, minAghVersion)
+		return rr
 	}
 
-	if o.status.Version != rs.Version {
-		rl.With("originVersion", o.status.Version, "replicaVersion", rs.Version).Warn("Versions do not match")
+	// an origin file has no version
+	if o.status.Version != "" && o.status.Version != rs.Version {
+		rl.With("origin_version", o.status.Version, "replica_version", rs.Version).Warn("Versions do not match")
 	}
 
-	err = w.syncGeneralSettings(o, rs, rc)
-	if err != nil {
-		rl.With("error", err).Error("Error syncing general settings")
-		return
+	if err := w.transform(o, replica); err != nil {
+		rl.With("error", err).Error("Error transforming the origin config")
+		rr.Error = err.Error()
+		return rr
 	}
 
-	err = w.syncConfigs(o, rc)
+	// the config of the replica before the sync, the sync steps read the sections of the enabled features from it
+	config, err := readSnapshot(cl, rs, w.cfg.Features)
 	if err != nil {
-		rl.With("error", err).Error("Error syncing configs")
-		return
+		rl.With("error", err).Warn("Error reading the replica config, the features are read by their sync")
+	} else {
+		rc.useSnapshot(config)
 	}
 
-	err = w.syncRewrites(rl, o.rewrites, rc)
-	if err != nil {
-		rl.With("error", err).Error("Error syncing rewrites")
-		return
+	// only enforced replicas are skipped, as a dry-run and the drift detection report all differences
+	skippable := !opts.dryRun && !detect && !opts.force && !w.cfg.Force
+	syncHash := w.syncHash(o, replica)
+	if skippable && config != nil && w.unchanged(rl, config, replica, syncHash) {
+		rl.Info("Origin and replica unchanged since the last sync, sync skipped")
+		rr.Result = types.ResultSkipped
+		return rr
 	}
-	err = w.syncFilters(o.filters, rc)
+
+	// all steps are planned before any change is applied, the delete guard checks the deletes of all features
+	steps := w.syncSteps(rl, o, rs, rc, replica)
+	plans, err := w.plan(rc, steps)
 	if err != nil {
-		rl.With("error", err).Error("Error syncing filters")
-		return
+		rl.With("error", err).Error("Sync aborted by the delete guard")
+		rr.Error = err.Error()
+		rr.Result = types.ResultAborted
+		return rr
 	}
 
-	err = w.syncServices(o.services, rc)
-	if err != nil {
-		rl.With("error", err).Error("Error syncing services")
-		return
+	// failed is set if the remaining steps are skipped
+	var failed bool
+	var errs error
+	for i, step := range steps {
+		result := types.ResultSuccess
+		var stepErr string
+		applied := len(rc.changes)
+		if failed {
+			result = types.ResultSkipped
+		} else if err := plans[i].apply(); err != nil {
+			rl.With("error", err, "feature", strings.Join(step.features, ",")).Errorf("Error syncing %s", step.name)
+			result = types.ResultFailed
+			if w.cfg.ContinueOnError {
+				// the features are synced independently, only the changes of the failed features are rolled back
+				rollback(rl, rr, rc, applied)
+			} else {
+				failed = true
+			}
+			errs = multierr.Append(errs, err)
+			stepErr = err.Error()
+		}
+		for _, f := range step.features {
+			if w.cfg.Features.Enabled(f) {
+				rr.Features = append(rr.Features, types.FeatureResult{Feature: f, Result: result, Error: stepErr})
+				if result == types.ResultFailed {
+					rr.FailedFeatures = append(rr.FailedFeatures, f)
+				}
+			}
+		}
+	}
+	if errs != nil {
+		rr.Error = errs.Error()
+	}
+	if failed {
+		rollback(rl, rr, rc, 0)
+		return rr
 	}
 
-	if err = w.syncClients(o.clients, rc); err != nil {
-		rl.With("error", err).Error("Error syncing clients")
-		return
+	dl := rl.With("changes", len(rc.changes))
+	switch {
+	case errs == nil:
+		rr.Result = types.ResultSuccess
+	case len(rr.FailedFeatures) < len(rr.Features):
+		// the features are synced independently if continueOnError is enabled
+		rr.Result = types.ResultPartial
+		dl = dl.With("failed_features", rr.FailedFeatures)
+	default:
+		return rr
 	}
+	for _, c := range w.skippedDeletes {
+		rl.With("feature", c.Feature, "action", c.Action, "key", c.Key).Warn("Skipping delete as deletes are disabled")
+	}
+	switch {
+	case opts.dryRun:
+		dl.Info("Dry-run done")
+	case detect:
+		rr.Drift = len(rc.changes) > 0
+		for _, c := range rc.changes {
+			rl.With("feature", c.Feature, "action", c.Action, "key", c.Key).Warn("Drift detected")
+		}
+		dl.Info("Drift detection done")
+	case rr.Result == types.ResultPartial:
+		dl.Warn("Sync done")
+	default:
+		w.saveApplied(rl, rc, config, replica, syncHash)
+		dl.Info("Sync done")
+	}
+	return rr
+}
 
-	if err = w.syncDNS(o.accessList, o.dnsConfig, rc); err != nil {
-		rl.With("error", err).Error("Error syncing dns")
-		return
+// syncStep syncs one or more features of a replica
+type syncStep struct {
+	name     string
+	features []string
+	sync     func() error
+}
+
+func (w *worker) syncSteps(rl *zap.SugaredLogger, o *origin, rs *types.Status, rc client.Client, replica types.AdGuardInstance) []syncStep {
+	return []syncStep{
+		{
+			name:     "general settings",
+			features: []string{types.FeatureGeneralSettings},
+			sync:     func() error { return w.syncGeneralSettings(o, rs, rc) },
+		},
+		{
+			name:     "configs",
+			features: []string{types.FeatureQueryLogConfig, types.FeatureStatsConfig},
+			sync:     func() error { return w.syncConfigs(o, rc) },
+		},
+		{
+			name:     "rewrites",
+			features: []string{types.FeatureDNSRewrites},
+			sync:     func() error { return w.syncRewrites(rl, o.rewrites, rc) },
+		},
+		{
+			name:     "filters",
+			features: []string{types.FeatureFilters},
+			sync:     func() error { return w.syncFilters(o.filters, rc) },
+		},
+		{
+			name:     "services",
+			features: []string{types.FeatureServices},
+			sync:     func() error { return w.syncServices(o.services, rc) },
+		},
+		{
+			name:     "clients",
+			features: []string{types.FeatureClientSettings},
+			sync:     func() error { return w.syncClients(o.clients, rc) },
+		},
+		{
+			name:     "dns",
+			features: []string{types.FeatureDNSAccessLists, types.FeatureDNSServerConfig},
+			sync:     func() error { return w.syncDNS(o.accessList, o.dnsConfig, rc) },
+		},
+		{
+			name:     "dhcp server",
+			features: []string{types.FeatureDHCPServerConfig, types.FeatureDHCPStaticLeases},
+			sync:     func() error { return w.syncDHCPServer(o.dhcpServerConfig, rc, replica) },
+		},
 	}
+}
 
-	if err = w.syncDHCPServer(o.dhcpServerConfig, rc, replica); err != nil {
-		rl.With("error", err).Error("Error syncing dns")
+// rollback reverts the changes of the replica since the change with the index and adds them to the rollback of the result
+func rollback(rl *zap.SugaredLogger, rr *types.ReplicaResult, rc *recorder, from int) {
+	rb := rc.rollback(from)
+	if rb == nil {
+		return
+	}
+	for _, f := range rb.Failed {
+		rl.With("feature", f.Change.Feature, "action", f.Change.Action, "key", f.Change.Key, "error", f.Error).Error("Error rolling back change")
+	}
+	rl.With("reverted", len(rb.Reverted), "failed", len(rb.Failed)).Warn("Rolled back the changes of the failed sync")
+	if rr.Rollback == nil {
+		rr.Rollback = rb
 		return
 	}
+	rr.Rollback.Reverted = append(rr.Rollback.Reverted, rb.Reverted...)
+	rr.Rollback.Failed = append(rr.Rollback.Failed, rb.Failed...)
+}
 
-	rl.Info("Sync done")
+// plannedStep the queued writes of a planned sync step and the error that ended its planning
+type plannedStep struct {
+	writes []func() error
+	err    error
+}
+
+// apply applies the queued writes of the step
+func (p plannedStep) apply() error {
+	for _, write := range p.writes {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+	return p.err
+}
+
+// plan runs the sync steps with the writes queued, the steps after a failed step are not planned unless
+// continueOnError is enabled. Returns the error of the delete guard if it is exceeded by any step.
+func (w *worker) plan(rc *recorder, steps []syncStep) ([]plannedStep, error) {
+	rc.planning = true
+	defer func() { rc.planning = false }()
+	plans := make([]plannedStep, len(steps))
+	for i, step := range steps {
+		err := step.sync()
+		plans[i] = plannedStep{writes: rc.takePlanned(), err: err}
+		var dge *types.DeleteGuardError
+		if errors.As(err, &dge) {
+			return nil, err
+		}
+		if err != nil && !w.cfg.ContinueOnError {
+			break
+		}
+	}
+	return plans, nil
+}
+
+// countChanges counts the changes per replica and feature
+func countChanges(rr *types.ReplicaResult) {
+	for _, c := range rr.Changes {
+		rr.Counts.Add(c)
+		for i := range rr.Features {
+			if rr.Features[i].Feature == c.Feature {
+				rr.Features[i].Counts.Add(c)
+			}
+		}
+	}
 }
 
 func (w *worker) statusWithSetup(rl *zap.SugaredLogger, replica types.AdGuardInstance, rc client.Client) (*types.Status, error) {
@@ -287,20 +919,27 @@ func (w *worker) syncServices(os types.Services, replica client.Client) error {
 
 func (w *worker) syncFilters(of *types.FilteringStatus, replica client.Client) error {
 	if w.cfg.Features.Filters {
+		m, err := w.cfg.Items.Filters.Matcher()
+		if err != nil {
+			return err
+		}
 		rf, err := replica.Filtering()
 		if err != nil {
 			return err
 		}
 
-		if err = w.syncFilterType(of.Filters, rf.Filters, false, replica); err != nil {
+		if err = w.syncFilterType(of.Filters.Select(m), rf.Filters.Select(m), false, replica); err != nil {
 			return err
 		}
-		if err = w.syncFilterType(of.WhitelistFilters, rf.WhitelistFilters, true, replica); err != nil {
+		if err = w.syncFilterType(of.WhitelistFilters.Select(m), rf.WhitelistFilters.Select(m), true, replica); err != nil {
 			return err
 		}
 
-		if of.UserRules.String() != rf.UserRules.String() {
-			return replica.SetCustomRules(of.UserRules)
+		// the local sections of the replica rules are kept
+		ors, _ := of.UserRules.Split()
+		rrs, rls := rf.UserRules.Split()
+		if ors.String() != rrs.String() {
+			return replica.SetCustomRules(append(ors, rls...))
 		}
 
 		if of.Enabled != rf.Enabled || of.Interval != rf.Interval {
@@ -314,6 +953,9 @@ func (w *worker) syncFilters(of *types.FilteringStatus, replica client.Client) e
 
 func (w *worker) syncFilterType(of types.Filters, rFilters types.Filters, whitelist bool, replica client.Client) error {
 	fa, fu, fd := rFilters.Merge(of)
+	if err := w.checkDeletes(types.FeatureFilters, len(of), len(rFilters), len(fd)); err != nil {
+		return err
+	}
 
 	if err := replica.AddFilters(whitelist, fa...); err != nil {
 		return err
@@ -328,6 +970,12 @@ func (w *worker) syncFilterType(of types.Filters, rFilters types.Filters, whitel
 		}
 	}
 
+	if !w.cfg.DeletesEnabled(types.FeatureFilters) {
+		for i := range fd {
+			w.skipDelete(types.FeatureFilters, fd[i].URL, fd[i])
+		}
+		return nil
+	}
 	if err := replica.DeleteFilters(whitelist, fd...); err != nil {
 		return err
 	}
@@ -336,18 +984,32 @@ func (w *worker) syncFilterType(of types.Filters, rFilters types.Filters, whitel
 
 func (w *worker) syncRewrites(rl *zap.SugaredLogger, or *types.RewriteEntries, replica client.Client) error {
 	if w.cfg.Features.DNS.Rewrites {
+		m, err := w.cfg.Items.Rewrites.Matcher()
+		if err != nil {
+			return err
+		}
 		replicaRewrites, err := replica.RewriteList()
 		if err != nil {
 			return err
 		}
 
-		a, r, d := replicaRewrites.Merge(or)
+		ro, rr := or.Select(m), replicaRewrites.Select(m)
+		a, r, d := rr.Merge(ro)
+		if err = w.checkDeletes(types.FeatureDNSRewrites, len(*ro), len(*rr), len(r)); err != nil {
+			return err
+		}
 
 		if err = replica.AddRewriteEntries(a...); err != nil {
 			return err
 		}
-		if err = replica.DeleteRewriteEntries(r...); err != nil {
-			return err
+		if w.cfg.DeletesEnabled(types.FeatureDNSRewrites) {
+			if err = replica.DeleteRewriteEntries(r...); err != nil {
+				return err
+			}
+		} else {
+			for i := range r {
+				w.skipDelete(types.FeatureDNSRewrites, r[i].Key(), r[i])
+			}
 		}
 
 		for _, dupl := range d {
@@ -360,12 +1022,20 @@ func (w *worker) syncRewrites(rl *zap.SugaredLogger, or *types.RewriteEntries, r
 
 func (w *worker) syncClients(oc *types.Clients, replica client.Client) error {
 	if w.cfg.Features.ClientSettings {
+		m, err := w.cfg.Items.Clients.Matcher()
+		if err != nil {
+			return err
+		}
 		rc, err := replica.Clients()
 		if err != nil {
 			return err
 		}
 
-		a, u, r := rc.Merge(oc)
+		co, cr := oc.Select(m), rc.Select(m)
+		a, u, r := cr.Merge(co)
+		if err = w.checkDeletes(types.FeatureClientSettings, len(co.Clients), len(cr.Clients), len(r)); err != nil {
+			return err
+		}
 
 		if err = replica.AddClients(a...); err != nil {
 			return err
@@ -373,6 +1043,12 @@ func (w *worker) syncClients(oc *types.Clients, replica client.Client) error {
 		if err = replica.UpdateClients(u...); err != nil {
 			return err
 		}
+		if !w.cfg.DeletesEnabled(types.FeatureClientSettings) {
+			for i := range r {
+				w.skipDelete(types.FeatureClientSettings, r[i].Name, r[i])
+			}
+			return nil
+		}
 		if err = replica.DeleteClients(r...); err != nil {
 			return err
 		}
@@ -484,11 +1160,25 @@ func (w *worker) syncDHCPServer(osc *types.DHCPServerConfig, rc client.Client, r
 	}
 
 	if w.cfg.Features.DHCP.StaticLeases {
-		a, r := sc.StaticLeases.Merge(osc.StaticLeases)
+		m, err := w.cfg.Items.StaticLeases.Matcher()
+		if err != nil {
+			return err
+		}
+		lo, lr := osc.StaticLeases.Select(m), sc.StaticLeases.Select(m)
+		a, r := lr.Merge(lo)
+		if err = w.checkDeletes(types.FeatureDHCPStaticLeases, len(lo), len(lr), len(r)); err != nil {
+			return err
+		}
 
 		if err = rc.AddDHCPStaticLeases(a...); err != nil {
 			return err
 		}
+		if !w.cfg.DeletesEnabled(types.FeatureDHCPStaticLeases) {
+			for i := range r {
+				w.skipDelete(types.FeatureDHCPStaticLeases, r[i].HWAddr, r[i])
+			}
+			return nil
+		}
 		if err = rc.DeleteDHCPStaticLeases(r...); err != nil {
 			return err
 		}
@@ -496,6 +1186,24 @@ func (w *worker) syncDHCPServer(osc *types.DHCPServerConfig, rc client.Client, r
 	return nil
 }
 
+// checkDeletes checks the deletes of a feature against the delete guard, skipped deletes are not checked
+func (w *worker) checkDeletes(feature string, originItems int, replicaItems int, deletes int) error {
+	if !w.cfg.DeletesEnabled(feature) {
+		return nil
+	}
+	return w.cfg.DeleteGuard.Check(feature, originItems, replicaItems, deletes)
+}
+
+// skipDelete records a delete that is not applied to the replica
+func (w *worker) skipDelete(feature string, key string, item interface{}) {
+	w.skippedDeletes = append(w.skippedDeletes, types.Change{
+		Feature: feature,
+		Action:  types.ActionDelete,
+		Key:     key,
+		Before:  item,
+	})
+}
+
 type origin struct {
 	status           *types.Status
 	rewrites         *types.RewriteEntries
@@ -511,3 +1219,57 @@ type origin struct {
 	safeSearch       bool
 	safeBrowsing     bool
 }
+
+// clone creates a deep copy of the origin
+func (o *origin) clone() *origin {
+	c := &origin{
+		parental:     o.parental,
+		safeSearch:   o.safeSearch,
+		safeBrowsing: o.safeBrowsing,
+	}
+	if o.status != nil {
+		c.status = &types.Status{}
+		deepCopy(c.status, o.status)
+	}
+	if o.rewrites != nil {
+		c.rewrites = &types.RewriteEntries{}
+		deepCopy(c.rewrites, o.rewrites)
+	}
+	if o.services != nil {
+		deepCopy(&c.services, o.services)
+	}
+	if o.filters != nil {
+		c.filters = &types.FilteringStatus{}
+		deepCopy(c.filters, o.filters)
+	}
+	if o.clients != nil {
+		c.clients = &types.Clients{}
+		deepCopy(c.clients, o.clients)
+	}
+	if o.queryLogConfig != nil {
+		c.queryLogConfig = &types.QueryLogConfig{}
+		deepCopy(c.queryLogConfig, o.queryLogConfig)
+	}
+	if o.statsConfig != nil {
+		c.statsConfig = &types.IntervalConfig{}
+		deepCopy(c.statsConfig, o.statsConfig)
+	}
+	if o.accessList != nil {
+		c.accessList = &types.AccessList{}
+		deepCopy(c.accessList, o.accessList)
+	}
+	if o.dnsConfig != nil {
+		c.dnsConfig = &types.DNSConfig{}
+		deepCopy(c.dnsConfig, o.dnsConfig)
+	}
+	if o.dhcpServerConfig != nil {
+		c.dhcpServerConfig = o.dhcpServerConfig.Clone()
+	}
+	return c
+}
+
+// deepCopy copies the values as they are sent to the API
+func deepCopy(to interface{}, from interface{}) {
+	b, _ := json.Marshal(from)
+	_ = json.Unmarshal(b, to)
+}
@@ -1,11 +1,23 @@
 package sync
 
 import (
+	"bytes"
 	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/bakito/adguardhome-sync/pkg/client"
+	"github.com/bakito/adguardhome-sync/pkg/log"
 	clientmock "github.com/bakito/adguardhome-sync/pkg/mocks/client"
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/state"
 	"github.com/bakito/adguardhome-sync/pkg/types"
+	"github.com/gin-gonic/gin"
 	gm "github.com/golang/mock/gomock"
 	"github.com/google/uuid"
 	. "github.com/onsi/ginkgo/v2"
@@ -27,6 +39,7 @@ var _ = Describe("Sync", func() {
 			createClient: func(instance types.AdGuardInstance) (client.Client, error) {
 				return cl, nil
 			},
+			state: state.NewMemoryStore(),
 			cfg: &types.Config{
 				Features: types.Features{
 					DHCP: types.DHCP{
@@ -53,6 +66,41 @@ var _ = Describe("Sync", func() {
 		defer mockCtrl.Finish()
 	})
 
+	// expectOrigin expects the reads of the origin config, that has the rewrites and default values otherwise
+	expectOrigin := func(rewrites ...types.RewriteEntry) {
+		cl.EXPECT().Host()
+		cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+		cl.EXPECT().Parental()
+		cl.EXPECT().SafeSearch()
+		cl.EXPECT().SafeBrowsing()
+		cl.EXPECT().RewriteList().Return(rewriteList(rewrites), nil)
+		cl.EXPECT().Services()
+		cl.EXPECT().Filtering().Return(&types.FilteringStatus{}, nil)
+		cl.EXPECT().Clients().Return(&types.Clients{}, nil)
+		cl.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil)
+		cl.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil)
+		cl.EXPECT().AccessList().Return(&types.AccessList{}, nil)
+		cl.EXPECT().DNSConfig().Return(&types.DNSConfig{}, nil)
+		cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+	}
+	// expectReplica expects the status and the reads of the config of all features of the replica before the sync
+	expectReplica := func(status *types.Status, rewrites ...types.RewriteEntry) {
+		cl.EXPECT().Host()
+		cl.EXPECT().Status().Return(status, nil)
+		cl.EXPECT().Parental()
+		cl.EXPECT().SafeSearch()
+		cl.EXPECT().SafeBrowsing()
+		cl.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil)
+		cl.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil)
+		cl.EXPECT().RewriteList().Return(rewriteList(rewrites), nil)
+		cl.EXPECT().Filtering().Return(&types.FilteringStatus{}, nil)
+		cl.EXPECT().Services()
+		cl.EXPECT().Clients().Return(&types.Clients{}, nil)
+		cl.EXPECT().AccessList().Return(&types.AccessList{}, nil)
+		cl.EXPECT().DNSConfig().Return(&types.DNSConfig{}, nil)
+		cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+	}
+
 	Context("worker", func() {
 		Context("syncRewrites", func() {
 			var (
@@ -99,6 +147,38 @@ var _ = Describe("Sync", func() {
 				err := w.syncRewrites(l, &reO, cl)
 				Ω(err).ShouldNot(HaveOccurred())
 			})
+			It("should not remove an excluded rewrite entry", func() {
+				reO = []types.RewriteEntry{}
+				reR = append(reR, types.RewriteEntry{Domain: "printer.local", Answer: "1.2.3.4"})
+				w.cfg.Items.Rewrites.Exclude = []string{"*.LOCAL"}
+				cl.EXPECT().RewriteList().Return(&reR, nil)
+				cl.EXPECT().AddRewriteEntries()
+				cl.EXPECT().DeleteRewriteEntries(reR[0])
+				err := w.syncRewrites(l, &reO, cl)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+			It("should not remove a rewrite entry if deletes are disabled", func() {
+				reO = []types.RewriteEntry{}
+				deletes := false
+				w.cfg.Deletes = &deletes
+				cl.EXPECT().RewriteList().Return(&reR, nil)
+				cl.EXPECT().AddRewriteEntries()
+				err := w.syncRewrites(l, &reO, cl)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(w.skippedDeletes).Should(HaveLen(1))
+				Ω(w.skippedDeletes[0].Feature).Should(Equal(types.FeatureDNSRewrites))
+				Ω(w.skippedDeletes[0].Key).Should(Equal(reR[0].Key()))
+			})
+			It("should only sync the included rewrite entries", func() {
+				reO = append(reO, types.RewriteEntry{Domain: "nas.home", Answer: "1.2.3.4"})
+				reR = []types.RewriteEntry{}
+				w.cfg.Items.Rewrites.Include = []string{`/\.home$/`}
+				cl.EXPECT().RewriteList().Return(&reR, nil)
+				cl.EXPECT().AddRewriteEntries(reO[1])
+				cl.EXPECT().DeleteRewriteEntries()
+				err := w.syncRewrites(l, &reO, cl)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
 			It("should return error when error on RewriteList()", func() {
 				cl.EXPECT().RewriteList().Return(nil, te)
 				err := w.syncRewrites(l, &reO, cl)
@@ -164,6 +244,18 @@ var _ = Describe("Sync", func() {
 				err := w.syncClients(clO, cl)
 				Ω(err).ShouldNot(HaveOccurred())
 			})
+			It("should not delete a client if deletes of clients are disabled", func() {
+				clO.Clients = []types.Client{}
+				deletes := false
+				w.cfg.FeatureDeletes = &types.FeaturesOverride{ClientSettings: &deletes}
+				cl.EXPECT().Clients().Return(clR, nil)
+				cl.EXPECT().AddClients()
+				cl.EXPECT().UpdateClients()
+				err := w.syncClients(clO, cl)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(w.skippedDeletes).Should(HaveLen(1))
+				Ω(w.skippedDeletes[0].Key).Should(Equal(name))
+			})
 			It("should return error when error on Clients()", func() {
 				cl.EXPECT().Clients().Return(nil, te)
 				err := w.syncClients(clO, cl)
@@ -371,6 +463,33 @@ var _ = Describe("Sync", func() {
 				err := w.syncFilters(of, cl)
 				Ω(err).ShouldNot(HaveOccurred())
 			})
+			It("should keep the local user rules of the replica", func() {
+				of.UserRules = []string{"foo"}
+				rf.UserRules = []string{"bar", types.UserRulesLocalStart, "local", types.UserRulesLocalEnd}
+				cl.EXPECT().Filtering().Return(rf, nil)
+				cl.EXPECT().AddFilters(false)
+				cl.EXPECT().UpdateFilters(false)
+				cl.EXPECT().DeleteFilters(false)
+				cl.EXPECT().AddFilters(true)
+				cl.EXPECT().UpdateFilters(true)
+				cl.EXPECT().DeleteFilters(true)
+				cl.EXPECT().SetCustomRules(types.UserRules{"foo", types.UserRulesLocalStart, "local", types.UserRulesLocalEnd})
+				err := w.syncFilters(of, cl)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+			It("should not delete an excluded filter", func() {
+				rf.Filters = types.Filters{{URL: "https://local/list.txt", Name: "local"}}
+				w.cfg.Items.Filters.Exclude = []string{"local"}
+				cl.EXPECT().Filtering().Return(rf, nil)
+				cl.EXPECT().AddFilters(false)
+				cl.EXPECT().UpdateFilters(false)
+				cl.EXPECT().DeleteFilters(false)
+				cl.EXPECT().AddFilters(true)
+				cl.EXPECT().UpdateFilters(true)
+				cl.EXPECT().DeleteFilters(true)
+				err := w.syncFilters(of, cl)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
 			It("should have changed filtering config", func() {
 				of.Enabled = true
 				of.Interval = 123
@@ -456,6 +575,246 @@ var _ = Describe("Sync", func() {
 			})
 		})
 
+		Context("recorder", func() {
+			var rec *recorder
+			BeforeEach(func() {
+				rec = newRecorder(cl, false)
+			})
+			It("should apply and record the changes", func() {
+				c := types.Client{Name: "foo"}
+				cl.EXPECT().AddClients(c)
+				err := rec.AddClients(c)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(rec.changes).Should(HaveLen(1))
+				Ω(rec.changes[0].Action).Should(Equal(types.ActionAdd))
+				Ω(rec.changes[0].Key).Should(Equal("foo"))
+			})
+			It("should record the replica value before the change", func() {
+				before := types.Client{Name: "foo"}
+				after := types.Client{Name: "foo", Disallowed: true}
+				cl.EXPECT().Clients().Return(&types.Clients{Clients: []types.Client{before}}, nil)
+				cl.EXPECT().UpdateClients(after)
+				_, err := rec.Clients()
+				Ω(err).ShouldNot(HaveOccurred())
+				err = rec.UpdateClients(after)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(rec.changes).Should(HaveLen(1))
+				Ω(rec.changes[0].Before).Should(Equal(before))
+				Ω(rec.changes[0].After).Should(Equal(after))
+			})
+			It("should not record failed changes", func() {
+				cl.EXPECT().SetStatsConfig(1.0).Return(te)
+				err := rec.SetStatsConfig(1)
+				Ω(err).Should(HaveOccurred())
+				Ω(rec.changes).Should(BeEmpty())
+			})
+			It("should record the applied items of a failed batch", func() {
+				c1 := types.Client{Name: "foo"}
+				c2 := types.Client{Name: "bar"}
+				cl.EXPECT().AddClients(c1)
+				cl.EXPECT().AddClients(c2).Return(te)
+				Ω(rec.AddClients(c1, c2)).Should(Equal(te))
+				Ω(rec.changes).Should(Equal([]types.Change{
+					{Feature: types.FeatureClientSettings, Action: types.ActionAdd, Key: "foo", After: c1},
+				}))
+
+				cl.EXPECT().DeleteClients(c1)
+				Ω(rec.rollback(0).Reverted).Should(Equal(rec.changes))
+			})
+			It("should resolve the values before the changes from the snapshot", func() {
+				rec.useSnapshot(&types.Snapshot{StatsConfig: &types.IntervalConfig{Interval: 7}})
+				cl.EXPECT().SetStatsConfig(1.0)
+				Ω(rec.SetStatsConfig(1)).ShouldNot(HaveOccurred())
+				Ω(rec.changes[0].Before).Should(Equal(&types.IntervalConfig{Interval: 7}))
+
+				cl.EXPECT().SetStatsConfig(7.0)
+				rb := rec.rollback(0)
+				Ω(rb.Reverted).Should(HaveLen(1))
+				Ω(rb.Failed).Should(BeEmpty())
+			})
+			It("should roll back the changes in reverse order", func() {
+				c := types.Client{Name: "foo"}
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				cl.EXPECT().AddClients(c)
+				cl.EXPECT().DeleteRewriteEntries(re)
+				cl.EXPECT().SetStatsConfig(1.0)
+				Ω(rec.AddClients(c)).ShouldNot(HaveOccurred())
+				Ω(rec.DeleteRewriteEntries(re)).ShouldNot(HaveOccurred())
+				Ω(rec.SetStatsConfig(1)).ShouldNot(HaveOccurred())
+
+				add := cl.EXPECT().AddRewriteEntries(re)
+				cl.EXPECT().DeleteClients(c).Return(te).After(add)
+				rb := rec.rollback(0)
+				Ω(rb.Reverted).Should(Equal([]types.Change{rec.changes[1]}))
+				Ω(rb.Failed).Should(Equal([]types.RollbackFailure{
+					{Change: rec.changes[2], Error: "the value before the change is unknown"},
+					{Change: rec.changes[0], Error: te.Error()},
+				}))
+			})
+			It("should not roll back in dry-run mode", func() {
+				rec.dryRun = true
+				Ω(rec.AddClients(types.Client{Name: "foo"})).ShouldNot(HaveOccurred())
+				Ω(rec.rollback(0)).Should(BeNil())
+			})
+			It("should not apply changes in dry-run mode", func() {
+				rec.dryRun = true
+				err := rec.DeleteRewriteEntries(types.RewriteEntry{Domain: "foo"})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(rec.changes).Should(HaveLen(1))
+				Ω(rec.changes[0].Action).Should(Equal(types.ActionDelete))
+			})
+		})
+
+		Context("snapshot", func() {
+			var o *origin
+			BeforeEach(func() {
+				o = &origin{
+					status:           &types.Status{Version: minAghVersion, Protection: types.Protection{ProtectionEnabled: true}},
+					rewrites:         &types.RewriteEntries{{Domain: "foo", Answer: "bar"}},
+					services:         types.Services{"youtube"},
+					filters:          &types.FilteringStatus{UserRules: []string{"||foo^"}},
+					clients:          &types.Clients{Clients: []types.Client{{Name: "foo"}}},
+					queryLogConfig:   &types.QueryLogConfig{AnonymizeClientIP: true},
+					statsConfig:      &types.IntervalConfig{Interval: 7},
+					accessList:       &types.AccessList{},
+					dnsConfig:        &types.DNSConfig{},
+					dhcpServerConfig: &types.DHCPServerConfig{InterfaceName: "eth0"},
+					parental:         true,
+					safeBrowsing:     true,
+				}
+			})
+			It("should restore the origin from its snapshot", func() {
+				s := o.snapshot("https://origin")
+				Ω(s.Version).Should(Equal(types.SnapshotVersion))
+				Ω(s.Source).Should(Equal("https://origin"))
+				Ω(s.AdGuardHomeVersion).Should(Equal(minAghVersion))
+				Ω(s.Created).ShouldNot(BeNil())
+				Ω(originFromSnapshot(s)).Should(Equal(&origin{
+					status:           &types.Status{Version: minAghVersion, Protection: types.Protection{ProtectionEnabled: true}},
+					rewrites:         o.rewrites,
+					services:         o.services,
+					filters:          o.filters,
+					clients:          o.clients,
+					queryLogConfig:   o.queryLogConfig,
+					statsConfig:      o.statsConfig,
+					accessList:       o.accessList,
+					dnsConfig:        o.dnsConfig,
+					dhcpServerConfig: o.dhcpServerConfig,
+					parental:         true,
+					safeBrowsing:     true,
+				}))
+			})
+			It("should export the origin", func() {
+				w.cfg.Origin.URL = "https://origin"
+				expectOrigin(*o.rewrites...)
+				s, err := w.export()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(s.Source).Should(Equal("https://origin"))
+				Ω(s.Rewrites).Should(Equal(o.rewrites))
+			})
+			It("should write a backup if enabled", func() {
+				w.cfg.Backup = types.Backup{Dir: GinkgoT().TempDir()}
+				w.backup(o, "https://origin")
+				files, err := snapshot.NewStore(w.cfg.Backup).Files()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(files).Should(HaveLen(1))
+				s, err := snapshot.Load(files[0])
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(s.Source).Should(Equal("https://origin"))
+				Ω(s.Rewrites).Should(Equal(o.rewrites))
+			})
+		})
+
+		Context("transform", func() {
+			It("should transform the values of the replica", func() {
+				o := &origin{
+					rewrites:         &types.RewriteEntries{{Domain: "nas.home", Answer: "10.0.0.2"}},
+					dnsConfig:        &types.DNSConfig{Upstreams: []string{"10.0.0.1"}},
+					dhcpServerConfig: &types.DHCPServerConfig{V4: &types.V4ServerConfJSON{RangeStart: net.ParseIP("10.0.0.100")}},
+					clients:          &types.Clients{Clients: []types.Client{{Name: "pc", Ids: []string{"10.0.0.3"}}}},
+					filters:          &types.FilteringStatus{UserRules: []string{"||10.0.0.4^"}},
+				}
+				err := w.transform(o, types.AdGuardInstance{
+					Variables: map[string]string{"site": "1"},
+					Transformations: []types.Transformation{
+						{Find: `/^10\.0\./`, Replace: `10.{{ .site }}.`},
+						{Targets: []string{types.TargetUserRules}, Find: "||", Replace: "@@||"},
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω((*o.rewrites)[0]).Should(Equal(types.RewriteEntry{Domain: "nas.home", Answer: "10.1.0.2"}))
+				Ω(o.dnsConfig.Upstreams).Should(Equal([]string{"10.1.0.1"}))
+				Ω(o.dhcpServerConfig.V4.RangeStart.String()).Should(Equal("10.1.0.100"))
+				Ω(o.clients.Clients[0].Ids).Should(Equal([]string{"10.1.0.3"}))
+				Ω(o.filters.UserRules).Should(Equal(types.UserRules{"@@||10.0.0.4^"}))
+			})
+			It("should only transform the addresses of the dhcp leases", func() {
+				lease := types.Lease{HWAddr: "00:10:00:00:00:01", IP: net.ParseIP("10.0.0.10"), Hostname: "host-10-0-0-10"}
+				o := &origin{dhcpServerConfig: &types.DHCPServerConfig{StaticLeases: types.Leases{lease}}}
+				err := w.transform(o, types.AdGuardInstance{
+					Transformations: []types.Transformation{
+						{Find: "10", Replace: "20"},
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(o.dhcpServerConfig.StaticLeases[0].HWAddr).Should(Equal(lease.HWAddr))
+				Ω(o.dhcpServerConfig.StaticLeases[0].Hostname).Should(Equal(lease.Hostname))
+				Ω(o.dhcpServerConfig.StaticLeases[0].IP.String()).Should(Equal("20.0.0.20"))
+			})
+			It("should not change the origin without transformations", func() {
+				o := &origin{rewrites: &types.RewriteEntries{{Domain: "nas.home", Answer: "10.0.0.2"}}}
+				Ω(w.transform(o, types.AdGuardInstance{})).ShouldNot(HaveOccurred())
+				Ω((*o.rewrites)[0].Answer).Should(Equal("10.0.0.2"))
+			})
+		})
+
+		Context("restore", func() {
+			BeforeEach(func() {
+				w.cfg.Origin = types.AdGuardInstance{URL: "origin"}
+				w.cfg.Replicas = []types.AdGuardInstance{{URL: "foo"}, {URL: "bar", APIPath: "/api"}}
+			})
+			It("should resolve the targets", func() {
+				instances, err := restoreTargets(w.cfg, []string{TargetOrigin, "bar", TargetReplicas})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(instances).Should(HaveLen(3))
+				Ω(instances[0]).Should(Equal(types.AdGuardInstance{URL: "origin", APIPath: types.DefaultAPIPath}))
+				Ω(instances[1]).Should(Equal(types.AdGuardInstance{URL: "bar", APIPath: "/api"}))
+				Ω(instances[2].URL).Should(Equal("foo"))
+			})
+			It("should fail with an unknown target", func() {
+				_, err := restoreTargets(w.cfg, []string{"baz"})
+				Ω(err).Should(HaveOccurred())
+			})
+			It("should fail without targets", func() {
+				_, err := restoreTargets(w.cfg, nil)
+				Ω(err).Should(HaveOccurred())
+			})
+			It("should plan the changes of the snapshot in dry-run mode", func() {
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				o := originFromSnapshot(&types.Snapshot{
+					AdGuardHomeVersion: minAghVersion,
+					GeneralSettings:    &types.GeneralSettings{},
+					QueryLogConfig:     &types.QueryLogConfig{},
+					StatsConfig:        &types.IntervalConfig{},
+					Rewrites:           &types.RewriteEntries{re},
+					Services:           &types.Services{},
+					Filtering:          &types.FilteringStatus{},
+					Clients:            &types.Clients{},
+					AccessList:         &types.AccessList{},
+					DNSConfig:          &types.DNSConfig{},
+					DHCPServerConfig:   &types.DHCPServerConfig{},
+				})
+				expectReplica(&types.Status{Version: minAghVersion})
+				run := w.restore(o, "snapshot.yaml", []types.AdGuardInstance{{URL: "foo"}}, syncOptions{dryRun: true})
+				Ω(run.Origin).Should(Equal("snapshot.yaml"))
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+				Ω(run.Replicas).Should(HaveLen(1))
+				Ω(run.Replicas[0].Changes).Should(Equal([]types.Change{
+					{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd, Key: re.Key(), After: re},
+				}))
+			})
+		})
+
 		Context("sync", func() {
 			BeforeEach(func() {
 				w.cfg = &types.Config{
@@ -481,80 +840,734 @@ var _ = Describe("Sync", func() {
 				}
 			})
 			It("should have no changes", func() {
-				// origin
+				expectOrigin()
+				expectReplica(&types.Status{Version: minAghVersion})
+				run := w.sync(syncOptions{trigger: types.TriggerAPI})
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+				Ω(run.Trigger).Should(Equal(types.TriggerAPI))
+				Ω(run.End).ShouldNot(BeNil())
+				Ω(run.Replicas).Should(HaveLen(1))
+				Ω(run.Replicas[0].Version).Should(Equal(minAghVersion))
+				Ω(run.Replicas[0].Features).Should(HaveLen(11))
+				for _, f := range run.Replicas[0].Features {
+					Ω(f.Result).Should(Equal(types.ResultSuccess))
+				}
+				Ω(w.history()).Should(Equal([]*types.Run{run}))
+			})
+			It("should skip the features after a failed feature", func() {
+				w.cfg.Features.GeneralSettings = false
+				expectOrigin()
+
+				// replica, the config is read by the sync of the features if it can't be read before
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil).Times(2)
+				cl.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil).Times(2)
+				cl.EXPECT().RewriteList().Return(nil, te).Times(2)
+				run := w.sync(syncOptions{})
+				Ω(run.Result).Should(Equal(types.ResultFailed))
+				rr := run.Replicas[0]
+				Ω(rr.Result).Should(Equal(types.ResultFailed))
+				Ω(rr.Error).Should(Equal(te.Error()))
+				Ω(rr.Features).Should(HaveLen(10))
+				Ω(rr.Features[0]).Should(Equal(types.FeatureResult{Feature: types.FeatureQueryLogConfig, Result: types.ResultSuccess}))
+				Ω(rr.Features[2]).Should(Equal(types.FeatureResult{Feature: types.FeatureDNSRewrites, Result: types.ResultFailed, Error: te.Error()}))
+				Ω(rr.Features[3]).Should(Equal(types.FeatureResult{Feature: types.FeatureFilters, Result: types.ResultSkipped}))
+			})
+			It("should not start a second sync while running", func() {
+				run := w.startRun(syncOptions{})
+				Ω(run).ShouldNot(BeNil())
+				Ω(w.sync(syncOptions{})).Should(BeNil())
+				w.finishRun(run)
+				Ω(w.history()).Should(HaveLen(1))
+				Ω(w.history()[0].Result).Should(Equal(types.ResultSuccess))
+			})
+			It("should restore the history and fail the interrupted runs", func() {
+				Ω(w.state.SaveRun(&types.Run{ID: "done", Start: time.Now().Add(-time.Minute), Result: types.ResultSuccess})).ShouldNot(HaveOccurred())
+				Ω(w.state.SaveRun(&types.Run{ID: "interrupted", Start: time.Now(), Result: types.ResultRunning})).ShouldNot(HaveOccurred())
+				w.loadRuns()
+				h := w.history()
+				Ω(h).Should(HaveLen(2))
+				Ω(h[0].ID).Should(Equal("interrupted"))
+				Ω(h[0].Result).Should(Equal(types.ResultFailed))
+				Ω(h[0].Error).Should(Equal("interrupted by a restart"))
+				Ω(h[1].ID).Should(Equal("done"))
+				runs, err := w.state.Runs()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(runs[1].Result).Should(Equal(types.ResultFailed))
+			})
+			It("should compare a run with the previous finished run that was not a dry-run", func() {
+				first := w.startRun(syncOptions{})
+				w.finishRun(first)
+				w.finishRun(w.startRun(syncOptions{dryRun: true}))
+				run := w.startRun(syncOptions{})
+				Ω(w.previousRun(run).ID).Should(Equal(first.ID))
+				w.finishRun(run)
+				Ω(w.previousRun(first)).Should(BeNil())
+			})
+			It("should keep the latest runs only", func() {
+				for i := 0; i < runHistorySize+5; i++ {
+					w.finishRun(w.startRun(syncOptions{}))
+				}
+				h := w.history()
+				Ω(h).Should(HaveLen(runHistorySize))
+				Ω(h[0].Start).Should(BeTemporally(">=", h[runHistorySize-1].Start))
+			})
+			It("should only record the changes in dry-run mode", func() {
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				expectOrigin(re)
+
+				expectReplica(&types.Status{Version: minAghVersion, Protection: types.Protection{ProtectionEnabled: true}})
+				plan := w.sync(syncOptions{dryRun: true})
+				Ω(plan.DryRun).Should(BeTrue())
+				Ω(plan.Error).Should(BeEmpty())
+				Ω(plan.Replicas).Should(HaveLen(1))
+				Ω(plan.Replicas[0].Error).Should(BeEmpty())
+				Ω(plan.Replicas[0].Changes).Should(ConsistOf(
+					types.Change{Feature: types.FeatureGeneralSettings, Action: types.ActionUpdate, Key: "protection", Before: true, After: false},
+					types.Change{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd, Key: re.Key(), After: re},
+				))
+			})
+			It("should sync from the origin file", func() {
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n    answer: bar\n"), 0o600)).ShouldNot(HaveOccurred())
+
+				// replica
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
+				cl.EXPECT().AddRewriteEntries(re)
+				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				run := w.sync(syncOptions{})
+				Ω(run.Origin).Should(Equal(w.cfg.Origin.File))
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+				Ω(run.Replicas[0].Counts.Adds).Should(Equal(1))
+			})
+			It("should abort the sync if the delete guard is exceeded", func() {
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+				w.cfg.DeleteGuard.EmptyOrigin = true
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites: []\n"), 0o600)).ShouldNot(HaveOccurred())
+
+				// replica
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{{Domain: "foo", Answer: "bar"}}, nil)
+				run := w.sync(syncOptions{})
+				Ω(run.Result).Should(Equal(types.ResultFailed))
+				rr := run.Replicas[0]
+				Ω(rr.Result).Should(Equal(types.ResultAborted))
+				Ω(rr.Error).Should(ContainSubstring("delete guard for dns.rewrites"))
+				Ω(rr.Changes).Should(BeEmpty())
+			})
+			It("should plan all features once before applying any change if the delete guard is enabled", func() {
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}, ClientSettings: true}
+				w.cfg.DeleteGuard.EmptyOrigin = true
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n    answer: bar\nclients:\n  clients: []\n"), 0o600)).ShouldNot(HaveOccurred())
+
+				// replica, the rewrite is not added as the deletes of the clients exceed the delete guard
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
+				cl.EXPECT().Clients().Return(&types.Clients{Clients: []types.Client{{Name: "laptop"}}}, nil)
+				run := w.sync(syncOptions{})
+				rr := run.Replicas[0]
+				Ω(rr.Result).Should(Equal(types.ResultAborted))
+				Ω(rr.Error).Should(ContainSubstring("delete guard for clientSettings"))
+				Ω(rr.Changes).Should(BeEmpty())
+				Ω(rr.Rollback).Should(BeNil())
+			})
+			It("should delete the items if the delete guard is forced", func() {
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+				w.cfg.DeleteGuard.EmptyOrigin = true
+				w.cfg.DeleteGuard.Force = true
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites: []\n"), 0o600)).ShouldNot(HaveOccurred())
+
+				// replica
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{re}, nil)
+				cl.EXPECT().DeleteRewriteEntries(re)
+				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				run := w.sync(syncOptions{})
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+				Ω(run.Replicas[0].Counts.Deletes).Should(Equal(1))
+				Ω(run.OriginHash).ShouldNot(BeEmpty())
+				Ω(w.state.AppliedHash("foo")).ShouldNot(BeEmpty())
+				// the replica was changed, its fingerprint is read on the next sync
+				Ω(w.state.ReplicaFingerprint("foo")).Should(BeEmpty())
+			})
+			Context("unchanged replicas", func() {
+				var re types.RewriteEntry
+				BeforeEach(func() {
+					re = types.RewriteEntry{Domain: "foo", Answer: "bar"}
+					w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+					w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+					Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n    answer: bar\n"), 0o600)).ShouldNot(HaveOccurred())
+
+					// first sync without changes
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{re}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.sync(syncOptions{})
+					Ω(run.Replicas[0].Result).Should(Equal(types.ResultSuccess))
+					Ω(w.state.ReplicaFingerprint("foo")).ShouldNot(BeEmpty())
+				})
+				It("should skip the replica if neither the origin nor the replica changed", func() {
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{re}, nil)
+					run := w.sync(syncOptions{})
+					Ω(run.Result).Should(Equal(types.ResultSuccess))
+					Ω(run.Replicas[0].Result).Should(Equal(types.ResultSkipped))
+				})
+				It("should sync the replica if it changed", func() {
+					other := types.RewriteEntry{Domain: "other", Answer: "bar"}
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{re, other}, nil)
+					cl.EXPECT().DeleteRewriteEntries(other)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.sync(syncOptions{})
+					Ω(run.Replicas[0].Result).Should(Equal(types.ResultSuccess))
+					Ω(run.Replicas[0].Counts.Deletes).Should(Equal(1))
+				})
+				It("should sync the replica if forced", func() {
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{re}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.sync(syncOptions{force: true})
+					Ω(run.Replicas[0].Result).Should(Equal(types.ResultSuccess))
+				})
+				It("should sync the replica if its sync config changed", func() {
+					w.cfg.Items.Rewrites.Exclude = []string{"*.local"}
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{re}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.sync(syncOptions{})
+					Ω(run.Replicas[0].Result).Should(Equal(types.ResultSuccess))
+				})
+			})
+			It("should sync a replica if its dns config changed since the last sync", func() {
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{ServerConfig: true}}
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("dnsConfig:\n  upstream_dns: [1.1.1.1]\n"), 0o600)).ShouldNot(HaveOccurred())
+				synced := &types.DNSConfig{Upstreams: []string{"1.1.1.1"}}
+
+				// first sync without changes
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().DNSConfig().Return(synced, nil)
+				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				Ω(w.sync(syncOptions{}).Replicas[0].Result).Should(Equal(types.ResultSuccess))
+
+				// unchanged
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().DNSConfig().Return(synced, nil)
+				Ω(w.sync(syncOptions{}).Replicas[0].Result).Should(Equal(types.ResultSkipped))
+
+				// the upstreams were changed on the replica
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().DNSConfig().Return(&types.DNSConfig{Upstreams: []string{"8.8.8.8"}}, nil)
+				cl.EXPECT().SetDNSConfig(gm.Any())
+				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				run := w.sync(syncOptions{})
+				Ω(run.Replicas[0].Result).Should(Equal(types.ResultSuccess))
+				Ω(run.Replicas[0].Counts.Updates).Should(Equal(1))
+			})
+			Context("watch", func() {
+				var (
+					ws *watcher
+					t0 time.Time
+				)
+				writeOrigin := func(answer string) {
+					Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n    answer: "+answer+"\n"), 0o600)).ShouldNot(HaveOccurred())
+				}
+				BeforeEach(func() {
+					w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+					w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+					w.cfg.Watch.Debounce = time.Minute
+					writeOrigin("bar")
+					// the origin config of the last sync restored from the state
+					fp, err := w.originFingerprint()
+					Ω(err).ShouldNot(HaveOccurred())
+					w.runs = []*types.Run{{Result: types.ResultSuccess, OriginHash: fp}}
+					ws = &watcher{synced: w.lastOriginHash()}
+					t0 = time.Now()
+					Ω(w.poll(ws, t0)).Should(BeNil())
+					Ω(ws.synced).Should(Equal(fp))
+				})
+				It("should sync with the first poll if the origin config of the last sync is unknown", func() {
+					w.runs = nil
+					ws = &watcher{}
+
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{{Domain: "foo", Answer: "bar"}}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.poll(ws, t0)
+					Ω(run).ShouldNot(BeNil())
+					Ω(run.Trigger).Should(Equal(types.TriggerWatch))
+					Ω(ws.synced).Should(Equal(run.OriginHash))
+
+					Ω(w.poll(ws, t0.Add(time.Minute))).Should(BeNil())
+				})
+				It("should poll an origin instance by the status and the enabled features only", func() {
+					w.cfg.Origin = types.AdGuardInstance{URL: "https://origin"}
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{{Domain: "foo", Answer: "bar"}}, nil)
+					Ω(w.originFingerprint()).Should(Equal(ws.synced))
+				})
+				It("should not sync if the origin did not change", func() {
+					Ω(w.poll(ws, t0.Add(2*time.Minute))).Should(BeNil())
+					Ω(ws.pending).Should(BeEmpty())
+				})
+				It("should sync once the changed origin config is stable for the debounce time", func() {
+					writeOrigin("baz")
+					Ω(w.poll(ws, t0)).Should(BeNil())
+					Ω(w.poll(ws, t0.Add(30*time.Second))).Should(BeNil())
+
+					// a further change restarts the debounce time
+					writeOrigin("qux")
+					Ω(w.poll(ws, t0.Add(45*time.Second))).Should(BeNil())
+					Ω(w.poll(ws, t0.Add(time.Minute))).Should(BeNil())
+
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{{Domain: "foo", Answer: "qux"}}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.poll(ws, t0.Add(105*time.Second))
+					Ω(run).ShouldNot(BeNil())
+					Ω(run.Trigger).Should(Equal(types.TriggerWatch))
+					Ω(run.Replicas[0].Result).Should(Equal(types.ResultSuccess))
+					Ω(ws.synced).Should(Equal(run.OriginHash))
+					Ω(ws.pending).Should(BeEmpty())
+
+					Ω(w.poll(ws, t0.Add(5*time.Minute))).Should(BeNil())
+				})
+				It("should retry a failed sync with the next poll", func() {
+					writeOrigin("baz")
+					Ω(w.poll(ws, t0)).Should(BeNil())
+
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(nil, te)
+					run := w.poll(ws, t0.Add(2*time.Minute))
+					Ω(run).ShouldNot(BeNil())
+					Ω(run.Result).Should(Equal(types.ResultFailed))
+					Ω(run.OriginHash).Should(BeEmpty())
+					Ω(ws.pending).ShouldNot(BeEmpty())
+
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{{Domain: "foo", Answer: "baz"}}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run = w.poll(ws, t0.Add(3*time.Minute))
+					Ω(run).ShouldNot(BeNil())
+					Ω(run.Result).Should(Equal(types.ResultSuccess))
+					Ω(ws.synced).Should(Equal(run.OriginHash))
+				})
+				It("should not treat a sync of selected replicas as synced origin config", func() {
+					writeOrigin("baz")
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{{Domain: "foo", Answer: "baz"}}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.sync(syncOptions{replicas: []string{w.cfg.Replica.URL}})
+					Ω(run.Result).Should(Equal(types.ResultSuccess))
+					Ω(run.OriginHash).Should(BeEmpty())
+
+					Ω(w.poll(ws, t0)).Should(BeNil())
+					Ω(ws.pending).ShouldNot(BeEmpty())
+				})
+				It("should not sync a change synced by another trigger", func() {
+					writeOrigin("baz")
+					Ω(w.poll(ws, t0)).Should(BeNil())
+					w.runs = append(w.runs, &types.Run{Result: types.ResultSuccess, OriginHash: ws.pending})
+					Ω(w.poll(ws, t0.Add(2*time.Minute))).Should(BeNil())
+					Ω(ws.pending).Should(BeEmpty())
+				})
+				It("should sync the change with the next poll if a sync is running", func() {
+					writeOrigin("baz")
+					Ω(w.poll(ws, t0)).Should(BeNil())
+					w.running = true
+					Ω(w.poll(ws, t0.Add(2*time.Minute))).Should(BeNil())
+					Ω(ws.pending).ShouldNot(BeEmpty())
+				})
+			})
+			Context("webhook", func() {
+				var now time.Time
+				body := []byte(`{"replicas":["foo"],"features":["dns.rewrites"]}`)
+				request := func(ts time.Time, signature string) *httptest.ResponseRecorder {
+					rec := httptest.NewRecorder()
+					c, _ := gin.CreateTestContext(rec)
+					c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/webhook", bytes.NewReader(body))
+					c.Request.Header.Set(headerWebhookTimestamp, strconv.FormatInt(ts.Unix(), 10))
+					c.Request.Header.Set(headerWebhookSignature, signature)
+					w.handleWebhook(c)
+					return rec
+				}
+				BeforeEach(func() {
+					now = time.Now()
+					w.cfg.API.Webhook.Secret = "secret"
+				})
+				It("should accept a signature only once", func() {
+					ts := strconv.FormatInt(now.Unix(), 10)
+					Ω(w.verifySignature(ts, sign("secret", now, body), body, now)).ShouldNot(HaveOccurred())
+					Ω(w.verifySignature(ts, sign("secret", now, body), body, now)).Should(MatchError("signature already used"))
+				})
+				It("should reject an invalid signature", func() {
+					ts := strconv.FormatInt(now.Unix(), 10)
+					Ω(w.verifySignature(ts, sign("other", now, body), body, now)).Should(MatchError("invalid signature"))
+					Ω(w.verifySignature(ts, sign("secret", now, body), []byte("{}"), now)).Should(MatchError("invalid signature"))
+					Ω(w.verifySignature("", sign("secret", now, body), body, now)).Should(HaveOccurred())
+				})
+				It("should reject an expired timestamp", func() {
+					old := now.Add(-10 * time.Minute)
+					err := w.verifySignature(strconv.FormatInt(old.Unix(), 10), sign("secret", old, body), body, now)
+					Ω(err).Should(HaveOccurred())
+					Ω(err.Error()).Should(ContainSubstring("outside the max age"))
+				})
+				It("should validate the selection", func() {
+					opts, err := w.webhookOptions(webhookRequest{Replicas: []string{"foo"}, Features: []string{types.FeatureDNSRewrites}})
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(opts.trigger).Should(Equal(types.TriggerWebhook))
+					_, err = w.webhookOptions(webhookRequest{Replicas: []string{"bar"}})
+					Ω(err).Should(MatchError(`unknown replica "bar"`))
+					_, err = w.webhookOptions(webhookRequest{Features: []string{"foo"}})
+					Ω(err).Should(MatchError(`unknown feature "foo"`))
+					w.cfg.MultiMaster.Enabled = true
+					_, err = w.webhookOptions(webhookRequest{Replicas: []string{"foo"}})
+					Ω(err).Should(HaveOccurred())
+				})
+				It("should sync only the selected features", func() {
+					opts := syncOptions{features: []string{types.FeatureDNSRewrites, types.FeatureServices}}
+					w.cfg.Features.Services = false
+					f := opts.selectFeatures(w.cfg.Features)
+					for _, feature := range types.AllFeatures {
+						Ω(f.Enabled(feature)).Should(Equal(feature == types.FeatureDNSRewrites), feature)
+					}
+				})
+				It("should reject an unsigned request", func() {
+					Ω(request(now, "").Code).Should(Equal(http.StatusUnauthorized))
+				})
+				It("should not start a sync if a sync is running", func() {
+					w.running = true
+					Ω(request(now, sign("secret", now, body)).Code).Should(Equal(http.StatusConflict))
+				})
+			})
+			It("should roll back the changes of a failed sync", func() {
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}, ClientSettings: true}
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n    answer: bar\nclients:\n  clients:\n    - name: laptop\n      ids: [192.168.1.2]\n"), 0o600)).ShouldNot(HaveOccurred())
+
+				// replica
 				cl.EXPECT().Host()
 				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
-				cl.EXPECT().Parental()
-				cl.EXPECT().SafeSearch()
-				cl.EXPECT().SafeBrowsing()
 				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
-				cl.EXPECT().Services()
-				cl.EXPECT().Filtering().Return(&types.FilteringStatus{}, nil)
 				cl.EXPECT().Clients().Return(&types.Clients{}, nil)
-				cl.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil)
-				cl.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil)
-				cl.EXPECT().AccessList().Return(&types.AccessList{}, nil)
-				cl.EXPECT().DNSConfig().Return(&types.DNSConfig{}, nil)
+				cl.EXPECT().AddRewriteEntries(re)
 				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				cl.EXPECT().AddClients(types.Client{Name: "laptop", Ids: []string{"192.168.1.2"}}).Return(te)
+				// rollback
+				cl.EXPECT().DeleteRewriteEntries(re)
+				run := w.sync(syncOptions{})
+				rr := run.Replicas[0]
+				Ω(rr.Result).Should(Equal(types.ResultFailed))
+				Ω(rr.Rollback).ShouldNot(BeNil())
+				Ω(rr.Rollback.Reverted).Should(Equal([]types.Change{
+					{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd, Key: re.Key(), After: re},
+				}))
+				Ω(rr.Rollback.Failed).Should(BeEmpty())
+			})
+			It("should sync the remaining features after a failed feature if continueOnError is enabled", func() {
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}, ClientSettings: true}
+				w.cfg.ContinueOnError = true
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n    answer: bar\n  - domain: baz\n    answer: bar\nclients:\n  clients: []\n"), 0o600)).ShouldNot(HaveOccurred())
+				foo := types.RewriteEntry{Domain: "foo", Answer: "bar"}
 
 				// replica
 				cl.EXPECT().Host()
 				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
-				cl.EXPECT().Parental()
-				cl.EXPECT().SafeSearch()
-				cl.EXPECT().SafeBrowsing()
-				cl.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil)
-				cl.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil)
 				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
-				cl.EXPECT().AddRewriteEntries()
-				cl.EXPECT().DeleteRewriteEntries()
-				cl.EXPECT().Filtering().Return(&types.FilteringStatus{}, nil)
-				cl.EXPECT().AddFilters(false)
-				cl.EXPECT().UpdateFilters(false)
-				cl.EXPECT().DeleteFilters(false)
-				cl.EXPECT().AddFilters(true)
-				cl.EXPECT().UpdateFilters(true)
-				cl.EXPECT().DeleteFilters(true)
-				cl.EXPECT().Services()
 				cl.EXPECT().Clients().Return(&types.Clients{}, nil)
-				cl.EXPECT().AddClients()
-				cl.EXPECT().UpdateClients()
-				cl.EXPECT().DeleteClients()
-				cl.EXPECT().AccessList().Return(&types.AccessList{}, nil)
-				cl.EXPECT().DNSConfig().Return(&types.DNSConfig{}, nil)
+				cl.EXPECT().AddRewriteEntries(foo)
+				cl.EXPECT().AddRewriteEntries(types.RewriteEntry{Domain: "baz", Answer: "bar"}).Return(te)
+				// rollback of the failed feature
+				cl.EXPECT().DeleteRewriteEntries(foo)
 				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
-				cl.EXPECT().AddDHCPStaticLeases().Return(nil)
-				cl.EXPECT().DeleteDHCPStaticLeases().Return(nil)
-				w.sync()
+				run := w.sync(syncOptions{})
+				Ω(run.Result).Should(Equal(types.ResultPartial))
+				rr := run.Replicas[0]
+				Ω(rr.Result).Should(Equal(types.ResultPartial))
+				Ω(rr.Error).Should(Equal(te.Error()))
+				Ω(rr.FailedFeatures).Should(Equal([]string{types.FeatureDNSRewrites}))
+				Ω(rr.Features).Should(Equal([]types.FeatureResult{
+					{Feature: types.FeatureDNSRewrites, Result: types.ResultFailed, Error: te.Error(), Counts: types.ChangeCounts{Adds: 1}},
+					{Feature: types.FeatureClientSettings, Result: types.ResultSuccess},
+				}))
+				Ω(rr.Rollback).ShouldNot(BeNil())
+				Ω(rr.Rollback.Reverted).Should(Equal([]types.Change{
+					{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd, Key: foo.Key(), After: foo},
+				}))
+			})
+			Context("failover", func() {
+				BeforeEach(func() {
+					w.cfg.Origin = types.AdGuardInstance{URL: "https://origin1"}
+					w.cfg.Origins = []types.AdGuardInstance{{URL: "https://origin2"}}
+					w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+					w.createClient = func(instance types.AdGuardInstance) (client.Client, error) {
+						if instance.URL == "https://origin1" {
+							return nil, te
+						}
+						return cl, nil
+					}
+				})
+				It("should fail over to the next origin", func() {
+					expectOrigin()
+
+					// replica
+					cl.EXPECT().Host()
+					cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+					cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
+					cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+					run := w.sync(syncOptions{})
+					Ω(run.Result).Should(Equal(types.ResultSuccess))
+					Ω(run.Origin).Should(Equal("https://origin2"))
+				})
+				It("should refuse to fail over to an origin with too many differences", func() {
+					w.cfg.Failover.MaxDifferences = 1
+					Ω(w.state.SetLastOrigin((&origin{
+						status:           &types.Status{Version: minAghVersion},
+						rewrites:         &types.RewriteEntries{{Domain: "a", Answer: "1"}, {Domain: "b", Answer: "2"}},
+						filters:          &types.FilteringStatus{},
+						clients:          &types.Clients{},
+						queryLogConfig:   &types.QueryLogConfig{},
+						statsConfig:      &types.IntervalConfig{},
+						accessList:       &types.AccessList{},
+						dnsConfig:        &types.DNSConfig{},
+						dhcpServerConfig: &types.DHCPServerConfig{},
+					}).snapshot("https://origin1"))).ShouldNot(HaveOccurred())
+
+					expectOrigin()
+
+					run := w.sync(syncOptions{})
+					Ω(run.Result).Should(Equal(types.ResultFailed))
+					Ω(run.Error).Should(ContainSubstring(te.Error()))
+					Ω(run.Error).Should(ContainSubstring("origin https://origin2 has 2 differences to the last known origin config"))
+					Ω(run.Replicas).Should(BeEmpty())
+				})
+			})
+			Context("multi-master", func() {
+				var (
+					ocl, rcl *clientmock.MockClient
+					a, b     types.RewriteEntry
+				)
+				fetch := func(c *clientmock.MockClient, rewrites types.RewriteEntries, clients ...types.Client) {
+					c.EXPECT().Host().Times(2)
+					c.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil).Times(2)
+					c.EXPECT().Parental()
+					c.EXPECT().SafeSearch()
+					c.EXPECT().SafeBrowsing()
+					c.EXPECT().RewriteList().Return(&rewrites, nil)
+					c.EXPECT().Services()
+					c.EXPECT().Filtering().Return(&types.FilteringStatus{}, nil)
+					c.EXPECT().Clients().Return(&types.Clients{Clients: clients}, nil)
+					c.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil)
+					c.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil)
+					c.EXPECT().AccessList().Return(&types.AccessList{}, nil)
+					c.EXPECT().DNSConfig().Return(&types.DNSConfig{}, nil)
+					c.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil).Times(2)
+				}
+				BeforeEach(func() {
+					ocl = clientmock.NewMockClient(mockCtrl)
+					rcl = clientmock.NewMockClient(mockCtrl)
+					a = types.RewriteEntry{Domain: "a", Answer: "1"}
+					b = types.RewriteEntry{Domain: "b", Answer: "2"}
+					w.cfg.Origin = types.AdGuardInstance{URL: "https://origin"}
+					w.cfg.Replica = types.AdGuardInstance{URL: "https://replica"}
+					w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}}
+					w.cfg.MultiMaster.Enabled = true
+					w.createClient = func(instance types.AdGuardInstance) (client.Client, error) {
+						if instance.URL == "https://origin" {
+							return ocl, nil
+						}
+						return rcl, nil
+					}
+
+					synced := types.RewriteEntries{a}
+					items := snapshot.ItemsOf(&types.Snapshot{Rewrites: &synced}, nil)
+					for _, url := range []string{"https://origin", "https://replica"} {
+						ms := &snapshot.MergeState{}
+						ms.Observe(items, time.Now())
+						ms.Synced(items, nil, nil)
+						Ω(w.state.SetMergeState(url, ms)).ShouldNot(HaveOccurred())
+					}
+				})
+				It("should sync the changes of a replica to the origin", func() {
+					fetch(ocl, types.RewriteEntries{a})
+					ocl.EXPECT().RewriteList().Return(&types.RewriteEntries{a}, nil)
+					ocl.EXPECT().AddRewriteEntries(b)
+					fetch(rcl, types.RewriteEntries{a, b})
+					rcl.EXPECT().RewriteList().Return(&types.RewriteEntries{a, b}, nil)
+
+					run := w.sync(syncOptions{})
+					Ω(run.Result).Should(Equal(types.ResultSuccess))
+					Ω(run.Conflicts).Should(BeEmpty())
+					Ω(run.Replicas).Should(HaveLen(2))
+					Ω(run.Replicas[0].Replica).Should(Equal("https://origin"))
+					ms, err := w.state.MergeState("https://origin")
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(ms.Base[snapshot.SectionRewrites]).Should(HaveKey(b.Key()))
+				})
+				It("should log the unavailable replica with the run id", func() {
+					fetch(ocl, types.RewriteEntries{a})
+					rcl.EXPECT().Host()
+					rcl.EXPECT().Status().Return(nil, te)
+					ocl.EXPECT().RewriteList().Return(&types.RewriteEntries{a}, nil)
+
+					run := w.sync(syncOptions{})
+					Ω(run.Replicas).Should(HaveLen(2))
+					Ω(run.Replicas[1].Result).Should(Equal(types.ResultFailed))
+					var fields []map[string]interface{}
+					for _, e := range log.Entries() {
+						if e.Message == "Error reading replica, it is not synced" {
+							fields = append(fields, e.Fields)
+						}
+					}
+					Ω(fields).ShouldNot(BeEmpty())
+					Ω(fields[len(fields)-1]).Should(HaveKeyWithValue("run_id", run.ID))
+					Ω(fields[len(fields)-1]).Should(HaveKeyWithValue("replica", "https://replica"))
+				})
+				It("should exclude the rewrites of unresolved conflicts by domain", func() {
+					ew := w.withExcludes([]types.Conflict{
+						{Section: snapshot.SectionRewrites, Key: a.Key()},
+						{Section: snapshot.SectionRewrites, Key: "b"},
+						{Section: snapshot.SectionRewrites, Key: "c#3", Winner: "https://origin"},
+					})
+					Ω(ew.cfg.Items.Rewrites.Exclude).Should(Equal([]string{"/^a$/", "/^b$/"}))
+				})
+				It("should not sync the items of manual conflicts", func() {
+					w.cfg.Features = types.Features{ClientSettings: true}
+					w.cfg.MultiMaster.Resolution = types.ResolutionManual
+					laptop := types.Client{Name: "laptop"}
+					items := snapshot.ItemsOf(&types.Snapshot{Clients: &types.Clients{Clients: []types.Client{laptop}}}, nil)
+					for _, url := range []string{"https://origin", "https://replica"} {
+						ms := &snapshot.MergeState{}
+						ms.Observe(items, time.Now())
+						ms.Synced(items, nil, nil)
+						Ω(w.state.SetMergeState(url, ms)).ShouldNot(HaveOccurred())
+					}
+					oc := types.Client{Name: "laptop", FilteringEnabled: true}
+					rc := types.Client{Name: "laptop", ParentalEnabled: true}
+
+					fetch(ocl, nil, oc)
+					ocl.EXPECT().Clients().Return(&types.Clients{Clients: []types.Client{oc}}, nil)
+					fetch(rcl, nil, rc)
+					rcl.EXPECT().Clients().Return(&types.Clients{Clients: []types.Client{rc}}, nil)
+
+					run := w.sync(syncOptions{})
+					Ω(run.Result).Should(Equal(types.ResultSuccess))
+					Ω(run.Conflicts).Should(HaveLen(1))
+					Ω(run.Conflicts[0].Key).Should(Equal("laptop"))
+					Ω(run.Conflicts[0].Winner).Should(BeEmpty())
+					ms, err := w.state.MergeState("https://replica")
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(ms.Base).Should(Equal(items))
+				})
+			})
+			It("should fail with an invalid origin file", func() {
+				w.cfg.Origin.File = filepath.Join(GinkgoT().TempDir(), "origin.yaml")
+				w.cfg.Features = types.Features{DNS: types.DNS{Rewrites: true}, Services: true}
+				Ω(os.WriteFile(w.cfg.Origin.File, []byte("rewrites:\n  - domain: foo\n"), 0o600)).ShouldNot(HaveOccurred())
+				run := w.sync(syncOptions{})
+				Ω(run.Result).Should(Equal(types.ResultFailed))
+				Ω(run.Error).Should(ContainSubstring("services"))
+				Ω(run.Error).Should(ContainSubstring("rewrites[0].answer: must not be empty"))
+				Ω(run.Replicas).Should(BeEmpty())
+			})
+			It("should only report the drift of a replica in detect mode", func() {
+				re := types.RewriteEntry{Domain: "foo", Answer: "bar"}
+				w.cfg.Replica.Mode = types.ModeDetect
+				expectOrigin(re)
+
+				expectReplica(&types.Status{Version: minAghVersion})
+				run := w.sync(syncOptions{})
+				Ω(run.DryRun).Should(BeFalse())
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+				Ω(run.HasDrift()).Should(BeTrue())
+				rr := run.Replicas[0]
+				Ω(rr.Mode).Should(Equal(types.ModeDetect))
+				Ω(rr.Drift).Should(BeTrue())
+				Ω(rr.Changes).Should(Equal([]types.Change{
+					{Feature: types.FeatureDNSRewrites, Action: types.ActionAdd, Key: re.Key(), After: re},
+				}))
+			})
+			It("should only sync the features of the replica", func() {
+				w.cfg.Replica.Features = &types.FeaturesOverride{}
+				for _, f := range types.AllFeatures {
+					w.cfg.Replica.Features.Set(f, f == types.FeatureDNSRewrites)
+				}
+				expectOrigin()
+
+				// replica
+				cl.EXPECT().Host()
+				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
+				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
+				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				run := w.sync(syncOptions{})
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+				Ω(run.Replicas[0].Features).Should(Equal([]types.FeatureResult{
+					{Feature: types.FeatureDNSRewrites, Result: types.ResultSuccess},
+				}))
+				Ω(w.cfg.Features.Services).Should(BeTrue())
+			})
+			It("should sync the replicas in parallel", func() {
+				w.cfg.Replica = types.AdGuardInstance{}
+				w.cfg.Replicas = []types.AdGuardInstance{{URL: "foo"}, {URL: "bar"}, {URL: "baz"}}
+				w.cfg.MaxParallelReplicas = 2
+				expectOrigin()
+
+				// replicas
+				cl.EXPECT().Host().Times(3)
+				cl.EXPECT().Status().Return(nil, te).Times(3)
+				plan := w.sync(syncOptions{})
+				Ω(plan.Replicas).Should(HaveLen(3))
+				for _, rp := range plan.Replicas {
+					Ω(rp.Error).Should(Equal(te.Error()))
+				}
 			})
 			It("origin version is too small", func() {
 				// origin
 				cl.EXPECT().Host()
 				cl.EXPECT().Status().Return(&types.Status{Version: "v0.106.9"}, nil)
-				w.sync()
+				w.sync(syncOptions{})
 			})
 			It("replica version is too small", func() {
-				// origin
-				cl.EXPECT().Host()
-				cl.EXPECT().Status().Return(&types.Status{Version: minAghVersion}, nil)
-				cl.EXPECT().Parental()
-				cl.EXPECT().SafeSearch()
-				cl.EXPECT().SafeBrowsing()
-				cl.EXPECT().RewriteList().Return(&types.RewriteEntries{}, nil)
-				cl.EXPECT().Services()
-				cl.EXPECT().Filtering().Return(&types.FilteringStatus{}, nil)
-				cl.EXPECT().Clients().Return(&types.Clients{}, nil)
-				cl.EXPECT().QueryLogConfig().Return(&types.QueryLogConfig{}, nil)
-				cl.EXPECT().StatsConfig().Return(&types.IntervalConfig{}, nil)
-				cl.EXPECT().AccessList().Return(&types.AccessList{}, nil)
-				cl.EXPECT().DNSConfig().Return(&types.DNSConfig{}, nil)
-				cl.EXPECT().DHCPServerConfig().Return(&types.DHCPServerConfig{}, nil)
+				expectOrigin()
 
 				// replica
 				cl.EXPECT().Host()
 				cl.EXPECT().Status().Return(&types.Status{Version: "v0.106.9"}, nil)
-				w.sync()
+				w.sync(syncOptions{})
 			})
 		})
 	})
 })
+
+// rewriteList returns the rewrites as list, an empty list if there are none
+func rewriteList(rewrites []types.RewriteEntry) *types.RewriteEntries {
+	list := append(types.RewriteEntries{}, rewrites...)
+	return &list
+}
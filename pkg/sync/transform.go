@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"encoding/json"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+)
+
+// dhcpLeaseFields the fields of the dhcp leases that are not addresses, they identify the device and are not transformed
+var dhcpLeaseFields = map[string]bool{"mac": true, "hostname": true, "expires": true}
+
+// transform applies the transformations of the replica to its copy of the origin
+func (w *worker) transform(o *origin, replica types.AdGuardInstance) error {
+	r, err := replica.Replacer()
+	if err != nil || r == nil {
+		return err
+	}
+
+	if o.rewrites != nil {
+		if err := replaceValues(o.rewrites, r, types.TargetRewrites, nil); err != nil {
+			return err
+		}
+	}
+	if o.dnsConfig != nil {
+		if err := replaceValues(o.dnsConfig, r, types.TargetDNSConfig, nil); err != nil {
+			return err
+		}
+	}
+	if o.dhcpServerConfig != nil {
+		if err := replaceValues(o.dhcpServerConfig, r, types.TargetDHCPServerConfig, dhcpLeaseFields); err != nil {
+			return err
+		}
+	}
+	if o.clients != nil {
+		if err := replaceValues(&o.clients.Clients, r, types.TargetClients, nil); err != nil {
+			return err
+		}
+	}
+	if o.filters != nil {
+		if err := replaceValues(&o.filters.UserRules, r, types.TargetUserRules, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceValues replaces all string values of the config as they are sent to the API, except the values of the
+// skipped keys
+func replaceValues(config interface{}, r *types.Replacer, target string, skip map[string]bool) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(replaceStrings(v, r, target, skip)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, config)
+}
+
+func replaceStrings(v interface{}, r *types.Replacer, target string, skip map[string]bool) interface{} {
+	switch value := v.(type) {
+	case string:
+		return r.Replace(target, value)
+	case []interface{}:
+		for i := range value {
+			value[i] = replaceStrings(value[i], r, target, skip)
+		}
+	case map[string]interface{}:
+		for k := range value {
+			if !skip[k] {
+				value[k] = replaceStrings(value[k], r, target, skip)
+			}
+		}
+	}
+	return v
+}
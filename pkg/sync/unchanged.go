@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"go.uber.org/zap"
+)
+
+// syncHash returns the hash of the origin config as applied to the replica, including the sync config of the replica
+func (w *worker) syncHash(o *origin, replica types.AdGuardInstance) string {
+	deletes := map[string]bool{}
+	for _, f := range types.AllFeatures {
+		deletes[f] = w.cfg.DeletesEnabled(f)
+	}
+	return hash(struct {
+		Origin        string
+		Features      types.Features
+		Items         types.Items
+		Deletes       map[string]bool
+		InterfaceName string
+	}{
+		Origin:        snapshot.Hash(o.snapshot("")),
+		Features:      w.cfg.Features,
+		Items:         w.cfg.Items,
+		Deletes:       deletes,
+		InterfaceName: replica.InterfaceName,
+	})
+}
+
+// replicaFingerprint returns the hash of the config of the enabled features of the replica and its version
+func replicaFingerprint(config *types.Snapshot) string {
+	return hash(struct {
+		Version string
+		Config  string
+	}{
+		Version: config.AdGuardHomeVersion,
+		Config:  snapshot.Hash(config),
+	})
+}
+
+// unchanged returns true if the origin config was already applied to the replica and the replica did not change since.
+// The config of the replica is read anyway, so a skip saves the writes and the comparison, not the reads.
+func (w *worker) unchanged(rl *zap.SugaredLogger, config *types.Snapshot, replica types.AdGuardInstance, syncHash string) bool {
+	applied, err := w.state.AppliedHash(replica.URL)
+	if err != nil {
+		rl.With("error", err).Error("Error reading the applied origin hash")
+		return false
+	}
+	if applied != syncHash {
+		return false
+	}
+	last, err := w.state.ReplicaFingerprint(replica.URL)
+	if err != nil {
+		rl.With("error", err).Error("Error reading the replica fingerprint")
+		return false
+	}
+	return last != "" && last == replicaFingerprint(config)
+}
+
+// saveApplied saves the applied origin hash and the fingerprint of the replica. The fingerprint of the config read
+// before the sync is only valid if no change was applied, otherwise the next sync compares all features once more.
+func (w *worker) saveApplied(rl *zap.SugaredLogger, rc *recorder, config *types.Snapshot, replica types.AdGuardInstance, syncHash string) {
+	var fingerprint string
+	if len(rc.changes) == 0 && config != nil {
+		fingerprint = replicaFingerprint(config)
+	}
+	if err := w.state.SetAppliedHash(replica.URL, syncHash); err != nil {
+		rl.With("error", err).Error("Error saving the applied origin hash")
+	}
+	if err := w.state.SetReplicaFingerprint(replica.URL, fingerprint); err != nil {
+		rl.With("error", err).Error("Error saving the replica fingerprint")
+	}
+}
+
+func hash(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
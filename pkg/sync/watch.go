@@ -0,0 +1,158 @@
+package sync
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/snapshot"
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"go.uber.org/multierr"
+)
+
+// watcher the state of the watch mode
+type watcher struct {
+	// synced the fingerprint of the origin config of the last sync
+	synced string
+	// pending the fingerprint of the changed origin config that was not synced yet
+	pending string
+	// changed when the pending origin config was seen first
+	changed time.Time
+}
+
+// watch polls the origin at the watch interval and syncs the replicas when the origin config changed
+func (w *worker) watch() {
+	l.With("interval", w.cfg.Watch.Interval, "debounce", w.cfg.Watch.Debounce).Info("Watching origin for changes")
+	// the origin config of the last sync restored from the state, the replicas are synced with the first poll if unknown
+	ws := &watcher{synced: w.lastOriginHash()}
+	ticker := time.NewTicker(w.cfg.Watch.Interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		w.poll(ws, now)
+	}
+}
+
+// poll reads the fingerprint of the origin config and syncs the replicas, if it changed and did not change again
+// within the debounce time. If the origin config of the last sync is not known, the replicas are synced immediately.
+// A failed sync is retried with the next poll. Returns the run if a sync was started.
+func (w *worker) poll(ws *watcher, now time.Time) *types.Run {
+	fp, err := w.originFingerprint()
+	if err != nil {
+		l.With("error", err).Warn("Error polling origin")
+		return nil
+	}
+	if fp == ws.synced || fp == w.lastOriginHash() {
+		// unchanged or synced by another trigger
+		ws.synced, ws.pending = fp, ""
+		return nil
+	}
+	if ws.synced != "" {
+		if fp != ws.pending {
+			l.With("debounce", w.cfg.Watch.Debounce).Info("Origin config changed")
+			ws.pending, ws.changed = fp, now
+		}
+		if now.Sub(ws.changed) < w.cfg.Watch.Debounce {
+			return nil
+		}
+	} else {
+		l.Info("Origin config of the last sync is unknown, syncing the replicas")
+	}
+	run := w.sync(syncOptions{trigger: types.TriggerWatch})
+	if run == nil {
+		// a sync is already running, the change is synced with the next poll
+		return nil
+	}
+	if run.Result != types.ResultSuccess {
+		// the failed sync is retried with the next poll
+		l.With("result", run.Result, "run_id", run.ID).Warn("Sync of the changed origin config failed")
+		return run
+	}
+	ws.synced, ws.pending = fp, ""
+	return run
+}
+
+// originFingerprint returns the hash of the config of the origin file or of the first available origin candidate.
+// The status and all enabled features are read, without logging or recording metrics. This is the read load of a sync,
+// the interval of an origin instance is therefore limited to the MinWatchInterval.
+func (w *worker) originFingerprint() (string, error) {
+	features := w.cfg.AnyFeatures()
+	if w.cfg.Origin.File != "" {
+		o, err := w.readOrigin()
+		if err != nil {
+			return "", err
+		}
+		return originHash(o.snapshot(w.cfg.Origin.File), features), nil
+	}
+
+	candidates := w.cfg.OriginCandidates()
+	if len(candidates) == 0 {
+		return "", errors.New("no origin configured")
+	}
+	var errs error
+	for _, c := range candidates {
+		oc, err := w.createClient(c)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		status, err := oc.Status()
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		s, err := readSnapshot(oc, status, features)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		return originHash(s, features), nil
+	}
+	return "", errs
+}
+
+// originHash returns the hash of the sections of the enabled features of the origin config
+func originHash(s *types.Snapshot, f types.Features) string {
+	c := *s
+	if !f.GeneralSettings {
+		c.GeneralSettings = nil
+	}
+	if !f.QueryLogConfig {
+		c.QueryLogConfig = nil
+	}
+	if !f.StatsConfig {
+		c.StatsConfig = nil
+	}
+	if !f.DNS.Rewrites {
+		c.Rewrites = nil
+	}
+	if !f.Filters {
+		c.Filtering = nil
+	}
+	if !f.Services {
+		c.Services = nil
+	}
+	if !f.ClientSettings {
+		c.Clients = nil
+	}
+	if !f.DNS.AccessLists {
+		c.AccessList = nil
+	}
+	if !f.DNS.ServerConfig {
+		c.DNSConfig = nil
+	}
+	if !f.DHCP.ServerConfig && !f.DHCP.StaticLeases {
+		c.DHCPServerConfig = nil
+	}
+	return snapshot.Hash(&c)
+}
+
+// lastOriginHash returns the hash of the origin config of the latest successful run that was not a dry-run
+func (w *worker) lastOriginHash() string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for i := len(w.runs) - 1; i >= 0; i-- {
+		if r := w.runs[i]; !r.DryRun && r.Result == types.ResultSuccess && r.OriginHash != "" {
+			return r.OriginHash
+		}
+	}
+	return ""
+}
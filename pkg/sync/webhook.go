@@ -0,0 +1,183 @@
+package sync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bakito/adguardhome-sync/pkg/types"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// headerWebhookTimestamp the header of the unix timestamp the webhook payload was signed at
+	headerWebhookTimestamp = "X-Sync-Timestamp"
+	// headerWebhookSignature the header of the signature of the webhook payload, "sha256=" followed by the hex encoded
+	// HMAC-SHA256 of the timestamp, a dot and the body
+	headerWebhookSignature = "X-Sync-Signature"
+
+	defaultWebhookMaxAge = 5 * time.Minute
+	maxWebhookBodySize   = 1 << 20
+	signaturePrefix      = "sha256="
+)
+
+// webhookRequest the optional payload of the webhook
+type webhookRequest struct {
+	// Replicas the urls of the replicas to sync, all replicas if empty
+	Replicas []string `json:"replicas,omitempty"`
+	// Features the names of the features to sync, all enabled features if empty
+	Features []string `json:"features,omitempty"`
+	DryRun   bool     `json:"dryRun,omitempty"`
+	Force    bool     `json:"force,omitempty"`
+}
+
+// usedSignatures the signatures of the accepted webhook requests within their max age, to reject replays
+type usedSignatures struct {
+	mutex      sync.Mutex
+	signatures map[string]time.Time
+}
+
+// use registers the signature, returns false if it was already used
+func (u *usedSignatures) use(signature string, now time.Time, maxAge time.Duration) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.signatures == nil {
+		u.signatures = map[string]time.Time{}
+	}
+	for s, t := range u.signatures {
+		if now.Sub(t) > maxAge {
+			delete(u.signatures, s)
+		}
+	}
+	if _, ok := u.signatures[signature]; ok {
+		return false
+	}
+	u.signatures[signature] = now
+	return true
+}
+
+// sign returns the signature of the webhook payload signed with the secret at the timestamp
+func sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10) + "."))
+	_, _ = mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature and the age of the timestamp of a webhook request
+func (w *worker) verifySignature(timestamp string, signature string, body []byte, now time.Time) error {
+	maxAge := w.cfg.API.Webhook.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultWebhookMaxAge
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	ts := time.Unix(sec, 0)
+	if age := now.Sub(ts); age > maxAge || age < -maxAge {
+		return fmt.Errorf("timestamp %s is outside the max age of %s", ts.UTC().Format(time.RFC3339), maxAge)
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(w.cfg.API.Webhook.Secret, ts, body))) {
+		return errors.New("invalid signature")
+	}
+	if !w.webhookSignatures.use(signature, now, 2*maxAge) {
+		return errors.New("signature already used")
+	}
+	return nil
+}
+
+// webhookOptions returns the options of the sync requested by the webhook
+func (w *worker) webhookOptions(req webhookRequest) (syncOptions, error) {
+	opts := syncOptions{
+		trigger:  types.TriggerWebhook,
+		dryRun:   req.DryRun,
+		force:    req.Force,
+		replicas: req.Replicas,
+		features: req.Features,
+	}
+	if w.cfg.MultiMaster.Enabled && (len(req.Replicas) > 0 || len(req.Features) > 0) {
+		return opts, errors.New("the replicas and features can't be selected in the multi-master mode")
+	}
+	replicas := w.cfg.UniqueReplicas()
+	for _, url := range req.Replicas {
+		if !containsReplica(replicas, url) {
+			return opts, fmt.Errorf("unknown replica %q", url)
+		}
+	}
+	for _, f := range req.Features {
+		if !containsFeature(f) {
+			return opts, fmt.Errorf("unknown feature %q", f)
+		}
+	}
+	return opts, nil
+}
+
+func containsReplica(replicas []types.AdGuardInstance, url string) bool {
+	for _, r := range replicas {
+		if r.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFeature(feature string) bool {
+	for _, f := range types.AllFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *worker) handleWebhook(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodySize))
+	if err != nil {
+		c.String(http.StatusRequestEntityTooLarge, "error reading body: %v", err)
+		return
+	}
+	wl := l.With("remote_addr", c.Request.RemoteAddr)
+	err = w.verifySignature(c.GetHeader(headerWebhookTimestamp), c.GetHeader(headerWebhookSignature), body, time.Now())
+	if err != nil {
+		wl.With("error", err).Warn("Rejected webhook request")
+		c.String(http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req webhookRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			c.String(http.StatusBadRequest, "invalid payload: %v", err)
+			return
+		}
+	}
+	opts, err := w.webhookOptions(req)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wl.With("replicas", req.Replicas, "features", req.Features, "dry_run", opts.dryRun, "force", opts.force).
+		Info("Starting sync from webhook")
+	run := w.startRun(opts)
+	if run == nil {
+		c.String(http.StatusConflict, "sync already running")
+		return
+	}
+	if opts.dryRun {
+		w.execute(run, opts)
+		c.JSON(http.StatusOK, run)
+		return
+	}
+	go w.execute(run, opts)
+	c.JSON(http.StatusAccepted, map[string]string{"id": run.ID})
+}
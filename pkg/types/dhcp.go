@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"net"
 	"time"
-
-	"github.com/jinzhu/copier"
 )
 
 // DHCPServerConfig dhcp server config
@@ -22,7 +20,8 @@ type DHCPServerConfig struct {
 // Clone the config
 func (c *DHCPServerConfig) Clone() *DHCPServerConfig {
 	clone := &DHCPServerConfig{}
-	_ = copier.Copy(c, clone)
+	b, _ := json.Marshal(c)
+	_ = json.Unmarshal(b, clone)
 	return clone
 }
 
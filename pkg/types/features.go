@@ -4,6 +4,46 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// FeatureGeneralSettings general settings feature name
+	FeatureGeneralSettings = "generalSettings"
+	// FeatureQueryLogConfig query log config feature name
+	FeatureQueryLogConfig = "queryLogConfig"
+	// FeatureStatsConfig stats config feature name
+	FeatureStatsConfig = "statsConfig"
+	// FeatureClientSettings client settings feature name
+	FeatureClientSettings = "clientSettings"
+	// FeatureServices services feature name
+	FeatureServices = "services"
+	// FeatureFilters filters feature name
+	FeatureFilters = "filters"
+	// FeatureDHCPServerConfig dhcp server config feature name
+	FeatureDHCPServerConfig = "dhcp.serverConfig"
+	// FeatureDHCPStaticLeases dhcp static leases feature name
+	FeatureDHCPStaticLeases = "dhcp.staticLeases"
+	// FeatureDNSServerConfig dns server config feature name
+	FeatureDNSServerConfig = "dns.serverConfig"
+	// FeatureDNSAccessLists dns access lists feature name
+	FeatureDNSAccessLists = "dns.accessLists"
+	// FeatureDNSRewrites dns rewrites feature name
+	FeatureDNSRewrites = "dns.rewrites"
+)
+
+// AllFeatures the names of all features
+var AllFeatures = []string{
+	FeatureGeneralSettings,
+	FeatureQueryLogConfig,
+	FeatureStatsConfig,
+	FeatureClientSettings,
+	FeatureServices,
+	FeatureFilters,
+	FeatureDHCPServerConfig,
+	FeatureDHCPStaticLeases,
+	FeatureDNSServerConfig,
+	FeatureDNSAccessLists,
+	FeatureDNSRewrites,
+}
+
 // Features feature flags
 type Features struct {
 	DNS             DNS  `json:"dns" yaml:"dns"`
@@ -29,6 +69,147 @@ type DNS struct {
 	Rewrites     bool `json:"rewrites" yaml:"rewrites"`
 }
 
+// Enabled returns true if the feature with the given name is enabled
+func (f *Features) Enabled(feature string) bool {
+	switch feature {
+	case FeatureGeneralSettings:
+		return f.GeneralSettings
+	case FeatureQueryLogConfig:
+		return f.QueryLogConfig
+	case FeatureStatsConfig:
+		return f.StatsConfig
+	case FeatureClientSettings:
+		return f.ClientSettings
+	case FeatureServices:
+		return f.Services
+	case FeatureFilters:
+		return f.Filters
+	case FeatureDHCPServerConfig:
+		return f.DHCP.ServerConfig
+	case FeatureDHCPStaticLeases:
+		return f.DHCP.StaticLeases
+	case FeatureDNSServerConfig:
+		return f.DNS.ServerConfig
+	case FeatureDNSAccessLists:
+		return f.DNS.AccessLists
+	case FeatureDNSRewrites:
+		return f.DNS.Rewrites
+	}
+	return false
+}
+
+// Merge returns a copy of the features with the set flags of the override
+func (f *Features) Merge(o *FeaturesOverride) Features {
+	merged := *f
+	if o == nil {
+		return merged
+	}
+	override(&merged.GeneralSettings, o.GeneralSettings)
+	override(&merged.QueryLogConfig, o.QueryLogConfig)
+	override(&merged.StatsConfig, o.StatsConfig)
+	override(&merged.ClientSettings, o.ClientSettings)
+	override(&merged.Services, o.Services)
+	override(&merged.Filters, o.Filters)
+	override(&merged.DHCP.ServerConfig, o.DHCP.ServerConfig)
+	override(&merged.DHCP.StaticLeases, o.DHCP.StaticLeases)
+	override(&merged.DNS.ServerConfig, o.DNS.ServerConfig)
+	override(&merged.DNS.AccessLists, o.DNS.AccessLists)
+	override(&merged.DNS.Rewrites, o.DNS.Rewrites)
+	return merged
+}
+
+func override(value *bool, o *bool) {
+	if o != nil {
+		*value = *o
+	}
+}
+
+// FeaturesOverride feature flags of a replica, unset flags fall back to the global features
+type FeaturesOverride struct {
+	DNS             DNSOverride  `json:"dns,omitempty" yaml:"dns,omitempty"`
+	DHCP            DHCPOverride `json:"dhcp,omitempty" yaml:"dhcp,omitempty"`
+	GeneralSettings *bool        `json:"generalSettings,omitempty" yaml:"generalSettings,omitempty"`
+	QueryLogConfig  *bool        `json:"queryLogConfig,omitempty" yaml:"queryLogConfig,omitempty"`
+	StatsConfig     *bool        `json:"statsConfig,omitempty" yaml:"statsConfig,omitempty"`
+	ClientSettings  *bool        `json:"clientSettings,omitempty" yaml:"clientSettings,omitempty"`
+	Services        *bool        `json:"services,omitempty" yaml:"services,omitempty"`
+	Filters         *bool        `json:"filters,omitempty" yaml:"filters,omitempty"`
+}
+
+// DHCPOverride dhcp feature flags of a replica
+type DHCPOverride struct {
+	ServerConfig *bool `json:"serverConfig,omitempty" yaml:"serverConfig,omitempty"`
+	StaticLeases *bool `json:"staticLeases,omitempty" yaml:"staticLeases,omitempty"`
+}
+
+// DNSOverride dns feature flags of a replica
+type DNSOverride struct {
+	AccessLists  *bool `json:"accessLists,omitempty" yaml:"accessLists,omitempty"`
+	ServerConfig *bool `json:"serverConfig,omitempty" yaml:"serverConfig,omitempty"`
+	Rewrites     *bool `json:"rewrites,omitempty" yaml:"rewrites,omitempty"`
+}
+
+// Set the flag of the feature with the given name
+func (o *FeaturesOverride) Set(feature string, value bool) {
+	v := &value
+	switch feature {
+	case FeatureGeneralSettings:
+		o.GeneralSettings = v
+	case FeatureQueryLogConfig:
+		o.QueryLogConfig = v
+	case FeatureStatsConfig:
+		o.StatsConfig = v
+	case FeatureClientSettings:
+		o.ClientSettings = v
+	case FeatureServices:
+		o.Services = v
+	case FeatureFilters:
+		o.Filters = v
+	case FeatureDHCPServerConfig:
+		o.DHCP.ServerConfig = v
+	case FeatureDHCPStaticLeases:
+		o.DHCP.StaticLeases = v
+	case FeatureDNSServerConfig:
+		o.DNS.ServerConfig = v
+	case FeatureDNSAccessLists:
+		o.DNS.AccessLists = v
+	case FeatureDNSRewrites:
+		o.DNS.Rewrites = v
+	}
+}
+
+// Get the flag of the feature with the given name, nil if not set
+func (o *FeaturesOverride) Get(feature string) *bool {
+	if o == nil {
+		return nil
+	}
+	switch feature {
+	case FeatureGeneralSettings:
+		return o.GeneralSettings
+	case FeatureQueryLogConfig:
+		return o.QueryLogConfig
+	case FeatureStatsConfig:
+		return o.StatsConfig
+	case FeatureClientSettings:
+		return o.ClientSettings
+	case FeatureServices:
+		return o.Services
+	case FeatureFilters:
+		return o.Filters
+	case FeatureDHCPServerConfig:
+		return o.DHCP.ServerConfig
+	case FeatureDHCPStaticLeases:
+		return o.DHCP.StaticLeases
+	case FeatureDNSServerConfig:
+		return o.DNS.ServerConfig
+	case FeatureDNSAccessLists:
+		return o.DNS.AccessLists
+	case FeatureDNSRewrites:
+		return o.DNS.Rewrites
+	}
+	return nil
+}
+
 // LogDisabled log all disabled features
 func (f *Features) LogDisabled(l *zap.SugaredLogger) {
 	var features []string
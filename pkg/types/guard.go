@@ -0,0 +1,63 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DeleteGuard limits of the items deleted by a sync on a replica, a sync exceeding a limit is aborted
+type DeleteGuard struct {
+	// MaxCount the maximum number of items of a feature deleted on a replica; if 0 the number is not limited
+	MaxCount int `json:"maxCount,omitempty" yaml:"maxCount,omitempty"`
+	// MaxPercent the maximum percentage of the items of a feature deleted on a replica; if 0 it is not limited
+	MaxPercent int `json:"maxPercent,omitempty" yaml:"maxPercent,omitempty"`
+	// EmptyOrigin abort if the origin has no items of a feature, but the replica has
+	EmptyOrigin bool `json:"emptyOrigin,omitempty" yaml:"emptyOrigin,omitempty"`
+	// Force disables the guard for intentional mass deletions
+	Force bool `json:"force,omitempty" yaml:"force,omitempty"`
+}
+
+// Enabled true if any limit is configured and the guard is not forced
+func (g *DeleteGuard) Enabled() bool {
+	return !g.Force && (g.MaxCount > 0 || g.MaxPercent > 0 || g.EmptyOrigin)
+}
+
+// Validate checks the limits
+func (g *DeleteGuard) Validate() error {
+	if g.MaxCount < 0 {
+		return errors.New("deleteGuard.maxCount must not be negative")
+	}
+	if g.MaxPercent < 0 || g.MaxPercent > 100 {
+		return errors.New("deleteGuard.maxPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+// Check returns a DeleteGuardError if the deletes of a feature exceed a limit
+func (g *DeleteGuard) Check(feature string, originItems int, replicaItems int, deletes int) error {
+	if !g.Enabled() || deletes == 0 {
+		return nil
+	}
+	var reason string
+	switch {
+	case g.EmptyOrigin && originItems == 0:
+		reason = fmt.Sprintf("the origin has no items, but %d would be deleted", deletes)
+	case g.MaxCount > 0 && deletes > g.MaxCount:
+		reason = fmt.Sprintf("%d items would be deleted, more than the maximum of %d", deletes, g.MaxCount)
+	case g.MaxPercent > 0 && deletes*100 > g.MaxPercent*replicaItems:
+		reason = fmt.Sprintf("%d of %d items would be deleted, more than %d%%", deletes, replicaItems, g.MaxPercent)
+	default:
+		return nil
+	}
+	return &DeleteGuardError{Feature: feature, Reason: reason}
+}
+
+// DeleteGuardError the deletes of a feature exceed a limit of the delete guard
+type DeleteGuardError struct {
+	Feature string
+	Reason  string
+}
+
+func (e *DeleteGuardError) Error() string {
+	return fmt.Sprintf("sync aborted by the delete guard for %s: %s", e.Feature, e.Reason)
+}
@@ -0,0 +1,206 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// UserRulesLocalStart comment marking the start of a section of user rules that is not synchronized
+	UserRulesLocalStart = "! adguardhome-sync:local-start"
+	// UserRulesLocalEnd comment marking the end of a section of user rules that is not synchronized
+	UserRulesLocalEnd = "! adguardhome-sync:local-end"
+)
+
+// Items include and exclude rules for the items of the features
+type Items struct {
+	Rewrites     ItemRules `json:"rewrites,omitempty" yaml:"rewrites,omitempty"`
+	Clients      ItemRules `json:"clients,omitempty" yaml:"clients,omitempty"`
+	Filters      ItemRules `json:"filters,omitempty" yaml:"filters,omitempty"`
+	StaticLeases ItemRules `json:"staticLeases,omitempty" yaml:"staticLeases,omitempty"`
+}
+
+// Merge returns the items with the rules of both
+func (i *Items) Merge(o *Items) Items {
+	merged := *i
+	if o == nil {
+		return merged
+	}
+	merged.Rewrites = i.Rewrites.merge(o.Rewrites)
+	merged.Clients = i.Clients.merge(o.Clients)
+	merged.Filters = i.Filters.merge(o.Filters)
+	merged.StaticLeases = i.StaticLeases.merge(o.StaticLeases)
+	return merged
+}
+
+// Validate checks that all patterns can be compiled
+func (i *Items) Validate() error {
+	for name, r := range map[string]ItemRules{
+		"rewrites":     i.Rewrites,
+		"clients":      i.Clients,
+		"filters":      i.Filters,
+		"staticLeases": i.StaticLeases,
+	} {
+		if _, err := r.Matcher(); err != nil {
+			return fmt.Errorf("invalid %s item rule: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ItemRules include and exclude patterns of the items of a feature. A pattern is either a glob
+// with '*' and '?' wildcards or a regular expression enclosed in slashes (e.g. /^guest-.*$/)
+type ItemRules struct {
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+}
+
+func (r ItemRules) merge(o ItemRules) ItemRules {
+	return ItemRules{
+		Include: append(append([]string{}, r.Include...), o.Include...),
+		Exclude: append(append([]string{}, r.Exclude...), o.Exclude...),
+	}
+}
+
+// Matcher compiles the patterns, returns nil if no pattern is defined
+func (r ItemRules) Matcher() (*ItemMatcher, error) {
+	if len(r.Include) == 0 && len(r.Exclude) == 0 {
+		return nil, nil
+	}
+	m := &ItemMatcher{}
+	var err error
+	if m.include, err = compilePatterns(r.Include); err != nil {
+		return nil, err
+	}
+	if m.exclude, err = compilePatterns(r.Exclude); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		expr := p
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			expr = p[1 : len(p)-1]
+		} else {
+			expr = "(?i)^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(p)) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// ItemMatcher decides if an item is managed by the sync
+type ItemMatcher struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Managed returns true if any of the values is included and none is excluded.
+// A nil matcher manages all items.
+func (m *ItemMatcher) Managed(values ...string) bool {
+	if m == nil {
+		return true
+	}
+	if len(m.include) > 0 && !matchAny(m.include, values) {
+		return false
+	}
+	return !matchAny(m.exclude, values)
+}
+
+func matchAny(patterns []*regexp.Regexp, values []string) bool {
+	for _, re := range patterns {
+		for _, v := range values {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Select returns the rewrites managed by the matcher, matched by domain
+func (rwe *RewriteEntries) Select(m *ItemMatcher) *RewriteEntries {
+	if m == nil || rwe == nil {
+		return rwe
+	}
+	selected := RewriteEntries{}
+	for _, re := range *rwe {
+		if m.Managed(re.Domain) {
+			selected = append(selected, re)
+		}
+	}
+	return &selected
+}
+
+// Select returns the filters managed by the matcher, matched by url and name
+func (f Filters) Select(m *ItemMatcher) Filters {
+	if m == nil {
+		return f
+	}
+	var selected Filters
+	for _, fi := range f {
+		if m.Managed(fi.URL, fi.Name) {
+			selected = append(selected, fi)
+		}
+	}
+	return selected
+}
+
+// Select returns the clients managed by the matcher, matched by name and tags
+func (clients *Clients) Select(m *ItemMatcher) *Clients {
+	if m == nil || clients == nil {
+		return clients
+	}
+	selected := *clients
+	selected.Clients = nil
+	for _, cl := range clients.Clients {
+		if m.Managed(append([]string{cl.Name}, cl.Tags...)...) {
+			selected.Clients = append(selected.Clients, cl)
+		}
+	}
+	return &selected
+}
+
+// Select returns the leases managed by the matcher, matched by mac and hostname
+func (l Leases) Select(m *ItemMatcher) Leases {
+	if m == nil {
+		return l
+	}
+	var selected Leases
+	for _, le := range l {
+		if m.Managed(le.HWAddr, le.Hostname) {
+			selected = append(selected, le)
+		}
+	}
+	return selected
+}
+
+// Split returns the synchronized rules and the local sections of the rules
+func (ur UserRules) Split() (UserRules, UserRules) {
+	var synced UserRules
+	var local UserRules
+	inLocal := false
+	for _, r := range ur {
+		switch {
+		case strings.TrimSpace(r) == UserRulesLocalStart:
+			inLocal = true
+			local = append(local, r)
+		case strings.TrimSpace(r) == UserRulesLocalEnd:
+			inLocal = false
+			local = append(local, r)
+		case inLocal:
+			local = append(local, r)
+		default:
+			synced = append(synced, r)
+		}
+	}
+	return synced, local
+}
@@ -0,0 +1,61 @@
+package types
+
+import "fmt"
+
+// ConflictResolution the policy to resolve an item changed differently on multiple instances
+type ConflictResolution string
+
+const (
+	// ResolutionPreferOrigin the value of the origin is used
+	ResolutionPreferOrigin ConflictResolution = "prefer-origin"
+	// ResolutionNewestWins the change that was detected last is used
+	ResolutionNewestWins ConflictResolution = "newest-wins"
+	// ResolutionManual the conflict is not resolved, the instances keep their values
+	ResolutionManual ConflictResolution = "manual"
+)
+
+// Valid returns true if the resolution is known, an empty resolution is valid and means prefer-origin
+func (r ConflictResolution) Valid() bool {
+	switch r {
+	case "", ResolutionPreferOrigin, ResolutionNewestWins, ResolutionManual:
+		return true
+	}
+	return false
+}
+
+// MultiMaster configuration of the multi-master mode
+type MultiMaster struct {
+	Enabled    bool               `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Resolution ConflictResolution `json:"resolution,omitempty" yaml:"resolution,omitempty"`
+}
+
+// Validate checks the resolution and that the instances can be merged. The values of transformed replicas can't be
+// merged back, as they differ from the values of the other instances.
+func (m MultiMaster) Validate(originFile string, replicas []AdGuardInstance) error {
+	if !m.Resolution.Valid() {
+		return fmt.Errorf("invalid conflict resolution %q", m.Resolution)
+	}
+	if !m.Enabled {
+		return nil
+	}
+	if originFile != "" {
+		return fmt.Errorf("multi-master mode can't be used with an origin file")
+	}
+	for _, r := range replicas {
+		if len(r.Transformations) > 0 {
+			return fmt.Errorf("multi-master mode can't be used with the transformations of replica %s", r.URL)
+		}
+	}
+	return nil
+}
+
+// Conflict an item changed differently on multiple instances since their last sync
+type Conflict struct {
+	Section string `json:"section"`
+	Key     string `json:"key"`
+	// Values the changed values by instance, nil if the item was deleted
+	Values     map[string]interface{} `json:"values"`
+	Resolution ConflictResolution     `json:"resolution"`
+	// Winner the instance whose value is used, empty if the conflict is not resolved
+	Winner string `json:"winner,omitempty"`
+}
@@ -0,0 +1,106 @@
+package types
+
+import (
+	"fmt"
+)
+
+// NotificationType the type of a notifier
+type NotificationType string
+
+const (
+	// NotificationWebhook posts the event as json, or the rendered body template, to a url
+	NotificationWebhook NotificationType = "webhook"
+	// NotificationChat posts the message to a chat-style incoming webhook (slack, mattermost, rocket.chat, ...)
+	NotificationChat NotificationType = "chat"
+	// NotificationSMTP sends the message as email
+	NotificationSMTP NotificationType = "smtp"
+)
+
+// EventType the type of a sync event
+type EventType string
+
+const (
+	// EventFailure a sync run failed for the origin or any replica
+	EventFailure EventType = "failure"
+	// EventRecovery a sync run succeeded after a failed run
+	EventRecovery EventType = "recovery"
+	// EventDrift a replica in detect mode differs from the origin
+	EventDrift EventType = "drift"
+	// EventSuccess a sync run succeeded
+	EventSuccess EventType = "success"
+)
+
+// Notification configuration of a notifier
+type Notification struct {
+	// Name the name of the notifier used in the logs, the type if empty
+	Name string           `json:"name,omitempty" yaml:"name,omitempty"`
+	Type NotificationType `json:"type" yaml:"type"`
+	// Events the events to notify, failure and recovery if empty
+	Events []EventType `json:"events,omitempty" yaml:"events,omitempty"`
+	// Repeat notify every failed run and every run with drift, not only the first one
+	Repeat bool `json:"repeat,omitempty" yaml:"repeat,omitempty"`
+
+	// URL the url of the webhook
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Headers the additional http headers of the webhook request
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Template the go template of the webhook body or the chat and email message, rendered with the event
+	Template string `json:"template,omitempty" yaml:"template,omitempty"`
+
+	SMTP SMTP `json:"smtp,omitempty" yaml:"smtp,omitempty"`
+}
+
+// SMTP configuration of the email notifier
+type SMTP struct {
+	Host     string   `json:"host,omitempty" yaml:"host,omitempty"`
+	Port     int      `json:"port,omitempty" yaml:"port,omitempty"`
+	Username string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string   `json:"password,omitempty" yaml:"password,omitempty"`
+	From     string   `json:"from,omitempty" yaml:"from,omitempty"`
+	To       []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// DisplayName the name of the notifier, the type if no name is configured
+func (n *Notification) DisplayName() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return string(n.Type)
+}
+
+// Notifies returns true if the event is notified
+func (n *Notification) Notifies(event EventType) bool {
+	if len(n.Events) == 0 {
+		return event == EventFailure || event == EventRecovery
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the type, the events and the required settings of the type
+func (n *Notification) Validate() error {
+	for _, e := range n.Events {
+		switch e {
+		case EventFailure, EventRecovery, EventDrift, EventSuccess:
+		default:
+			return fmt.Errorf("notification %s: invalid event %q", n.DisplayName(), e)
+		}
+	}
+	switch n.Type {
+	case NotificationWebhook, NotificationChat:
+		if n.URL == "" {
+			return fmt.Errorf("notification %s: url is required", n.DisplayName())
+		}
+	case NotificationSMTP:
+		if n.SMTP.Host == "" || n.SMTP.From == "" || len(n.SMTP.To) == 0 {
+			return fmt.Errorf("notification %s: smtp host, from and to are required", n.DisplayName())
+		}
+	default:
+		return fmt.Errorf("notification %s: invalid type %q", n.DisplayName(), n.Type)
+	}
+	return nil
+}
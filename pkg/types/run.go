@@ -0,0 +1,196 @@
+package types
+
+import "time"
+
+// Action the kind of change applied to a replica
+type Action string
+
+const (
+	// ActionAdd an item is added
+	ActionAdd Action = "add"
+	// ActionUpdate an item or a config is updated
+	ActionUpdate Action = "update"
+	// ActionDelete an item is deleted
+	ActionDelete Action = "delete"
+)
+
+// Trigger the trigger of a sync run
+type Trigger string
+
+const (
+	// TriggerStartup sync run on startup
+	TriggerStartup Trigger = "startup"
+	// TriggerCron sync run by the cron job
+	TriggerCron Trigger = "cron"
+	// TriggerAPI sync run triggered via API
+	TriggerAPI Trigger = "api"
+	// TriggerCLI sync run triggered via command line
+	TriggerCLI Trigger = "cli"
+	// TriggerWatch sync run triggered by a change of the origin config in watch mode
+	TriggerWatch Trigger = "watch"
+	// TriggerWebhook sync run triggered via the signed webhook
+	TriggerWebhook Trigger = "webhook"
+)
+
+// Result the result of a sync run, replica or feature
+type Result string
+
+const (
+	// ResultRunning the sync is still running
+	ResultRunning Result = "running"
+	// ResultSuccess the sync was successful
+	ResultSuccess Result = "success"
+	// ResultPartial the sync was successful for some replicas only
+	ResultPartial Result = "partial"
+	// ResultFailed the sync failed
+	ResultFailed Result = "failed"
+	// ResultSkipped the sync was not executed
+	ResultSkipped Result = "skipped"
+	// ResultAborted the sync was aborted by the delete guard
+	ResultAborted Result = "aborted"
+)
+
+// Change a single change of a replica
+type Change struct {
+	Feature string      `json:"feature"`
+	Action  Action      `json:"action"`
+	Key     string      `json:"key,omitempty"`
+	Before  interface{} `json:"before,omitempty"`
+	After   interface{} `json:"after,omitempty"`
+}
+
+// ChangeCounts the number of changes by action
+type ChangeCounts struct {
+	Adds    int `json:"adds"`
+	Updates int `json:"updates"`
+	Deletes int `json:"deletes"`
+}
+
+// Add count the change
+func (cc *ChangeCounts) Add(c Change) {
+	switch c.Action {
+	case ActionAdd:
+		cc.Adds++
+	case ActionUpdate:
+		cc.Updates++
+	case ActionDelete:
+		cc.Deletes++
+	}
+}
+
+// FeatureResult the result of a single feature of a replica
+type FeatureResult struct {
+	Feature string       `json:"feature"`
+	Result  Result       `json:"result"`
+	Error   string       `json:"error,omitempty"`
+	Counts  ChangeCounts `json:"counts"`
+}
+
+// ReplicaResult the result and changes of a single replica
+type ReplicaResult struct {
+	Replica  string          `json:"replica"`
+	Version  string          `json:"version,omitempty"`
+	Mode     Mode            `json:"mode,omitempty"`
+	Result   Result          `json:"result"`
+	Error    string          `json:"error,omitempty"`
+	Drift    bool            `json:"drift,omitempty"`
+	Counts   ChangeCounts    `json:"counts"`
+	Features []FeatureResult `json:"features,omitempty"`
+	Changes  []Change        `json:"changes,omitempty"`
+
+	FailedFeatures []string `json:"failedFeatures,omitempty"`
+
+	SkippedDeletes []Change  `json:"skippedDeletes,omitempty"`
+	Rollback       *Rollback `json:"rollback,omitempty"`
+}
+
+// Rollback the result of reverting the changes of a failed replica sync
+type Rollback struct {
+	Reverted []Change          `json:"reverted,omitempty"`
+	Failed   []RollbackFailure `json:"failed,omitempty"`
+}
+
+// RollbackFailure a change that could not be reverted
+type RollbackFailure struct {
+	Change Change `json:"change"`
+	Error  string `json:"error"`
+}
+
+// Run a sync run
+type Run struct {
+	ID      string     `json:"id"`
+	Trigger Trigger    `json:"trigger"`
+	DryRun  bool       `json:"dryRun"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	Result  Result     `json:"result"`
+	Origin  string     `json:"origin"`
+	// OriginHash the hash of the enabled features of the origin config synced to the replicas, set if all replicas
+	// and features were synced successfully
+	OriginHash string           `json:"originHash,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Replicas   []*ReplicaResult `json:"replicas,omitempty"`
+
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+}
+
+// HasChanges returns true if any replica has changes
+func (r *Run) HasChanges() bool {
+	for _, rr := range r.Replicas {
+		if len(rr.Changes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasDrift returns true if any replica in detect mode differs from the origin
+func (r *Run) HasDrift() bool {
+	for _, rr := range r.Replicas {
+		if rr.Drift {
+			return true
+		}
+	}
+	return false
+}
+
+// HasErrors returns true if the run or any replica has an error
+func (r *Run) HasErrors() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, rr := range r.Replicas {
+		if rr.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Finish set the end time and evaluate the result of the run
+func (r *Run) Finish() {
+	now := time.Now()
+	r.End = &now
+
+	if r.Error != "" {
+		r.Result = ResultFailed
+		return
+	}
+	failed, partial := 0, 0
+	for _, rr := range r.Replicas {
+		switch {
+		case rr.Result == ResultPartial:
+			partial++
+		case rr.Error != "":
+			failed++
+		}
+	}
+	switch {
+	case failed == 0 && partial == 0:
+		r.Result = ResultSuccess
+	case failed == len(r.Replicas):
+		r.Result = ResultFailed
+	default:
+		r.Result = ResultPartial
+	}
+}
@@ -0,0 +1,66 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotVersion the current version of the snapshot format
+const SnapshotVersion = "v1"
+
+// Snapshot the synchronized configuration of an AdGuardHome instance
+type Snapshot struct {
+	Version            string     `json:"version"`
+	Created            *time.Time `json:"created,omitempty"`
+	Source             string     `json:"source,omitempty"`
+	AdGuardHomeVersion string     `json:"adGuardHomeVersion,omitempty"`
+
+	GeneralSettings  *GeneralSettings  `json:"generalSettings,omitempty"`
+	QueryLogConfig   *QueryLogConfig   `json:"queryLogConfig,omitempty"`
+	StatsConfig      *IntervalConfig   `json:"statsConfig,omitempty"`
+	Rewrites         *RewriteEntries   `json:"rewrites,omitempty"`
+	Services         *Services         `json:"services,omitempty"`
+	Filtering        *FilteringStatus  `json:"filtering,omitempty"`
+	Clients          *Clients          `json:"clients,omitempty"`
+	AccessList       *AccessList       `json:"accessList,omitempty"`
+	DNSConfig        *DNSConfig        `json:"dnsConfig,omitempty"`
+	DHCPServerConfig *DHCPServerConfig `json:"dhcpServerConfig,omitempty"`
+}
+
+// GeneralSettings the general settings of an instance
+type GeneralSettings struct {
+	ProtectionEnabled bool `json:"protectionEnabled"`
+	Parental          bool `json:"parental"`
+	SafeSearch        bool `json:"safeSearch"`
+	SafeBrowsing      bool `json:"safeBrowsing"`
+}
+
+// Validate checks that the snapshot contains the sections of all enabled features
+func (s *Snapshot) Validate(f *Features) error {
+	sections := map[string]bool{
+		FeatureGeneralSettings:  s.GeneralSettings != nil,
+		FeatureQueryLogConfig:   s.QueryLogConfig != nil,
+		FeatureStatsConfig:      s.StatsConfig != nil,
+		FeatureClientSettings:   s.Clients != nil,
+		FeatureServices:         s.Services != nil,
+		FeatureFilters:          s.Filtering != nil,
+		FeatureDHCPServerConfig: s.DHCPServerConfig != nil,
+		FeatureDHCPStaticLeases: s.DHCPServerConfig != nil,
+		FeatureDNSServerConfig:  s.DNSConfig != nil,
+		FeatureDNSAccessLists:   s.AccessList != nil,
+		FeatureDNSRewrites:      s.Rewrites != nil,
+	}
+	var missing []string
+	for feature, ok := range sections {
+		if !ok && f.Enabled(feature) {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("snapshot has no config for the enabled features %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
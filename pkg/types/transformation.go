@@ -0,0 +1,117 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	// TargetRewrites transformation target of the dns rewrites
+	TargetRewrites = "rewrites"
+	// TargetDNSConfig transformation target of the dns server config
+	TargetDNSConfig = "dnsConfig"
+	// TargetDHCPServerConfig transformation target of the dhcp server config and static leases
+	TargetDHCPServerConfig = "dhcpServerConfig"
+	// TargetClients transformation target of the clients
+	TargetClients = "clients"
+	// TargetUserRules transformation target of the user rules
+	TargetUserRules = "userRules"
+)
+
+// Transformation replaces values of the origin config before they are synced to a replica
+type Transformation struct {
+	// Targets the configs to transform, all if empty
+	Targets []string `json:"targets,omitempty" yaml:"targets,omitempty"`
+	// Find the text to replace, or a regular expression enclosed in slashes
+	Find string `json:"find" yaml:"find"`
+	// Replace the replacement, a go template with the variables of the replica
+	Replace string `json:"replace" yaml:"replace"`
+}
+
+// Replacer replaces the values of the transformations of a replica
+type Replacer struct {
+	rules []replaceRule
+}
+
+type replaceRule struct {
+	targets map[string]bool
+	find    string
+	re      *regexp.Regexp
+	replace string
+}
+
+// Replacer compiles the transformations of the instance, returns nil if it has no transformations
+func (i *AdGuardInstance) Replacer() (*Replacer, error) {
+	if len(i.Transformations) == 0 {
+		return nil, nil
+	}
+	funcs := template.FuncMap{
+		"var": func(name string) (string, error) {
+			for k, v := range i.Variables {
+				if strings.EqualFold(k, name) {
+					return v, nil
+				}
+			}
+			return "", fmt.Errorf("variable %q is not defined", name)
+		},
+	}
+
+	r := &Replacer{}
+	for idx, t := range i.Transformations {
+		rule := replaceRule{find: t.Find}
+		if t.Find == "" {
+			return nil, fmt.Errorf("transformations[%d].find: must not be empty", idx)
+		}
+		if len(t.Find) > 1 && strings.HasPrefix(t.Find, "/") && strings.HasSuffix(t.Find, "/") {
+			re, err := regexp.Compile(t.Find[1 : len(t.Find)-1])
+			if err != nil {
+				return nil, fmt.Errorf("transformations[%d].find: %w", idx, err)
+			}
+			rule.re = re
+		}
+		for _, target := range t.Targets {
+			switch target {
+			case TargetRewrites, TargetDNSConfig, TargetDHCPServerConfig, TargetClients, TargetUserRules:
+			default:
+				return nil, fmt.Errorf("transformations[%d].targets: unknown target %q", idx, target)
+			}
+			if rule.targets == nil {
+				rule.targets = make(map[string]bool)
+			}
+			rule.targets[target] = true
+		}
+
+		tpl, err := template.New("replace").Option("missingkey=error").Funcs(funcs).Parse(t.Replace)
+		if err != nil {
+			return nil, fmt.Errorf("transformations[%d].replace: %w", idx, err)
+		}
+		buf := &bytes.Buffer{}
+		if err := tpl.Execute(buf, i.Variables); err != nil {
+			return nil, fmt.Errorf("transformations[%d].replace: %w", idx, err)
+		}
+		rule.replace = buf.String()
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Replace applies the transformations of the target to the value
+func (r *Replacer) Replace(target string, value string) string {
+	if r == nil {
+		return value
+	}
+	for _, rule := range r.rules {
+		if rule.targets != nil && !rule.targets[target] {
+			continue
+		}
+		if rule.re != nil {
+			value = rule.re.ReplaceAllString(value, rule.replace)
+		} else {
+			value = strings.ReplaceAll(value, rule.find, rule.replace)
+		}
+	}
+	return value
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 )
 
 const (
 	// DefaultAPIPath default api path
 	DefaultAPIPath = "/control"
+	// MinWatchInterval the minimum interval to poll an origin instance, a poll reads all enabled features
+	MinWatchInterval = 10 * time.Second
 )
 
 // Config application configuration struct
@@ -21,14 +24,137 @@ type Config struct {
 	RunOnStart bool              `json:"runOnStart,omitempty" yaml:"runOnStart,omitempty"`
 	API        API               `json:"api,omitempty" yaml:"api,omitempty"`
 	Features   Features          `json:"features,omitempty" yaml:"features,omitempty"`
+
+	MaxParallelReplicas int    `json:"maxParallelReplicas,omitempty" yaml:"maxParallelReplicas,omitempty"`
+	Backup              Backup `json:"backup,omitempty" yaml:"backup,omitempty"`
+	Items               Items  `json:"items,omitempty" yaml:"items,omitempty"`
+
+	Deletes        *bool             `json:"deletes,omitempty" yaml:"deletes,omitempty"`
+	FeatureDeletes *FeaturesOverride `json:"featureDeletes,omitempty" yaml:"featureDeletes,omitempty"`
+	DeleteGuard    DeleteGuard       `json:"deleteGuard,omitempty" yaml:"deleteGuard,omitempty"`
+
+	ContinueOnError bool `json:"continueOnError,omitempty" yaml:"continueOnError,omitempty"`
+	// Force disables skipping the replicas that did not change since the last sync
+	Force bool `json:"force,omitempty" yaml:"force,omitempty"`
+
+	Origins  []AdGuardInstance `json:"origins,omitempty" yaml:"origins,omitempty"`
+	Failover Failover          `json:"failover,omitempty" yaml:"failover,omitempty"`
+
+	MultiMaster MultiMaster `json:"multiMaster,omitempty" yaml:"multiMaster,omitempty"`
+
+	State State `json:"state,omitempty" yaml:"state,omitempty"`
+
+	Watch Watch `json:"watch,omitempty" yaml:"watch,omitempty"`
+
+	Notifications []Notification `json:"notifications,omitempty" yaml:"notifications,omitempty"`
+
+	Log Log `json:"log,omitempty" yaml:"log,omitempty"`
+}
+
+// Log configuration of the log output
+type Log struct {
+	// Format the format of the log entries: console (default) or json
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	// Output the paths (or stdout / stderr) the logs are written to, stdout if empty
+	Output []string `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// Watch configuration of the watch mode, that syncs the replicas when the origin config changed
+type Watch struct {
+	// Interval the interval to poll the origin for changes; if 0 the watch mode is disabled
+	Interval time.Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// Debounce the time the changed origin config must be stable before the replicas are synced
+	Debounce time.Duration `json:"debounce,omitempty" yaml:"debounce,omitempty"`
+}
+
+// Enabled true if a watch interval is configured
+func (w *Watch) Enabled() bool {
+	return w.Interval > 0
+}
+
+// Validate checks the interval, an origin instance is polled at the MinWatchInterval at most. An origin file can be
+// polled at any interval.
+func (w *Watch) Validate(originFile string) error {
+	if w.Interval < 0 {
+		return fmt.Errorf("watch.interval must not be negative")
+	}
+	if w.Enabled() && originFile == "" && w.Interval < MinWatchInterval {
+		return fmt.Errorf("watch.interval %s is shorter than the minimum of %s", w.Interval, MinWatchInterval)
+	}
+	return nil
+}
+
+// State configuration of the state store
+type State struct {
+	// File the embedded key value file to persist the state, the state is kept in memory only if empty
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+}
+
+// Failover configuration of the failover to the next origin candidate
+type Failover struct {
+	// MaxDifferences the maximum number of differences of a candidate to the last known origin config; if 0 they are not checked
+	MaxDifferences int `json:"maxDifferences,omitempty" yaml:"maxDifferences,omitempty"`
+}
+
+// Backup configuration of the origin snapshots
+type Backup struct {
+	Dir      string        `json:"dir,omitempty" yaml:"dir,omitempty"`
+	Format   string        `json:"format,omitempty" yaml:"format,omitempty"`
+	MaxCount int           `json:"maxCount,omitempty" yaml:"maxCount,omitempty"`
+	MaxAge   time.Duration `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+}
+
+// Enabled true if a backup directory is configured
+func (b *Backup) Enabled() bool {
+	return b.Dir != ""
 }
 
 // API configuration
 type API struct {
-	Port     int    `json:"port,omitempty" yaml:"port,omitempty"`
-	Username string `json:"username,omitempty" yaml:"username,omitempty"`
-	Password string `json:"password,omitempty" yaml:"password,omitempty"`
-	DarkMode bool   `json:"darkMode,omitempty" yaml:"darkMode,omitempty"`
+	Port     int     `json:"port,omitempty" yaml:"port,omitempty"`
+	Username string  `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string  `json:"password,omitempty" yaml:"password,omitempty"`
+	DarkMode bool    `json:"darkMode,omitempty" yaml:"darkMode,omitempty"`
+	Webhook  Webhook `json:"webhook,omitempty" yaml:"webhook,omitempty"`
+}
+
+// Webhook configuration of the signed webhook to trigger a sync
+type Webhook struct {
+	// Secret the shared secret of the HMAC-SHA256 signature; if empty the webhook is disabled
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	// MaxAge the maximum age of the signature timestamp
+	MaxAge time.Duration `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+}
+
+// Enabled true if a secret is configured
+func (w *Webhook) Enabled() bool {
+	return w.Secret != ""
+}
+
+// OriginCandidates get the origin instances in the order of priority, the origin is followed by the origins
+func (cfg *Config) OriginCandidates() []AdGuardInstance {
+	if len(cfg.Origins) == 0 {
+		o := cfg.Origin
+		if o.APIPath == "" {
+			o.APIPath = DefaultAPIPath
+		}
+		o.AutoSetup = false
+		return []AdGuardInstance{o}
+	}
+	var candidates []AdGuardInstance
+	seen := make(map[string]bool)
+	for _, o := range append([]AdGuardInstance{cfg.Origin}, cfg.Origins...) {
+		if o.URL == "" || seen[o.Key()] {
+			continue
+		}
+		seen[o.Key()] = true
+		if o.APIPath == "" {
+			o.APIPath = DefaultAPIPath
+		}
+		o.AutoSetup = false
+		candidates = append(candidates, o)
+	}
+	return candidates
 }
 
 // UniqueReplicas get unique replication instances
@@ -53,6 +179,46 @@ func (cfg *Config) UniqueReplicas() []AdGuardInstance {
 	return r
 }
 
+// ParallelReplicas the number of replicas to be synced in parallel
+func (cfg *Config) ParallelReplicas() int {
+	if cfg.MaxParallelReplicas < 1 {
+		return 1
+	}
+	return cfg.MaxParallelReplicas
+}
+
+// ReplicaFeatures the features of the replica merged over the global features
+func (cfg *Config) ReplicaFeatures(replica AdGuardInstance) Features {
+	return cfg.Features.Merge(replica.Features)
+}
+
+// ReplicaItems the item rules of the replica added to the global item rules
+func (cfg *Config) ReplicaItems(replica AdGuardInstance) Items {
+	return cfg.Items.Merge(replica.Items)
+}
+
+// DeletesEnabled returns true if items of the feature are deleted on the replicas, by default deletes are enabled
+func (cfg *Config) DeletesEnabled(feature string) bool {
+	if v := cfg.FeatureDeletes.Get(feature); v != nil {
+		return *v
+	}
+	return cfg.Deletes == nil || *cfg.Deletes
+}
+
+// AnyFeatures the features that are enabled globally or for any replica
+func (cfg *Config) AnyFeatures() Features {
+	enabled := &FeaturesOverride{}
+	for _, r := range cfg.UniqueReplicas() {
+		rf := cfg.ReplicaFeatures(r)
+		for _, f := range AllFeatures {
+			if rf.Enabled(f) {
+				enabled.Set(f, true)
+			}
+		}
+	}
+	return cfg.Features.Merge(enabled)
+}
+
 // AdGuardInstance AdguardHome config instance
 type AdGuardInstance struct {
 	URL                string `json:"url" yaml:"url"`
@@ -62,6 +228,29 @@ type AdGuardInstance struct {
 	InsecureSkipVerify bool   `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
 	AutoSetup          bool   `json:"autoSetup" yaml:"autoSetup"`
 	InterfaceName      string `json:"interfaceName" yaml:"interfaceName"`
+	File               string `json:"file,omitempty" yaml:"file,omitempty"`
+	Mode               Mode   `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	Features *FeaturesOverride `json:"features,omitempty" yaml:"features,omitempty"`
+	Items    *Items            `json:"items,omitempty" yaml:"items,omitempty"`
+
+	Variables       map[string]string `json:"variables,omitempty" yaml:"variables,omitempty"`
+	Transformations []Transformation  `json:"transformations,omitempty" yaml:"transformations,omitempty"`
+}
+
+// Mode the sync mode of a replica
+type Mode string
+
+const (
+	// ModeEnforce the replica is synchronized with the origin (default)
+	ModeEnforce Mode = "enforce"
+	// ModeDetect the differences to the origin are only reported, the replica is not changed
+	ModeDetect Mode = "detect"
+)
+
+// Valid returns true if the mode is known
+func (m Mode) Valid() bool {
+	return m == "" || m == ModeEnforce || m == ModeDetect
 }
 
 // Key AdGuardInstance key
@@ -3,6 +3,8 @@ package types_test
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net"
+	"time"
 
 	"github.com/bakito/adguardhome-sync/pkg/types"
 	"github.com/google/uuid"
@@ -30,6 +32,26 @@ var _ = Describe("Types", func() {
 		})
 	})
 
+	Context("DHCPServerConfig", func() {
+		Context("Clone", func() {
+			It("should copy the config", func() {
+				c := &types.DHCPServerConfig{
+					InterfaceName: "eth0",
+					V4:            &types.V4ServerConfJSON{GatewayIP: net.ParseIP("192.168.1.1")},
+					StaticLeases:  types.Leases{{HWAddr: "00:11:22:33:44:55", IP: net.ParseIP("192.168.1.10"), Hostname: "printer"}},
+				}
+				clone := c.Clone()
+				Ω(clone).Should(Equal(c))
+				Ω(c.InterfaceName).Should(Equal("eth0"))
+
+				clone.V4.LeaseDuration = 3600
+				clone.StaticLeases[0].Hostname = "other"
+				Ω(c.V4.LeaseDuration).Should(BeZero())
+				Ω(c.StaticLeases[0].Hostname).Should(Equal("printer"))
+			})
+		})
+	})
+
 	Context("Filters", func() {
 		Context("Merge", func() {
 			var (
@@ -96,6 +118,49 @@ var _ = Describe("Types", func() {
 			})
 		})
 	})
+	Context("Run", func() {
+		var run *types.Run
+		BeforeEach(func() {
+			run = &types.Run{Replicas: []*types.ReplicaResult{{}, {}}}
+		})
+		Context("Finish", func() {
+			It("should be successful", func() {
+				run.Finish()
+				Ω(run.End).ShouldNot(BeNil())
+				Ω(run.Result).Should(Equal(types.ResultSuccess))
+			})
+			It("should be partial", func() {
+				run.Replicas[0].Error = "error"
+				run.Finish()
+				Ω(run.Result).Should(Equal(types.ResultPartial))
+			})
+			It("should fail if all replicas failed", func() {
+				run.Replicas[0].Error = "error"
+				run.Replicas[1].Error = "error"
+				run.Finish()
+				Ω(run.Result).Should(Equal(types.ResultFailed))
+			})
+			It("should fail on origin error", func() {
+				run.Error = "error"
+				run.Finish()
+				Ω(run.Result).Should(Equal(types.ResultFailed))
+			})
+		})
+	})
+	Context("Snapshot", func() {
+		Context("Validate", func() {
+			It("should accept a snapshot with all enabled features", func() {
+				s := &types.Snapshot{Rewrites: &types.RewriteEntries{}}
+				Ω(s.Validate(&types.Features{DNS: types.DNS{Rewrites: true}})).ShouldNot(HaveOccurred())
+			})
+			It("should list the missing features", func() {
+				s := &types.Snapshot{Rewrites: &types.RewriteEntries{}}
+				err := s.Validate(&types.Features{DNS: types.DNS{Rewrites: true}, DHCP: types.DHCP{StaticLeases: true}, Services: true})
+				Ω(err).Should(HaveOccurred())
+				Ω(err.Error()).Should(HaveSuffix("dhcp.staticLeases, services"))
+			})
+		})
+	})
 	Context("AdGuardInstance", func() {
 		It("should build a key with url and api apiPath", func() {
 			i := &types.AdGuardInstance{URL: url, APIPath: apiPath}
@@ -216,12 +281,107 @@ var _ = Describe("Types", func() {
 			ur := types.UserRules([]string{r1, r2})
 			Ω(ur.String()).Should(Equal(r1 + "\n" + r2))
 		})
+		It("should split the local sections", func() {
+			ur := types.UserRules{"a", types.UserRulesLocalStart, "b", types.UserRulesLocalEnd, "c"}
+			synced, local := ur.Split()
+			Ω(synced).Should(Equal(types.UserRules{"a", "c"}))
+			Ω(local).Should(Equal(types.UserRules{types.UserRulesLocalStart, "b", types.UserRulesLocalEnd}))
+		})
+	})
+	Context("Replacer", func() {
+		var instance *types.AdGuardInstance
+		BeforeEach(func() {
+			instance = &types.AdGuardInstance{Variables: map[string]string{"siteIP": "10.1.0.2"}}
+		})
+		It("should be nil without transformations", func() {
+			r, err := instance.Replacer()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(r.Replace(types.TargetRewrites, "foo")).Should(Equal("foo"))
+		})
+		It("should replace text with the rendered template", func() {
+			instance.Transformations = []types.Transformation{{Find: "10.0.0.2", Replace: `{{ var "siteip" }}`}}
+			r, err := instance.Replacer()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(r.Replace(types.TargetRewrites, "10.0.0.2")).Should(Equal("10.1.0.2"))
+		})
+		It("should replace regular expressions for the targets only", func() {
+			instance.Transformations = []types.Transformation{{
+				Targets: []string{types.TargetDNSConfig},
+				Find:    `/^tls://(.*)\.site-a\.example$/`,
+				Replace: `tls://${1}.site-b.example`,
+			}}
+			r, err := instance.Replacer()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(r.Replace(types.TargetDNSConfig, "tls://dns.site-a.example")).Should(Equal("tls://dns.site-b.example"))
+			Ω(r.Replace(types.TargetRewrites, "tls://dns.site-a.example")).Should(Equal("tls://dns.site-a.example"))
+		})
+		It("should fail with an undefined variable", func() {
+			instance.Transformations = []types.Transformation{{Find: "a", Replace: `{{ var "foo" }}`}}
+			_, err := instance.Replacer()
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring(`variable "foo" is not defined`))
+		})
+		It("should fail with an unknown target", func() {
+			instance.Transformations = []types.Transformation{{Find: "a", Targets: []string{"foo"}}}
+			_, err := instance.Replacer()
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(HavePrefix("transformations[0].targets"))
+		})
+	})
+	Context("ItemRules", func() {
+		It("should manage all items without rules", func() {
+			m, err := types.ItemRules{}.Matcher()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m).Should(BeNil())
+			Ω(m.Managed("foo")).Should(BeTrue())
+		})
+		It("should match globs case insensitive", func() {
+			m, err := types.ItemRules{Exclude: []string{"guest-?.*"}}.Matcher()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Managed("Guest-1.home")).Should(BeFalse())
+			Ω(m.Managed("guest-12.home")).Should(BeTrue())
+			Ω(m.Managed("xguest-1.home")).Should(BeTrue())
+		})
+		It("should match regular expressions", func() {
+			m, err := types.ItemRules{Include: []string{"/^nas/"}, Exclude: []string{"/backup/"}}.Matcher()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Managed("nas.home")).Should(BeTrue())
+			Ω(m.Managed("nas-backup.home")).Should(BeFalse())
+			Ω(m.Managed("printer.home")).Should(BeFalse())
+		})
+		It("should manage an item if any value matches", func() {
+			m, err := types.ItemRules{Exclude: []string{"device_guest"}}.Matcher()
+			Ω(err).ShouldNot(HaveOccurred())
+			clients := &types.Clients{Clients: []types.Client{{Name: "a", Tags: []string{"device_guest"}}, {Name: "b"}}}
+			Ω(clients.Select(m).Clients).Should(Equal([]types.Client{{Name: "b"}}))
+		})
+		It("should fail with an invalid regular expression", func() {
+			items := &types.Items{Clients: types.ItemRules{Include: []string{"/(/"}}}
+			err := items.Validate()
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("clients"))
+		})
+		It("should add the rules of the replica", func() {
+			items := &types.Items{Rewrites: types.ItemRules{Exclude: []string{"a"}}}
+			merged := items.Merge(&types.Items{Rewrites: types.ItemRules{Exclude: []string{"b"}}})
+			Ω(merged.Rewrites.Exclude).Should(Equal([]string{"a", "b"}))
+			Ω(items.Rewrites.Exclude).Should(Equal([]string{"a"}))
+		})
 	})
 	Context("Config", func() {
 		var cfg *types.Config
 		BeforeEach(func() {
 			cfg = &types.Config{}
 		})
+		Context("ParallelReplicas", func() {
+			It("should sync one replica at a time by default", func() {
+				Ω(cfg.ParallelReplicas()).Should(Equal(1))
+			})
+			It("should use the configured value", func() {
+				cfg.MaxParallelReplicas = 3
+				Ω(cfg.ParallelReplicas()).Should(Equal(3))
+			})
+		})
 		Context("UniqueReplicas", func() {
 			It("should be empty if noting defined", func() {
 				r := cfg.UniqueReplicas()
@@ -258,6 +418,127 @@ var _ = Describe("Types", func() {
 				Ω(r[1].APIPath).Should(Equal(types.DefaultAPIPath))
 			})
 		})
+		Context("ReplicaFeatures", func() {
+			BeforeEach(func() {
+				cfg.Features = types.Features{Services: true, DHCP: types.DHCP{ServerConfig: true, StaticLeases: true}}
+			})
+			It("should use the global features without override", func() {
+				Ω(cfg.ReplicaFeatures(types.AdGuardInstance{})).Should(Equal(cfg.Features))
+			})
+			It("should merge the override over the global features", func() {
+				o := &types.FeaturesOverride{}
+				o.Set(types.FeatureDHCPServerConfig, false)
+				o.Set(types.FeatureFilters, true)
+				f := cfg.ReplicaFeatures(types.AdGuardInstance{Features: o})
+				Ω(f).Should(Equal(types.Features{Services: true, Filters: true, DHCP: types.DHCP{StaticLeases: true}}))
+				Ω(cfg.Features.DHCP.ServerConfig).Should(BeTrue())
+			})
+		})
+		Context("DeletesEnabled", func() {
+			It("should enable deletes by default", func() {
+				Ω(cfg.DeletesEnabled(types.FeatureFilters)).Should(BeTrue())
+			})
+			It("should use the feature override over the global flag", func() {
+				deletes := false
+				cfg.Deletes = &deletes
+				cfg.FeatureDeletes = &types.FeaturesOverride{}
+				cfg.FeatureDeletes.Set(types.FeatureDNSRewrites, true)
+				Ω(cfg.DeletesEnabled(types.FeatureFilters)).Should(BeFalse())
+				Ω(cfg.DeletesEnabled(types.FeatureDNSRewrites)).Should(BeTrue())
+			})
+		})
+		Context("MultiMaster", func() {
+			It("should be valid if disabled", func() {
+				Ω(cfg.MultiMaster.Validate("", nil)).ShouldNot(HaveOccurred())
+			})
+			It("should fail with an unknown resolution", func() {
+				cfg.MultiMaster.Resolution = "oldest-wins"
+				Ω(cfg.MultiMaster.Validate("", nil)).Should(HaveOccurred())
+			})
+			It("should fail with an origin file", func() {
+				cfg.MultiMaster.Enabled = true
+				Ω(cfg.MultiMaster.Validate("origin.yaml", nil)).Should(HaveOccurred())
+			})
+			It("should fail with a transformed replica", func() {
+				cfg.MultiMaster.Enabled = true
+				replicas := []types.AdGuardInstance{{URL: "https://replica", Transformations: []types.Transformation{{Find: "a", Replace: "b"}}}}
+				Ω(cfg.MultiMaster.Validate("", replicas)).Should(HaveOccurred())
+			})
+		})
+		Context("Watch", func() {
+			It("should accept the minimum interval for an origin instance", func() {
+				cfg.Watch.Interval = types.MinWatchInterval
+				Ω(cfg.Watch.Validate("")).ShouldNot(HaveOccurred())
+			})
+			It("should fail with a shorter interval for an origin instance", func() {
+				cfg.Watch.Interval = time.Second
+				Ω(cfg.Watch.Validate("")).Should(MatchError("watch.interval 1s is shorter than the minimum of 10s"))
+			})
+			It("should accept a shorter interval for an origin file", func() {
+				cfg.Watch.Interval = time.Second
+				Ω(cfg.Watch.Validate("origin.yaml")).ShouldNot(HaveOccurred())
+			})
+		})
+		Context("DeleteGuard", func() {
+			It("should not check the deletes if not enabled", func() {
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 0, 10, 10)).ShouldNot(HaveOccurred())
+			})
+			It("should abort on an empty origin", func() {
+				cfg.DeleteGuard.EmptyOrigin = true
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 1, 10, 9)).ShouldNot(HaveOccurred())
+				err := cfg.DeleteGuard.Check(types.FeatureFilters, 0, 10, 10)
+				Ω(err).Should(BeAssignableToTypeOf(&types.DeleteGuardError{}))
+				Ω(err.Error()).Should(ContainSubstring("the origin has no items"))
+			})
+			It("should abort if more than the maximum number of items are deleted", func() {
+				cfg.DeleteGuard.MaxCount = 2
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 1, 10, 2)).ShouldNot(HaveOccurred())
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 1, 10, 3)).Should(HaveOccurred())
+			})
+			It("should abort if more than the maximum percentage of items are deleted", func() {
+				cfg.DeleteGuard.MaxPercent = 50
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 1, 10, 5)).ShouldNot(HaveOccurred())
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 1, 10, 6)).Should(HaveOccurred())
+			})
+			It("should not abort if forced", func() {
+				cfg.DeleteGuard.MaxCount = 1
+				cfg.DeleteGuard.Force = true
+				Ω(cfg.DeleteGuard.Check(types.FeatureFilters, 0, 10, 10)).ShouldNot(HaveOccurred())
+			})
+			It("should fail with an invalid percentage", func() {
+				cfg.DeleteGuard.MaxPercent = 101
+				Ω(cfg.DeleteGuard.Validate()).Should(HaveOccurred())
+			})
+		})
+		Context("OriginCandidates", func() {
+			It("should use the origin if no origins are configured", func() {
+				cfg.Origin = types.AdGuardInstance{URL: url, AutoSetup: true}
+				c := cfg.OriginCandidates()
+				Ω(c).Should(HaveLen(1))
+				Ω(c[0].URL).Should(Equal(url))
+				Ω(c[0].APIPath).Should(Equal(types.DefaultAPIPath))
+				Ω(c[0].AutoSetup).Should(BeFalse())
+			})
+			It("should put the origin before the unique origins", func() {
+				cfg.Origin = types.AdGuardInstance{URL: url}
+				cfg.Origins = []types.AdGuardInstance{{URL: url + "2"}, {URL: url}, {URL: url + "3"}}
+				c := cfg.OriginCandidates()
+				Ω(c).Should(HaveLen(3))
+				Ω(c[0].URL).Should(Equal(url))
+				Ω(c[1].URL).Should(Equal(url + "2"))
+				Ω(c[2].URL).Should(Equal(url + "3"))
+			})
+		})
+		Context("AnyFeatures", func() {
+			It("should include the features enabled for a single replica", func() {
+				cfg.Features = types.Features{Services: true}
+				o := &types.FeaturesOverride{}
+				o.Set(types.FeatureServices, false)
+				o.Set(types.FeatureDNSRewrites, true)
+				cfg.Replicas = []types.AdGuardInstance{{URL: url, Features: o}, {URL: url + "1"}}
+				Ω(cfg.AnyFeatures()).Should(Equal(types.Features{Services: true, DNS: types.DNS{Rewrites: true}}))
+			})
+		})
 	})
 
 	Context("Clients", func() {